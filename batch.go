@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type batchItems[T any] struct {
+	items []T
+	full  chan bool // closed when the batch size is reached
+}
+
+/*
+ * Collects items of concurrent outputs. The first item starts the batch
+ * and its goroutine sends all the items collected in the time window.
+ */
+type outputBatch[T any] struct {
+	sync.Mutex
+	groups map[string]*batchItems[T]
+}
+
+/*
+ * Returns the items to send and true for the goroutine which started the batch,
+ * false for all others: their item is sent by the first one
+ */
+func (b *outputBatch[T]) add(item T, size int, window time.Duration) ([]T, bool) {
+	return b.addKey("", item, size, window, nil)
+}
+
+/*
+ * Same as add, items with the same key are collected together.
+ * Closed stop sends the collected items before the end of the window.
+ */
+func (b *outputBatch[T]) addKey(key string, item T, size int, window time.Duration,
+	stop <-chan bool) ([]T, bool) {
+	if size <= 1 || window <= 0 {
+		return []T{item}, true
+	}
+
+	b.Lock()
+	if batch := b.groups[key]; batch != nil {
+		batch.items = append(batch.items, item)
+		if len(batch.items) >= size {
+			delete(b.groups, key)
+			close(batch.full)
+		}
+		b.Unlock()
+		return nil, false
+	}
+	if b.groups == nil {
+		b.groups = make(map[string]*batchItems[T])
+	}
+	batch := &batchItems[T]{items: []T{item}, full: make(chan bool)}
+	b.groups[key] = batch
+	b.Unlock()
+
+	select {
+	case <-time.After(window):
+	case <-batch.full:
+	case <-stop:
+	}
+
+	b.Lock()
+	if b.groups[key] == batch {
+		delete(b.groups, key)
+	}
+	items := batch.items
+	b.Unlock()
+	return items, true
+}
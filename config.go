@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -20,6 +22,9 @@ func InitConfig(configName string, Context *_context) error {
 	if err := viper.Unmarshal(&Context.Config); err != nil {
 		return fmt.Errorf("error parsing config: %s", err)
 	}
+	if err := validateConfig(Context); err != nil {
+		return fmt.Errorf("invalid config: %s", err)
+	}
 
 	// -----------------
 	if Context.Config.QueueSize < 1 {
@@ -48,8 +53,69 @@ func InitConfig(configName string, Context *_context) error {
 	}
 	Context.ExecTimeout *= time.Millisecond
 
-	Context.Messages = make(chan string, Context.Config.QueueSize)
+	Context.Messages = make(chan InputMessage, Context.Config.QueueSize)
 	Context.StopChan = make(chan bool)
 
 	return nil
 }
+
+/*
+ * Methods of the steps which lead back to a method on the path,
+ * a step would run the method again and again
+ */
+func stepsCycle(Context *_context, name string, path []string) []string {
+	if slices.Contains(path, name) {
+		return append(path, name)
+	}
+	path = append(path, name)
+	for _, step := range Context.Config.Methods[name].Steps {
+		if step.Method == "" {
+			continue
+		}
+		if cycle := stepsCycle(Context, step.Method, path); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+/*
+ * Settings which cannot work, so they are not found only when a message comes
+ */
+func validateConfig(Context *_context) error {
+	for name, method := range Context.Config.Methods {
+		for i := range method.Mattermost {
+			if method.Mattermost[i].Token != "" && method.Mattermost[i].Url == "" {
+				return fmt.Errorf("method %s: mattermost with token needs the url of the server", name)
+			}
+		}
+		for i := range method.Gotify {
+			if method.Gotify[i].Url == "" {
+				return fmt.Errorf("method %s: gotify needs the url of the server", name)
+			}
+		}
+		for _, step := range method.Steps {
+			if _, ok := Context.Config.Methods[step.Method]; step.Method != "" && !ok {
+				return fmt.Errorf("method %s: step %s runs unknown method %s", name, step.Name, step.Method)
+			}
+		}
+		if cycle := stepsCycle(Context, name, nil); cycle != nil {
+			return fmt.Errorf("method steps run each other: %s", strings.Join(cycle, " -> "))
+		}
+		for i := range method.Zabbix {
+			switch method.Zabbix[i].TlsConnect {
+			case "", "unencrypted", "cert":
+			default:
+				return fmt.Errorf("method %s: unknown zabbix tls-connect %s", name, method.Zabbix[i].TlsConnect)
+			}
+		}
+		for i := range method.Pushover {
+			out := &method.Pushover[i]
+			if strings.Contains(out.Attach, "{{") && !out.AttachTemplated {
+				return fmt.Errorf("method %s: pushover downloads attach %s, a templated url needs attach-templated",
+					name, out.Attach)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+ * Dedup windows of the methods by method and fingerprint
+ */
+type dedupState struct {
+	sync.Mutex
+	entries   map[string]*dedupEntry
+	followups []*dedupEntry // closed windows waiting for a free worker
+}
+
+type dedupEntry struct {
+	method      string // name in the config, "default" for unknown methods
+	fingerprint string
+	persistent  bool
+	expires     time.Time
+	suppressed  int
+
+	// the last suppressed message is sent as the follow-up
+	jsonrpc JsonRpcRequest
+	peer    map[string]interface{}
+}
+
+/*
+ * Returns false for a repeat of a message within the dedup window,
+ * the repeats are counted for the follow-up.
+ */
+func dedupMessage(msg_ctx *MessageContext, method string, dedup *_dedupConfig) bool {
+	fingerprint := replaceJSONPathTags(msg_ctx, dedup.Key, &dedup.tags.Key)
+	if dedup.Key == "" {
+		fingerprint = jsonValueString(msg_ctx.JsonRpc.Params)
+	}
+	key := method + "\x00" + fingerprint
+
+	state := &msg_ctx.Context.Dedup
+	state.Lock()
+	defer state.Unlock()
+	if state.entries == nil {
+		state.entries = make(map[string]*dedupEntry)
+	}
+	entry, ok := state.entries[key]
+	if ok && time.Now().Before(entry.expires) {
+		entry.suppressed += 1
+		entry.jsonrpc = msg_ctx.JsonRpc
+		entry.peer = msg_ctx.Peer
+		return false
+	}
+	if ok && entry.suppressed > 0 { // expired, not collected by the ticker yet
+		state.followups = append(state.followups, entry)
+	}
+
+	window := time.Duration(dedup.Window) * time.Millisecond
+	if dedup.Window == 0 {
+		window = time.Minute
+	}
+	state.entries[key] = &dedupEntry{
+		method:      method,
+		fingerprint: fingerprint,
+		persistent:  dedup.Persistent,
+		expires:     time.Now().Add(window),
+	}
+	return true
+}
+
+/*
+ * Sends the follow-ups of the closed windows while there are free workers,
+ * the others wait for the next tick. With flush all windows are closed and sent.
+ */
+func dedupFollowups(Context *_context, flush bool) {
+	now := time.Now()
+	state := &Context.Dedup
+	state.Lock()
+	for key, entry := range state.entries {
+		if !flush && now.Before(entry.expires) {
+			continue
+		}
+		delete(state.entries, key)
+		if entry.suppressed > 0 {
+			state.followups = append(state.followups, entry)
+		}
+	}
+	var followups []*dedupEntry
+	for len(state.followups) > 0 &&
+		(flush || ActiveWorkers.Get()+int64(len(followups)) < int64(Context.Config.Workers)) {
+		followups = append(followups, state.followups[0])
+		state.followups = state.followups[1:]
+	}
+	state.Unlock()
+
+	for _, entry := range followups {
+		sendDedupFollowup(Context, entry)
+	}
+}
+
+/*
+ * Persistent entries are moved to the new config if its method still has dedup,
+ * the follow-ups of the others are sent with the new config
+ */
+func reloadDedup(old_Context *_context, new_Context *_context) {
+	old_Context.Dedup.Lock()
+	new_Context.Dedup.Lock()
+	for key, entry := range old_Context.Dedup.entries {
+		method, ok := new_Context.Config.Methods[entry.method]
+		if entry.persistent && ok && method.Dedup != nil && method.Dedup.Persistent {
+			if new_Context.Dedup.entries == nil {
+				new_Context.Dedup.entries = make(map[string]*dedupEntry)
+			}
+			new_Context.Dedup.entries[key] = entry
+		} else if entry.suppressed > 0 {
+			new_Context.Dedup.followups = append(new_Context.Dedup.followups, entry)
+		}
+	}
+	new_Context.Dedup.followups = append(new_Context.Dedup.followups, old_Context.Dedup.followups...)
+	old_Context.Dedup.entries = nil
+	old_Context.Dedup.followups = nil
+	new_Context.Dedup.Unlock()
+	old_Context.Dedup.Unlock()
+}
+
+/*
+ * The last suppressed message with "suppressed" count and "fingerprint",
+ * sent to followup-method or to the method of the message, without dedup
+ */
+func sendDedupFollowup(Context *_context, entry *dedupEntry) {
+	method_name := entry.method
+	if method, ok := Context.Config.Methods[method_name]; ok && method.Dedup != nil &&
+		method.Dedup.FollowupMethod != "" {
+		method_name = method.Dedup.FollowupMethod
+	}
+	method, ok := Context.Config.Methods[method_name]
+	if !ok {
+		log.Printf("DEDUP: cannot send follow-up of %s to method %s", entry.fingerprint, method_name)
+		return
+	}
+
+	params := map[string]interface{}{}
+	if entry_params, ok := entry.jsonrpc.Params.(map[string]interface{}); ok {
+		for k, v := range entry_params {
+			params[k] = v
+		}
+	} else if entry.jsonrpc.Params != nil {
+		params["params"] = entry.jsonrpc.Params
+	}
+	params["suppressed"] = float64(entry.suppressed) // as decoded from JSON
+	params["fingerprint"] = entry.fingerprint
+
+	msg_ctx := &MessageContext{
+		JsonRpc: JsonRpcRequest{
+			JSONRPC: entry.jsonrpc.JSONRPC,
+			Method:  method_name,
+			Params:  params,
+			Id:      entry.jsonrpc.Id,
+		},
+		JSONPath_Cache: make(map[string]string),
+		Peer:           entry.peer,
+		Context:        Context,
+	}
+	log.Printf("DEDUP: %d duplicates of %s suppressed", entry.suppressed, entry.fingerprint)
+	dispatchMessage(msg_ctx, &method)
+}
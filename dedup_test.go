@@ -0,0 +1,161 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func dedupTestContext(t *testing.T, dedup *_dedupConfig) (*_context, func() []pushRequest) {
+	server, requests := newPushServer(t)
+	Context := testContext()
+	Context.Config.Methods = map[string]_methodConfig{
+		"alert": {
+			Dedup: dedup,
+			Ntfy: []_outPushConfig{{Url: server.URL, Topic: "alerts",
+				Message: "{{$.text}} suppressed={{$.suppressed}} fingerprint={{$.fingerprint}}"}},
+		},
+		"alert.repeats": {
+			Ntfy: []_outPushConfig{{Url: server.URL, Topic: "repeats",
+				Message: "{{$.text}} suppressed={{$.suppressed}}"}},
+		},
+	}
+	return Context, requests
+}
+
+func waitPushRequests(t *testing.T, requests func() []pushRequest, n int) []pushRequest {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(requests()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // no more than n
+	sent := requests()
+	if len(sent) != n {
+		t.Fatalf("%d messages sent, want %d", len(sent), n)
+	}
+	return sent
+}
+
+func sendDedup(t *testing.T, Context *_context, params string) bool {
+	t.Helper()
+	method := Context.Config.Methods["alert"]
+	return dedupMessage(testMessage(t, Context, "alert", params), "alert", method.Dedup)
+}
+
+func TestDedupWindow(t *testing.T) {
+	Context, _ := dedupTestContext(t, &_dedupConfig{Key: "{{$.host}}", Window: 60000})
+
+	passed := []bool{
+		sendDedup(t, Context, `{"host":"web1","text":"disk full"}`),
+		sendDedup(t, Context, `{"host":"web1","text":"disk still full"}`),
+		sendDedup(t, Context, `{"host":"web2","text":"disk full"}`),
+		sendDedup(t, Context, `{"host":"web1","text":"disk 99%"}`),
+	}
+	want := []bool{true, false, true, false}
+	for ii := range want {
+		if passed[ii] != want[ii] {
+			t.Errorf("message %d passed %v, want %v", ii, passed[ii], want[ii])
+		}
+	}
+	entry := Context.Dedup.entries["alert\x00web1"]
+	if entry == nil || entry.suppressed != 2 {
+		t.Fatalf("entry %+v, want 2 suppressed", entry)
+	}
+	if params := entry.jsonrpc.Params.(map[string]interface{}); params["text"] != "disk 99%" {
+		t.Errorf("follow-up %v, want the last suppressed message", params)
+	}
+}
+
+func TestDedupDefaultKey(t *testing.T) {
+	Context, _ := dedupTestContext(t, &_dedupConfig{})
+
+	if !sendDedup(t, Context, `{"a":1,"b":2}`) {
+		t.Error("first message suppressed")
+	}
+	if sendDedup(t, Context, `{"b":2,"a":1}`) {
+		t.Error("same params passed")
+	}
+	if !sendDedup(t, Context, `{"a":1,"b":3}`) {
+		t.Error("other params suppressed")
+	}
+}
+
+func TestDedupFollowup(t *testing.T) {
+	Context, requests := dedupTestContext(t, &_dedupConfig{Key: "{{$.host}}", Window: 30})
+
+	sendDedup(t, Context, `{"host":"web1","text":"first"}`)
+	sendDedup(t, Context, `{"host":"web1","text":"second"}`)
+	sendDedup(t, Context, `{"host":"web1","text":"third"}`)
+	sendDedup(t, Context, `{"host":"web2","text":"once"}`)
+
+	dedupFollowups(Context, false)
+	if len(requests()) != 0 || len(Context.Dedup.entries) != 2 {
+		t.Fatal("follow-up sent before the end of the window")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	dedupFollowups(Context, false)
+	sent := waitPushRequests(t, requests, 1)
+	if message := sent[0].body["message"]; message != "third suppressed=2 fingerprint=web1" {
+		t.Errorf("follow-up %q, want the last message with 2 suppressed", message)
+	}
+	if len(Context.Dedup.entries) != 0 {
+		t.Errorf("%d entries left after the window", len(Context.Dedup.entries))
+	}
+}
+
+/*
+ * A window expired before the ticker collected it, the next message opens
+ * a new window and the repeats of the old one are still sent
+ */
+func TestDedupExpiredBeforeTick(t *testing.T) {
+	Context, requests := dedupTestContext(t,
+		&_dedupConfig{Key: "{{$.host}}", Window: 30, FollowupMethod: "alert.repeats"})
+
+	sendDedup(t, Context, `{"host":"web1","text":"first"}`)
+	sendDedup(t, Context, `{"host":"web1","text":"second"}`)
+	sendDedup(t, Context, `{"host":"web1","text":"third"}`)
+	time.Sleep(50 * time.Millisecond)
+	if !sendDedup(t, Context, `{"host":"web1","text":"fourth"}`) {
+		t.Fatal("message after the window suppressed")
+	}
+	if sendDedup(t, Context, `{"host":"web1","text":"fifth"}`) {
+		t.Fatal("repeat in the new window passed")
+	}
+
+	dedupFollowups(Context, false)
+	sent := waitPushRequests(t, requests, 1)
+	if sent[0].body["topic"] != "repeats" || sent[0].body["message"] != "third suppressed=2" {
+		t.Errorf("follow-up %v, want the repeats of the expired window", sent[0].body)
+	}
+
+	// the new window is sent on flush
+	dedupFollowups(Context, true)
+	sent = waitPushRequests(t, requests, 2)
+	if sent[1].body["message"] != "fifth suppressed=1" {
+		t.Errorf("flushed follow-up %v, want the repeat of the new window", sent[1].body)
+	}
+}
+
+func TestReloadDedup(t *testing.T) {
+	old_Context, _ := dedupTestContext(t, &_dedupConfig{Key: "{{$.host}}", Persistent: true})
+	sendDedup(t, old_Context, `{"host":"web1"}`)
+	sendDedup(t, old_Context, `{"host":"web1"}`)
+
+	new_Context, _ := dedupTestContext(t, &_dedupConfig{Key: "{{$.host}}", Persistent: true})
+	reloadDedup(old_Context, new_Context)
+	if sendDedup(t, new_Context, `{"host":"web1"}`) {
+		t.Error("persistent window not kept on reload")
+	}
+	if entry := new_Context.Dedup.entries["alert\x00web1"]; entry == nil || entry.suppressed != 2 {
+		t.Errorf("entry %+v, want the 2 repeats", entry)
+	}
+
+	// without persistent the follow-up is sent with the new config
+	other_Context, _ := dedupTestContext(t, &_dedupConfig{Key: "{{$.host}}"})
+	reloadDedup(new_Context, other_Context)
+	if len(other_Context.Dedup.entries) != 0 || len(other_Context.Dedup.followups) != 1 {
+		t.Errorf("%d entries %d follow-ups, want the window closed",
+			len(other_Context.Dedup.entries), len(other_Context.Dedup.followups))
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+type digestItem struct {
+	params interface{}
+	line   string
+}
+
+/*
+ * With digest window the messages of the output are grouped by the templated key
+ * and sent as one message with params:
+ *   count   - number of messages
+ *   key     - the group key
+ *   items   - array of the messages params
+ *   list    - the item lines, one per message
+ *   summary - resolved with the params above
+ * Returns the digest message for the goroutine which sends it, nil for the others.
+ * Without window the message is returned as it is.
+ */
+func collectDigest(msg_ctx *MessageContext, digest *_digestConfig) *MessageContext {
+	if digest.Window == 0 {
+		return msg_ctx
+	}
+	PendingMessages.Increment()
+	defer PendingMessages.Decrement()
+
+	key := replaceJSONPathTags(msg_ctx, digest.Key, &digest.tags.Key)
+	item := digestItem{
+		params: msg_ctx.JsonRpc.Params,
+		line:   replaceJSONPathTags(msg_ctx, digest.Item, &digest.tags.Item),
+	}
+	if digest.Item == "" {
+		item.line = jsonValueString(item.params)
+	}
+
+	max := int(digest.Max)
+	if max == 0 {
+		max = 1000
+	}
+	window := time.Duration(digest.Window) * time.Millisecond
+	items, ok := digest.batch.addKey(key, item, max, window, msg_ctx.Context.StopChan)
+	if !ok {
+		return nil // sent by the first message of the digest
+	}
+
+	params := make([]interface{}, len(items))
+	lines := make([]string, len(items))
+	for ii := range items {
+		params[ii] = items[ii].params
+		lines[ii] = items[ii].line
+	}
+	digest_params := map[string]interface{}{
+		"count": len(items),
+		"key":   key,
+		"items": params,
+		"list":  strings.Join(lines, "\n"),
+	}
+
+	// params are decoded from JSON, so the tags see the same types as in a message
+	digest_ctx := &MessageContext{
+		JsonRpc: JsonRpcRequest{
+			JSONRPC: msg_ctx.JsonRpc.JSONRPC,
+			Method:  msg_ctx.JsonRpc.Method,
+		},
+		JSONPath_Cache: make(map[string]string),
+		Peer:           msg_ctx.Peer,
+		Context:        msg_ctx.Context,
+	}
+	digest_json, _ := json.Marshal(digest_params)
+	json.Unmarshal(digest_json, &digest_ctx.JsonRpc.Params)
+
+	summary := replaceJSONPathTags(digest_ctx, digest.Summary, &digest.tags.Summary)
+	digest_ctx.JsonRpc.Params.(map[string]interface{})["summary"] = summary
+	return digest_ctx
+}
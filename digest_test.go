@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * The tag lists of a digest are parsed by its first message,
+ * in the notifier the concurrent ones come after it
+ */
+func parseDigestTags(digest *_digestConfig) {
+	for _, field := range []struct {
+		template string
+		tags     **[]string
+	}{{digest.Key, &digest.tags.Key}, {digest.Item, &digest.tags.Item}, {digest.Summary, &digest.tags.Summary}} {
+		tags := findTags(field.template)
+		*field.tags = &tags
+	}
+}
+
+/*
+ * Sends the messages concurrently, in order, and returns the digests
+ */
+func collectDigests(t *testing.T, Context *_context, digest *_digestConfig, params []string) []*MessageContext {
+	var lock sync.Mutex
+	var digests []*MessageContext
+	var wg sync.WaitGroup
+	for _, p := range params {
+		msg_ctx := testMessage(t, Context, "alert", p)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if digest_ctx := collectDigest(msg_ctx, digest); digest_ctx != nil {
+				lock.Lock()
+				digests = append(digests, digest_ctx)
+				lock.Unlock()
+			}
+		}()
+		time.Sleep(2 * time.Millisecond)
+	}
+	wg.Wait()
+	sort.Slice(digests, func(i, j int) bool {
+		return digestParam(digests[i], "key") < digestParam(digests[j], "key")
+	})
+	return digests
+}
+
+func digestParam(msg_ctx *MessageContext, name string) string {
+	value := msg_ctx.JsonRpc.Params.(map[string]interface{})[name]
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func TestDigestKeys(t *testing.T) {
+	Context := testContext()
+	digest := &_digestConfig{Window: 50, Key: "{{$.host}}", Item: "{{$.host}}: {{$.text}}",
+		Summary: "{{$.count}} alerts on {{$.key}}"}
+	parseDigestTags(digest)
+
+	digests := collectDigests(t, Context, digest, []string{
+		`{"host":"web1","text":"disk full"}`,
+		`{"host":"web2","text":"cpu"}`,
+		`{"host":"web1","text":"disk still full"}`,
+	})
+	if len(digests) != 2 {
+		t.Fatalf("%d digests, want one per host", len(digests))
+	}
+	want := []map[string]string{
+		{"count": "2", "key": "web1", "list": "web1: disk full\nweb1: disk still full", "summary": "2 alerts on web1",
+			"items": `[{"host":"web1","text":"disk full"},{"host":"web1","text":"disk still full"}]`},
+		{"count": "1", "key": "web2", "list": "web2: cpu", "summary": "1 alerts on web2",
+			"items": `[{"host":"web2","text":"cpu"}]`},
+	}
+	for ii := range want {
+		for name, value := range want[ii] {
+			if got := digestParam(digests[ii], name); got != value {
+				t.Errorf("digest %d %s %q, want %q", ii, name, got, value)
+			}
+		}
+	}
+	if PendingMessages.Get() != 0 {
+		t.Errorf("%d pending messages after the digests", PendingMessages.Get())
+	}
+}
+
+func TestDigestMax(t *testing.T) {
+	Context := testContext()
+	digest := &_digestConfig{Window: 60000, Max: 2}
+	parseDigestTags(digest)
+
+	start := time.Now()
+	digests := collectDigests(t, Context, digest, []string{`{"a":1}`, `{"a":2}`})
+	if len(digests) != 1 || digestParam(digests[0], "list") != "{\"a\":1}\n{\"a\":2}" {
+		t.Fatalf("digests %v, want one with the params as JSON", digests)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("digest sent after the window, not at max")
+	}
+
+	// the rest is sent on stop
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(Context.StopChan)
+	}()
+	digests = collectDigests(t, Context, digest, []string{`{"a":3}`})
+	if len(digests) != 1 || digestParam(digests[0], "count") != "1" {
+		t.Errorf("digests %v, want the collected message on stop", digests)
+	}
+}
+
+func TestDigestNtfy(t *testing.T) {
+	server, requests := newPushServer(t)
+	Context := testContext()
+	out := &_outPushConfig{Url: server.URL, Topic: "alerts", Title: "{{$.summary}}", Message: "{{$.list}}",
+		Digest: _digestConfig{Window: 50, Item: "{{$.text}}", Summary: "{{$.count}} alerts"}}
+	parseDigestTags(&out.Digest)
+
+	var wg sync.WaitGroup
+	for _, text := range []string{"first", "second", "third"} {
+		msg_ctx := testMessage(t, Context, "alert", `{"text":"`+text+`"}`)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputNtfy(msg_ctx, out)
+		}()
+		time.Sleep(2 * time.Millisecond)
+	}
+	wg.Wait()
+
+	sent := pushOne(t, requests())
+	if sent.body["title"] != "3 alerts" || sent.body["message"] != "first\nsecond\nthird" {
+		t.Errorf("digest %v, want the 3 messages", sent.body)
+	}
+}
+
+func TestDigestTelegram(t *testing.T) {
+	var lock sync.Mutex
+	var texts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		lock.Lock()
+		texts = append(texts, fmt.Sprint(payload["text"]))
+		lock.Unlock()
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer server.Close()
+
+	Context := testContext()
+	out := &_outTelegramConfig{ApiUrl: server.URL, Token: "123:abc", ChatIds: []string{"42"},
+		Text: "{{$.summary}}\n{{$.list}}", Digest: _digestConfig{Window: 50, Item: "- {{$.host}}",
+			Summary: "{{$.count}} hosts down"}}
+	parseDigestTags(&out.Digest)
+
+	var wg sync.WaitGroup
+	for _, host := range []string{"web1", "web2"} {
+		msg_ctx := testMessage(t, Context, "alert", `{"host":"`+host+`"}`)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputTelegram(msg_ctx, out)
+		}()
+		time.Sleep(2 * time.Millisecond)
+	}
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if want := "2 hosts down\n- web1\n- web2"; len(texts) != 1 || texts[0] != want {
+		t.Errorf("messages %q, want one digest %q", texts, want)
+	}
+}
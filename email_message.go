@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+type emailAttachment struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+type emailMessage struct {
+	from        *mail.Address
+	to          []*mail.Address
+	cc          []*mail.Address
+	bcc         []*mail.Address
+	replyTo     []*mail.Address
+	subject     string
+	headers     [][2]string
+	text        string
+	html        string
+	attachments []emailAttachment
+}
+
+// RFC 5322 recommends lines up to 78 characters
+const emailLineLength = 78
+
+var emailNewlines = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+/*
+ * Each value is an address list "Name <a@example.com>, b@example.com"
+ * or a JSON array of addresses, e.g. from {{$.recipients}}
+ */
+func parseEmailAddresses(values []string) ([]*mail.Address, error) {
+	var addresses []*mail.Address
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		list := []string{value}
+		if strings.HasPrefix(value, "[") {
+			if err := json.Unmarshal([]byte(value), &list); err != nil {
+				return nil, fmt.Errorf("invalid address array %s : %w", value, err)
+			}
+		}
+		for _, item := range list {
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+			parsed, err := mail.ParseAddressList(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %s : %w", item, err)
+			}
+			addresses = append(addresses, parsed...)
+		}
+	}
+	return addresses, nil
+}
+
+/*
+ * Envelope recipients: To, Cc and Bcc
+ */
+func (msg *emailMessage) recipients() []string {
+	var rcpt []string
+	for _, list := range [][]*mail.Address{msg.to, msg.cc, msg.bcc} {
+		for _, addr := range list {
+			rcpt = append(rcpt, addr.Address)
+		}
+	}
+	return rcpt
+}
+
+/*
+ * RFC 5322 message with RFC 2047 encoded headers, text and html as multipart/alternative,
+ * attachments as multipart/mixed. Bcc is not in the headers.
+ */
+func (msg *emailMessage) bytes() ([]byte, error) {
+	var buf bytes.Buffer
+
+	writeEmailHeader(&buf, "From", msg.from.String())
+	if len(msg.to) > 0 {
+		writeEmailHeader(&buf, "To", emailAddressList(msg.to))
+	}
+	if len(msg.cc) > 0 {
+		writeEmailHeader(&buf, "Cc", emailAddressList(msg.cc))
+	}
+	if len(msg.replyTo) > 0 {
+		writeEmailHeader(&buf, "Reply-To", emailAddressList(msg.replyTo))
+	}
+	writeEmailHeader(&buf, "Subject", encodeEmailHeader(msg.subject))
+	writeEmailHeader(&buf, "Date", time.Now().Format(time.RFC1123Z))
+	writeEmailHeader(&buf, "Message-ID", emailMessageId(msg.from.Address))
+	for _, header := range msg.headers {
+		writeEmailHeader(&buf, header[0], encodeEmailHeader(header[1]))
+	}
+	writeEmailHeader(&buf, "MIME-Version", "1.0")
+
+	if len(msg.attachments) == 0 {
+		writeEmailBody(&buf, msg.text, msg.html)
+		return buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	writeEmailHeader(&buf, "Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	buf.WriteString("\r\n")
+
+	// The body is the first part, it writes its own headers
+	body_header, body := emailBodyPart(msg.text, msg.html)
+	part, err := mixed.CreatePart(body_header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(body); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range msg.attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", attachment.contentType)
+		header.Set("Content-Transfer-Encoding", "base64")
+		header.Set("Content-Disposition",
+			mime.FormatMediaType("attachment", map[string]string{"filename": attachment.name}))
+		part, err := mixed.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(emailBase64(attachment.data)); err != nil {
+			return nil, err
+		}
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+ * Body headers and content of a single part message
+ */
+func writeEmailBody(buf *bytes.Buffer, text, html string) {
+	header, body := emailBodyPart(text, html)
+	for _, name := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if value := header.Get(name); value != "" {
+			writeEmailHeader(buf, name, value)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+}
+
+/*
+ * text/plain, text/html or multipart/alternative of both
+ */
+func emailBodyPart(text, html string) (textproto.MIMEHeader, []byte) {
+	header := textproto.MIMEHeader{}
+	switch {
+	case html == "":
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		return header, emailQuotedPrintable(text)
+	case text == "":
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		return header, emailQuotedPrintable(html)
+	}
+
+	var buf bytes.Buffer
+	alternative := multipart.NewWriter(&buf)
+	header.Set("Content-Type", "multipart/alternative; boundary="+alternative.Boundary())
+	for _, part := range [][2]string{{"text/plain", text}, {"text/html", html}} {
+		part_header := textproto.MIMEHeader{}
+		part_header.Set("Content-Type", part[0]+"; charset=utf-8")
+		part_header.Set("Content-Transfer-Encoding", "quoted-printable")
+		w, _ := alternative.CreatePart(part_header)
+		w.Write(emailQuotedPrintable(part[1]))
+	}
+	alternative.Close()
+	return header, buf.Bytes()
+}
+
+func emailQuotedPrintable(text string) []byte {
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")))
+	w.Close()
+	return buf.Bytes()
+}
+
+/*
+ * Base64 in lines of 76 characters
+ */
+func emailBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return buf.Bytes()
+}
+
+func emailAddressList(addresses []*mail.Address) string {
+	list := make([]string, len(addresses))
+	for ii, addr := range addresses {
+		list[ii] = addr.String() // the name is RFC 2047 encoded if needed
+	}
+	return strings.Join(list, ", ")
+}
+
+/*
+ * RFC 2047 encoded-words if the value is not printable ASCII, new lines are removed
+ */
+func encodeEmailHeader(value string) string {
+	value = emailNewlines.Replace(value)
+	for _, r := range value {
+		if r < ' ' || r > '~' {
+			return mime.QEncoding.Encode("utf-8", value)
+		}
+	}
+	return value
+}
+
+/*
+ * Folds the header at spaces, so the lines are up to 78 characters where possible.
+ * A long first word, e.g. an encoded-word, goes on the next line if it fits there.
+ */
+func writeEmailHeader(buf *bytes.Buffer, name, value string) {
+	line_len := len(name) + 1
+	line_start := true
+	buf.WriteString(name + ":")
+	for _, word := range strings.Split(value, " ") {
+		if word != "" && line_len+1+len(word) > emailLineLength &&
+			(!line_start || 1+len(word) <= emailLineLength) {
+			buf.WriteString("\r\n")
+			line_len = 0
+		}
+		buf.WriteString(" " + word)
+		line_len += 1 + len(word)
+		line_start = false
+	}
+	buf.WriteString("\r\n")
+}
+
+func emailMessageId(from string) string {
+	domain := from[strings.LastIndex(from, "@")+1:]
+	if domain == "" || domain == from {
+		domain, _ = os.Hostname()
+	}
+	random := make([]byte, 12)
+	rand.Read(random)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random), domain)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func testAddresses(t *testing.T, values ...string) []*mail.Address {
+	t.Helper()
+	addresses, err := parseEmailAddresses(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addresses
+}
+
+var (
+	emailBoundaryRe  = regexp.MustCompile(`boundary=([0-9a-f]+)`)
+	emailDateRe      = regexp.MustCompile(`(?m)^Date: .*\r$`)
+	emailMessageIdRe = regexp.MustCompile(`(?m)^Message-ID: <\d+\.[0-9a-f]{24}@(.*)>\r$`)
+)
+
+/*
+ * The boundaries, date and message id are replaced, they differ in every message
+ */
+func normalizeEmail(t *testing.T, data []byte) string {
+	t.Helper()
+	message := string(data)
+	for ii, match := range emailBoundaryRe.FindAllStringSubmatch(message, -1) {
+		message = strings.ReplaceAll(message, match[1], "BOUNDARY"+string(rune('1'+ii)))
+	}
+	if !emailDateRe.MatchString(message) || !emailMessageIdRe.MatchString(message) {
+		t.Errorf("no Date or Message-ID header:\n%s", message)
+	}
+	message = emailDateRe.ReplaceAllString(message, "Date: DATE\r")
+	message = emailMessageIdRe.ReplaceAllString(message, "Message-ID: <ID@$1>\r")
+	return message
+}
+
+func checkGolden(t *testing.T, name string, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".eml")
+	if *updateGolden {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("message differs from %s, got:\n%s", path, got)
+	}
+}
+
+/*
+ * Lines end with CRLF, header lines are up to 78 characters
+ * unless a single word is longer
+ */
+func checkEmailLines(t *testing.T, data []byte) {
+	t.Helper()
+	lines := strings.Split(strings.TrimSuffix(string(data), "\r\n"), "\r\n")
+	in_headers := true
+	for _, line := range lines {
+		if strings.Contains(line, "\n") || strings.Contains(line, "\r") {
+			t.Errorf("bare new line in %q", line)
+		}
+		if line == "" {
+			in_headers = false
+		}
+		if in_headers && len(line) > emailLineLength && strings.Contains(strings.TrimSpace(line), " ") {
+			t.Errorf("header line of %d characters: %s", len(line), line)
+		}
+	}
+}
+
+func TestEmailPlain(t *testing.T) {
+	msg := &emailMessage{
+		from: testAddresses(t, "Notifier <notifier@example.com>")[0],
+		to: testAddresses(t, "ops@example.com, Database Team <db-team@example.com>",
+			`["oncall-primary@example.com", "oncall-secondary@example.com"]`),
+		bcc:     testAddresses(t, "audit@example.com"),
+		subject: "disk full on web1: /var is at 97% of 200 GB, cleanup of old logs is needed now",
+		headers: [][2]string{{"X-Priority", "1"}, {"X-Host", "web1\r\nBcc: injected@example.com"}},
+		text:    "Disk /var is full.\nCheck the logs =)\n",
+	}
+	data, err := msg.bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmailLines(t, data)
+	checkGolden(t, "plain", normalizeEmail(t, data))
+
+	if strings.Contains(string(data), "audit@example.com") {
+		t.Error("Bcc in the message headers")
+	}
+	want := []string{"ops@example.com", "db-team@example.com",
+		"oncall-primary@example.com", "oncall-secondary@example.com", "audit@example.com"}
+	if got := msg.recipients(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("recipients %v, want %v", got, want)
+	}
+}
+
+func TestEmailEncodedHeaders(t *testing.T) {
+	subject := "Диск пълен на web1 ✓\nвтори ред"
+	msg := &emailMessage{
+		from:    testAddresses(t, "Известия <notifier@example.com>")[0],
+		to:      testAddresses(t, "José Müller <jose@example.com>"),
+		cc:      testAddresses(t, "ops@example.com"),
+		replyTo: testAddresses(t, "Екип <team@example.com>"),
+		subject: subject,
+		headers: [][2]string{{"X-Note", "café"}},
+		html:    "<p>Диск <b>/var</b> е пълен</p>",
+	}
+	data, err := msg.bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmailLines(t, data)
+	checkGolden(t, "encoded_headers", normalizeEmail(t, data))
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := &mime.WordDecoder{}
+	for name, want := range map[string]string{
+		"Subject": "Диск пълен на web1 ✓ втори ред",
+		"X-Note":  "café",
+	} {
+		got, err := decoder.DecodeHeader(parsed.Header.Get(name))
+		if err != nil || got != want {
+			t.Errorf("%s decoded %q %v, want %q", name, got, err, want)
+		}
+	}
+	from, err := parsed.Header.AddressList("From")
+	if err != nil || from[0].Name != "Известия" {
+		t.Errorf("From %v %v, want the decoded name", from, err)
+	}
+}
+
+func TestEmailAlternative(t *testing.T) {
+	msg := &emailMessage{
+		from:    testAddresses(t, "notifier@example.com")[0],
+		to:      testAddresses(t, "ops@example.com"),
+		subject: "alert",
+		text:    "Line one\r\nLine two with a very long text that needs a soft line break in quoted-printable",
+		html:    "<p>Line one</p>",
+	}
+	data, err := msg.bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmailLines(t, data)
+	checkGolden(t, "alternative", normalizeEmail(t, data))
+}
+
+func TestEmailAttachments(t *testing.T) {
+	binary_data := make([]byte, 200)
+	for ii := range binary_data {
+		binary_data[ii] = byte(ii)
+	}
+	msg := &emailMessage{
+		from:    testAddresses(t, "notifier@example.com")[0],
+		to:      testAddresses(t, "ops@example.com"),
+		subject: "report",
+		text:    "See the attachments.",
+		html:    "<p>See the attachments.</p>",
+		attachments: []emailAttachment{
+			{name: "отчет 1.csv", contentType: "text/csv", data: []byte("host,usage\nweb1,97\n")},
+			{name: "dump.bin", contentType: "application/octet-stream", data: binary_data},
+		},
+	}
+	data, err := msg.bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEmailLines(t, data)
+	checkGolden(t, "attachments", normalizeEmail(t, data))
+
+	// the attachments decode to the original data
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	media_type, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil || media_type != "multipart/mixed" {
+		t.Fatalf("Content-Type %s %v, want multipart/mixed", media_type, err)
+	}
+	reader := multipart.NewReader(parsed.Body, params["boundary"])
+	var parts []*multipart.Part
+	var contents [][]byte
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(part)
+		parts = append(parts, part)
+		contents = append(contents, content)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("%d parts, want the body and 2 attachments", len(parts))
+	}
+	if media_type, _, _ := mime.ParseMediaType(parts[0].Header.Get("Content-Type")); media_type != "multipart/alternative" {
+		t.Errorf("first part %s, want multipart/alternative", media_type)
+	}
+	for ii, attachment := range msg.attachments {
+		part := parts[ii+1]
+		if part.FileName() != attachment.name {
+			t.Errorf("attachment name %q, want %q", part.FileName(), attachment.name)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(contents[ii+1])), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("base64 line of %d characters", len(line))
+			}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(contents[ii+1]), "\r\n", ""))
+		if err != nil || !bytes.Equal(decoded, attachment.data) {
+			t.Errorf("attachment %s decoded %q %v", attachment.name, decoded, err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * rlimits, no_new_privs and seccomp are applied by notifier itself started as
+ * "/proc/self/exe <execSandboxArg> <path> <argv...>" in the new process,
+ * then it execs the command. The settings are passed in execSandboxEnv.
+ */
+const execSandboxArg = "--exec-sandbox"
+const execSandboxEnv = "NOTIFIER_EXEC_SANDBOX"
+
+type execSandbox struct {
+	Rlimits    map[int]uint64 `json:"rlimits"`
+	NoNewPrivs bool           `json:"no_new_privs"`
+	Seccomp    []string       `json:"seccomp"`
+}
+
+var execNamespaces = map[string]uintptr{
+	"net":   syscall.CLONE_NEWNET,
+	"ipc":   syscall.CLONE_NEWIPC,
+	"uts":   syscall.CLONE_NEWUTS,
+	"pid":   syscall.CLONE_NEWPID,
+	"mount": syscall.CLONE_NEWNS,
+	"user":  syscall.CLONE_NEWUSER,
+}
+
+// syscalls which can be denied with seccomp-deny
+var seccompSyscalls = map[string]uint32{
+	"ptrace":            unix.SYS_PTRACE,
+	"mount":             unix.SYS_MOUNT,
+	"umount2":           unix.SYS_UMOUNT2,
+	"pivot_root":        unix.SYS_PIVOT_ROOT,
+	"chroot":            unix.SYS_CHROOT,
+	"unshare":           unix.SYS_UNSHARE,
+	"setns":             unix.SYS_SETNS,
+	"reboot":            unix.SYS_REBOOT,
+	"kexec_load":        unix.SYS_KEXEC_LOAD,
+	"init_module":       unix.SYS_INIT_MODULE,
+	"finit_module":      unix.SYS_FINIT_MODULE,
+	"delete_module":     unix.SYS_DELETE_MODULE,
+	"swapon":            unix.SYS_SWAPON,
+	"swapoff":           unix.SYS_SWAPOFF,
+	"bpf":               unix.SYS_BPF,
+	"perf_event_open":   unix.SYS_PERF_EVENT_OPEN,
+	"keyctl":            unix.SYS_KEYCTL,
+	"add_key":           unix.SYS_ADD_KEY,
+	"request_key":       unix.SYS_REQUEST_KEY,
+	"personality":       unix.SYS_PERSONALITY,
+	"process_vm_readv":  unix.SYS_PROCESS_VM_READV,
+	"process_vm_writev": unix.SYS_PROCESS_VM_WRITEV,
+	"socket":            unix.SYS_SOCKET,
+	"connect":           unix.SYS_CONNECT,
+	"bind":              unix.SYS_BIND,
+	"setuid":            unix.SYS_SETUID,
+	"setgid":            unix.SYS_SETGID,
+}
+
+var seccompArch = map[string]uint32{
+	"amd64": unix.AUDIT_ARCH_X86_64,
+	"arm64": unix.AUDIT_ARCH_AARCH64,
+}
+
+/*
+ * Isolation of the command process: own process group (or session with setsid),
+ * namespaces and the sandbox helper for rlimits and seccomp
+ */
+func setupExecSandbox(run_attr *syscall.SysProcAttr, exec_conf *_execCommandConfig) (*execSandbox, error) {
+	if exec_conf.Setsid {
+		run_attr.Setsid = true // new session and process group, no controlling tty
+	} else {
+		run_attr.Setpgid = true // the group is killed on timeout
+	}
+
+	for _, name := range exec_conf.Namespaces {
+		flag, ok := execNamespaces[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown namespace %s", name)
+		}
+		run_attr.Cloneflags |= flag
+	}
+	if run_attr.Cloneflags&syscall.CLONE_NEWUSER != 0 {
+		if run_attr.Credential != nil {
+			return nil, fmt.Errorf("user namespace cannot be combined with user and group")
+		}
+		// the user of notifier is mapped to itself
+		uid, gid := os.Getuid(), os.Getgid()
+		run_attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		run_attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	}
+
+	sandbox := &execSandbox{
+		Rlimits:    map[int]uint64{},
+		NoNewPrivs: exec_conf.NoNewPrivs || len(exec_conf.SeccompDeny) > 0,
+		Seccomp:    exec_conf.SeccompDeny,
+	}
+	limits := &exec_conf.Rlimits
+	if limits.Cpu != nil {
+		sandbox.Rlimits[unix.RLIMIT_CPU] = *limits.Cpu
+	}
+	if limits.MemoryMb != nil {
+		sandbox.Rlimits[unix.RLIMIT_AS] = *limits.MemoryMb * 1024 * 1024
+	}
+	if limits.Files != nil {
+		sandbox.Rlimits[unix.RLIMIT_NOFILE] = *limits.Files
+	}
+	if limits.Processes != nil {
+		sandbox.Rlimits[unix.RLIMIT_NPROC] = *limits.Processes
+	}
+	if limits.FileSizeMb != nil {
+		sandbox.Rlimits[unix.RLIMIT_FSIZE] = *limits.FileSizeMb * 1024 * 1024
+	}
+	if len(sandbox.Seccomp) > 0 {
+		// fail here and not in the command process
+		if _, err := seccompFilter(sandbox.Seccomp); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(sandbox.Rlimits) == 0 && !sandbox.NoNewPrivs {
+		return nil, nil
+	}
+	return sandbox, nil
+}
+
+/*
+ * Runs in the command process before the exec of the command
+ */
+func runExecSandbox(args []string) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "notifier exec sandbox: %s\n", err)
+		os.Exit(127)
+	}
+	if len(args) < 2 {
+		fail(fmt.Errorf("no command"))
+	}
+
+	var sandbox execSandbox
+	if err := json.Unmarshal([]byte(os.Getenv(execSandboxEnv)), &sandbox); err != nil {
+		fail(err)
+	}
+	os.Unsetenv(execSandboxEnv)
+
+	// no_new_privs and seccomp are set per thread, exec is done by the same thread
+	runtime.LockOSThread()
+
+	for resource, value := range sandbox.Rlimits {
+		if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: value, Max: value}); err != nil {
+			fail(fmt.Errorf("setrlimit %d : %w", resource, err))
+		}
+	}
+	if sandbox.NoNewPrivs {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			fail(fmt.Errorf("no_new_privs : %w", err))
+		}
+	}
+	if len(sandbox.Seccomp) > 0 {
+		filter, err := seccompFilter(sandbox.Seccomp)
+		if err != nil {
+			fail(err)
+		}
+		prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+		if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER,
+			uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+			fail(fmt.Errorf("seccomp : %w", err))
+		}
+	}
+
+	fail(syscall.Exec(args[0], args[1:], os.Environ()))
+}
+
+/*
+ * BPF program: the listed syscalls fail with EPERM, other architectures are denied
+ */
+func seccompFilter(names []string) ([]unix.SockFilter, error) {
+	arch, ok := seccompArch[runtime.GOARCH]
+	if !ok {
+		return nil, fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	var numbers []uint32
+	for _, name := range names {
+		nr, ok := seccompSyscalls[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown syscall %s for seccomp", name)
+		}
+		numbers = append(numbers, nr)
+	}
+
+	const (
+		ld  = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jge = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		ret = unix.BPF_RET | unix.BPF_K
+	)
+	// struct seccomp_data offsets
+	const offsetNr, offsetArch = 0, 4
+
+	filter := []unix.SockFilter{
+		{Code: ld, K: offsetArch},
+		{Code: jeq, K: arch, Jt: 1},
+		{Code: ret, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)}, // other architecture
+		{Code: ld, K: offsetNr},
+	}
+	if runtime.GOARCH == "amd64" {
+		filter = append(filter, unix.SockFilter{Code: jge, K: 0x40000000}) // x32 ABI
+	}
+	for _, nr := range numbers {
+		filter = append(filter, unix.SockFilter{Code: jeq, K: nr})
+	}
+	filter = append(filter,
+		unix.SockFilter{Code: ret, K: unix.SECCOMP_RET_ALLOW},
+		unix.SockFilter{Code: ret, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+	)
+
+	deny := len(filter) - 1
+	if deny > 255 {
+		return nil, fmt.Errorf("too many syscalls for seccomp")
+	}
+	for ii := 4; ii < deny-1; ii++ {
+		filter[ii].Jt = uint8(deny - ii - 1)
+	}
+	return filter, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// the test binary run as the sandboxed command reports the result of a syscall
+const sandboxProbeEnv = "NOTIFIER_TEST_SANDBOX_PROBE"
+
+func runSandboxProbe(probe string) {
+	switch probe {
+	case "socket":
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+		if err != nil {
+			fmt.Printf("socket: %s", err)
+			os.Exit(1)
+		}
+		unix.Close(fd)
+		fmt.Print("socket: ok")
+	case "nofile":
+		var limit unix.Rlimit
+		unix.Getrlimit(unix.RLIMIT_NOFILE, &limit)
+		fmt.Printf("nofile: %d", limit.Cur)
+	case "no_new_privs":
+		value, _ := unix.PrctlRetInt(unix.PR_GET_NO_NEW_PRIVS, 0, 0, 0, 0)
+		fmt.Printf("no_new_privs: %d", value)
+	}
+	os.Exit(0)
+}
+
+func runSandboxed(t *testing.T, probe string, exec_conf *_execCommandConfig) (string, int) {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec_conf.Cmd = exe
+	// without the exit delay of the race detector
+	exec_conf.Env = []string{sandboxProbeEnv + "=" + probe, "GORACE=atexit_sleep_ms=0"}
+	exec_conf.Timeout = 10000
+	result, _ := runCommand(testMessage(t, testContext(), "exec", `{}`), exec_conf)
+	if result == nil {
+		t.Fatal("command not started")
+	}
+	if stderr := result["stderr"].(string); stderr != "" {
+		t.Logf("stderr: %s", stderr)
+	}
+	return fmt.Sprint(result["stdout"]), result["exit_code"].(int)
+}
+
+func TestExecSeccompDeny(t *testing.T) {
+	if _, ok := seccompArch[runtime.GOARCH]; !ok {
+		t.Skipf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+
+	stdout, exit_code := runSandboxed(t, "socket", &_execCommandConfig{})
+	if stdout != "socket: ok" || exit_code != 0 {
+		t.Fatalf("without seccomp: %s exit %d", stdout, exit_code)
+	}
+
+	stdout, exit_code = runSandboxed(t, "socket", &_execCommandConfig{SeccompDeny: []string{"bind", "Socket"}})
+	if stdout != "socket: "+unix.EPERM.Error() || exit_code != 1 {
+		t.Errorf("with seccomp-deny socket: %s exit %d, want EPERM", stdout, exit_code)
+	}
+}
+
+func TestExecSandboxLimits(t *testing.T) {
+	files := uint64(64)
+	stdout, _ := runSandboxed(t, "nofile", &_execCommandConfig{Rlimits: _execRlimitsConfig{Files: &files}})
+	if stdout != "nofile: 64" {
+		t.Errorf("rlimits files 64: %s", stdout)
+	}
+
+	stdout, _ = runSandboxed(t, "no_new_privs", &_execCommandConfig{NoNewPrivs: true})
+	if stdout != "no_new_privs: 1" {
+		t.Errorf("no-new-privs: %s", stdout)
+	}
+}
+
+func TestSeccompFilterErrors(t *testing.T) {
+	if _, ok := seccompArch[runtime.GOARCH]; !ok {
+		t.Skipf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	if _, err := seccompFilter([]string{"socket", "open"}); err == nil {
+		t.Error("unknown syscall open accepted")
+	}
+	if _, err := setupExecSandbox(&syscall.SysProcAttr{}, &_execCommandConfig{SeccompDeny: []string{"nope"}}); err == nil {
+		t.Error("sandbox with unknown syscall accepted")
+	}
+}
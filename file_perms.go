@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+/*
+ * Parses octal permissions like "0660"
+ */
+func parseFileMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("invalid file mode \"%s\"", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+/*
+ * Resolves user and group names or numeric ids, -1 means unchanged
+ */
+func lookupOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		if id, err := strconv.Atoi(owner); err == nil {
+			uid = id
+		} else {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return -1, -1, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if group != "" {
+		if id, err := strconv.Atoi(group); err == nil {
+			gid = id
+		} else {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return -1, -1, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
+
+/*
+ * Applies configured mode and ownership to a created socket or pipe
+ */
+func setFilePerms(path, mode, owner, group string) error {
+	if mode != "" {
+		perm, err := parseFileMode(mode)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, perm); err != nil {
+			return err
+		}
+	}
+	if owner != "" || group != "" {
+		uid, gid, err := lookupOwner(owner, group)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+/*
+ * Runs until the connection fails, returns nil on stop
+ */
+type brokerConsumer func(ctx context.Context, Context *_context, in *_inBrokerConfig, timeout time.Duration) error
+
+func inputMqtt(Context *_context, in *_inBrokerConfig) {
+	inputBroker(Context, in, "MQTT", consumeMqtt)
+}
+
+func inputNats(Context *_context, in *_inBrokerConfig) {
+	inputBroker(Context, in, "NATS", consumeNats)
+}
+
+func inputRedis(Context *_context, in *_inBrokerConfig) {
+	inputBroker(Context, in, "REDIS", consumeRedis)
+}
+
+func inputAmqp(Context *_context, in *_inBrokerConfig) {
+	inputBroker(Context, in, "AMQP", consumeAmqp)
+}
+
+func inputKafka(Context *_context, in *_inBrokerConfig) {
+	inputBroker(Context, in, "KAFKA", consumeKafka)
+}
+
+/*
+ * Consumes the topics and reconnects with backoff when the connection fails
+ */
+func inputBroker(Context *_context, in *_inBrokerConfig, name string, consume brokerConsumer) {
+	log.Printf("Starting %s input: %s %s", name, in.Url, strings.Join(in.Topics, ","))
+	Context.ActiveInputs.Add(1)
+	defer Context.ActiveInputs.Done()
+	Context.InputsReady.Done()
+
+	timeout := time.Duration(in.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = Context.InputTimeout
+	}
+	backoff_min := time.Duration(in.ReconnectMin) * time.Millisecond
+	if backoff_min == 0 {
+		backoff_min = time.Second
+	}
+	backoff_max := time.Duration(in.ReconnectMax) * time.Millisecond
+	if backoff_max < backoff_min {
+		backoff_max = 60 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-Context.StopChan
+		cancel()
+	}()
+
+	backoff := backoff_min
+	for {
+		if IsStopping(Context) {
+			break
+		}
+
+		started := time.Now()
+		err := consume(ctx, Context, in, timeout)
+		if IsStopping(Context) {
+			break
+		}
+		if err != nil {
+			log.Printf("INPUT-%s: %s failed: %s", name, in.Url, err)
+		}
+
+		// Reset the backoff if the connection was healthy for a while
+		if time.Since(started) > backoff_max {
+			backoff = backoff_min
+		}
+
+		// Interruptable sleep
+		select {
+		case <-time.After(backoff):
+		case <-Context.StopChan:
+		}
+		backoff *= 2
+		if backoff > backoff_max {
+			backoff = backoff_max
+		}
+	}
+	log.Printf("Stopping %s input: %s", name, in.Url)
+}
+
+/*
+ * Puts the message in the queue, false if stopping before it was queued.
+ * Only queued messages are acknowledged, the others are delivered again by the broker.
+ */
+func queueBrokerMessage(Context *_context, in *_inBrokerConfig, payload []byte, topic string) bool {
+	message := strings.TrimSpace(string(payload))
+	if in.Method != "" {
+		var params interface{} = json.RawMessage(message)
+		if !json.Valid([]byte(message)) {
+			params = message
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  in.Method,
+			"params":  params,
+		})
+		if err != nil {
+			log.Printf("INPUT-BROKER: failed to encode message from %s : %s", topic, err)
+			return true
+		}
+		message = string(data)
+	}
+
+	select {
+	case Context.Messages <- InputMessage{Body: message, Peer: map[string]interface{}{"topic": topic}}:
+		return true
+	case <-Context.StopChan:
+		return false
+	}
+}
+
+func brokerGroup(in *_inBrokerConfig) string {
+	if in.Group == "" {
+		return "notifier"
+	}
+	return in.Group
+}
+
+// ========================================================
+// MQTT
+// ========================================================
+
+/*
+ * With client-id the session is kept, so QoS 1 and 2 messages are not lost while disconnected.
+ * With group it is a shared subscription $share/<group>/<topic>.
+ */
+func consumeMqtt(ctx context.Context, Context *_context, in *_inBrokerConfig, timeout time.Duration) error {
+	tls_config, err := brokerTlsConfig(&in._brokerConnConfig)
+	if err != nil {
+		return err
+	}
+	qos := byte(1)
+	if in.Qos != nil {
+		qos = *in.Qos
+	}
+	if qos > 2 {
+		return fmt.Errorf("invalid qos %d", qos)
+	}
+
+	lost := make(chan error, 1)
+	opts := mqtt.NewClientOptions().
+		AddBroker(in.Url).
+		SetClientID(mqttClientId(in.ClientId)).
+		SetUsername(in.User).
+		SetPassword(in.Password).
+		SetConnectTimeout(timeout).
+		SetCleanSession(in.ClientId == "").
+		SetAutoReconnect(false). // reconnected by inputBroker
+		SetAutoAckDisabled(true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			select {
+			case lost <- err:
+			default:
+			}
+		})
+	if tls_config != nil {
+		opts.SetTLSConfig(tls_config)
+	}
+
+	c := mqtt.NewClient(opts)
+	token := c.Connect()
+	if !token.WaitTimeout(timeout) {
+		c.Disconnect(0)
+		return fmt.Errorf("connect timeout")
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	defer c.Disconnect(250)
+
+	filters := make(map[string]byte, len(in.Topics))
+	for _, topic := range in.Topics {
+		if in.Group != "" {
+			topic = "$share/" + in.Group + "/" + topic
+		}
+		filters[topic] = qos
+	}
+	token = c.SubscribeMultiple(filters, func(_ mqtt.Client, msg mqtt.Message) {
+		if queueBrokerMessage(Context, in, msg.Payload(), msg.Topic()) {
+			msg.Ack()
+		}
+	})
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("subscribe timeout")
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-lost:
+		return err
+	}
+}
+
+// ========================================================
+// NATS
+// ========================================================
+
+/*
+ * Subscribers of the same queue group share the messages.
+ * Messages with reply subject, e.g. of JetStream push consumers, are acknowledged.
+ */
+func consumeNats(ctx context.Context, Context *_context, in *_inBrokerConfig, timeout time.Duration) error {
+	tls_config, err := brokerTlsConfig(&in._brokerConnConfig)
+	if err != nil {
+		return err
+	}
+	lost := make(chan error, 1)
+	opts := []nats.Option{
+		nats.Name("notifier"),
+		nats.Timeout(timeout),
+		nats.NoReconnect(), // reconnected by inputBroker
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err == nil {
+				err = errors.New("disconnected")
+			}
+			select {
+			case lost <- err:
+			default:
+			}
+		}),
+	}
+	if in.User != "" {
+		opts = append(opts, nats.UserInfo(in.User, in.Password))
+	}
+	if in.Token != "" {
+		opts = append(opts, nats.Token(in.Token))
+	}
+	if tls_config != nil {
+		opts = append(opts, nats.Secure(tls_config))
+	}
+
+	c, err := nats.Connect(in.Url, opts...)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	msgs := make(chan *nats.Msg, 256)
+	for _, subject := range in.Topics {
+		if _, err := c.ChanQueueSubscribe(subject, in.Group, msgs); err != nil {
+			return fmt.Errorf("subscribe %s: %w", subject, err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-lost:
+			return err
+		case msg := <-msgs:
+			if !queueBrokerMessage(Context, in, msg.Data, msg.Subject) {
+				return nil
+			}
+			if msg.Reply != "" {
+				msg.Ack()
+			}
+		}
+	}
+}
+
+// ========================================================
+// Redis
+// ========================================================
+
+/*
+ * Streams are read with a consumer group, created at the end of the stream if missing.
+ * The pending entries of the consumer are read first, every entry is XACKed after queued.
+ */
+func consumeRedis(ctx context.Context, Context *_context, in *_inBrokerConfig, timeout time.Duration) error {
+	opts, err := redis.ParseURL(in.Url)
+	if err != nil {
+		return err
+	}
+	if in.User != "" {
+		opts.Username = in.User
+	}
+	if in.Password != "" {
+		opts.Password = in.Password
+	}
+	tls_config, err := brokerTlsConfig(&in._brokerConnConfig)
+	if err != nil {
+		return err
+	}
+	if tls_config != nil {
+		opts.TLSConfig = tls_config
+	}
+	opts.DialTimeout = timeout
+
+	c := redis.NewClient(opts)
+	defer c.Close()
+
+	group := brokerGroup(in)
+	consumer := in.Consumer
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+	}
+	field := in.Field
+	if field == "" {
+		field = "message"
+	}
+
+	last_ids := make(map[string]string, len(in.Topics))
+	for _, stream := range in.Topics {
+		err := c.XGroupCreateMkStream(ctx, stream, group, "$").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("create group %s of %s: %w", group, stream, err)
+		}
+		last_ids[stream] = "0" // pending entries first
+	}
+
+	for {
+		streams := make([]string, 0, 2*len(in.Topics))
+		streams = append(streams, in.Topics...)
+		for _, stream := range in.Topics {
+			streams = append(streams, last_ids[stream])
+		}
+		result, err := c.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  streams,
+			Count:    100,
+			Block:    time.Second,
+		}).Result()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, stream := range result {
+			if last_ids[stream.Stream] != ">" {
+				if len(stream.Messages) == 0 {
+					last_ids[stream.Stream] = ">" // no more pending entries
+				} else {
+					last_ids[stream.Stream] = stream.Messages[len(stream.Messages)-1].ID
+				}
+			}
+			for _, entry := range stream.Messages {
+				payload, ok := entry.Values[field].(string)
+				if !ok {
+					data, _ := json.Marshal(entry.Values)
+					payload = string(data)
+				}
+				if !queueBrokerMessage(Context, in, []byte(payload), stream.Stream) {
+					return nil
+				}
+				if err := redisAck(c, stream.Stream, group, entry.ID, timeout); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+/*
+ * Not canceled on stop, the entry is already queued
+ */
+func redisAck(c *redis.Client, stream, group, id string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.XAck(ctx, stream, group, id).Err()
+}
+
+// ========================================================
+// AMQP 0.9.1
+// ========================================================
+
+/*
+ * Consumes the queues with manual acknowledgement, messages not queued are requeued
+ */
+func consumeAmqp(ctx context.Context, Context *_context, in *_inBrokerConfig, timeout time.Duration) error {
+	tls_config, err := brokerTlsConfig(&in._brokerConnConfig)
+	if err != nil {
+		return err
+	}
+	config := amqp.Config{
+		Dial:            amqp.DefaultDial(timeout),
+		TLSClientConfig: tls_config,
+		Properties:      amqp.Table{"connection_name": "notifier"},
+	}
+	if in.User != "" {
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: in.User, Password: in.Password}}
+	}
+
+	conn, err := amqp.DialConfig(in.Url, config)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	prefetch := int(in.Prefetch)
+	if prefetch == 0 {
+		prefetch = 10
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return err
+	}
+
+	// Deliveries of all queues, the forwarders stop with the connection
+	deliveries := make(chan amqp.Delivery)
+	done := make(chan struct{})
+	defer close(done)
+	for _, queue := range in.Topics {
+		queue_deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("consume %s: %w", queue, err)
+		}
+		go func() {
+			for delivery := range queue_deliveries {
+				select {
+				case deliveries <- delivery:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-closed:
+			if err == nil {
+				return errors.New("connection closed")
+			}
+			return err
+		case delivery := <-deliveries:
+			topic := delivery.RoutingKey
+			if topic == "" {
+				topic = delivery.ConsumerTag
+			}
+			if !queueBrokerMessage(Context, in, delivery.Body, topic) {
+				delivery.Nack(false, true)
+				return nil
+			}
+			if err := delivery.Ack(false); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// ========================================================
+// Kafka
+// ========================================================
+
+/*
+ * Consumer group member, the offset is committed after the message is queued.
+ * A new group starts at the end of the topics.
+ */
+func consumeKafka(ctx context.Context, Context *_context, in *_inBrokerConfig, timeout time.Duration) error {
+	tls_config, err := brokerTlsConfig(&in._brokerConnConfig)
+	if err != nil {
+		return err
+	}
+	dialer := &kafka.Dialer{
+		ClientID: "notifier",
+		Timeout:  timeout,
+		TLS:      tls_config,
+	}
+	if in.User != "" {
+		dialer.SASLMechanism = plain.Mechanism{Username: in.User, Password: in.Password}
+	}
+	brokers := kafkaBrokers(in.Url)
+	if len(brokers) == 0 {
+		return fmt.Errorf("no brokers in url")
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     brokers,
+		GroupID:     brokerGroup(in),
+		GroupTopics: in.Topics,
+		Dialer:      dialer,
+		StartOffset: kafka.LastOffset,
+		MaxWait:     time.Second,
+		ErrorLogger: kafka.LoggerFunc(func(msg string, args ...interface{}) {
+			log.Printf("INPUT-KAFKA: "+msg, args...)
+		}),
+	})
+	defer r.Close()
+
+	for {
+		msg, err := r.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !queueBrokerMessage(Context, in, msg.Value, msg.Topic) {
+			return nil
+		}
+		// not canceled on stop, the message is already queued
+		commit_ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = r.CommitMessages(commit_ctx, msg)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBrokerMessageWrapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		payload string
+		want    string
+	}{
+		{"json-rpc as is", "", ` {"jsonrpc":"2.0","method":"alert","params":{"a":1}}` + "\n",
+			`{"jsonrpc":"2.0","method":"alert","params":{"a":1}}`},
+		{"json object", "sensor", `{"temp": 42}`,
+			`{"jsonrpc":"2.0","method":"sensor","params":{"temp":42}}`},
+		{"json array", "sensor", `[1, 2]`,
+			`{"jsonrpc":"2.0","method":"sensor","params":[1,2]}`},
+		{"plain text", "sensor", "door open\n",
+			`{"jsonrpc":"2.0","method":"sensor","params":"door open"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			Context := testContext()
+			in := &_inBrokerConfig{Method: test.method}
+			if !queueBrokerMessage(Context, in, []byte(test.payload), "sensors/door") {
+				t.Fatal("message not queued")
+			}
+			msg := nextMessage(t, Context)
+			if test.method == "" {
+				if msg.Body != test.want {
+					t.Errorf("body %s, want %s", msg.Body, test.want)
+				}
+			} else {
+				var got, want interface{}
+				json.Unmarshal([]byte(msg.Body), &got)
+				json.Unmarshal([]byte(test.want), &want)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("body %s, want %s", msg.Body, test.want)
+				}
+			}
+			if msg.Peer["topic"] != "sensors/door" {
+				t.Errorf("peer %v, want topic sensors/door", msg.Peer)
+			}
+		})
+	}
+}
+
+func TestBrokerPeerTopicTag(t *testing.T) {
+	Context := testContext()
+	in := &_inBrokerConfig{Method: "sensor"}
+	queueBrokerMessage(Context, in, []byte(`{"state":"open"}`), "home/door")
+	msg := nextMessage(t, Context)
+
+	msg_ctx := testMessage(t, Context, "sensor", `{"state":"open"}`)
+	msg_ctx.Peer = msg.Peer
+	var tags *[]string
+	got := replaceJSONPathTags(msg_ctx, "{{peer.topic}} is {{$.state}}", &tags)
+	if got != "home/door is open" {
+		t.Errorf("got %q, want %q", got, "home/door is open")
+	}
+}
+
+/*
+ * The consumers ack a message only after queueBrokerMessage returned true,
+ * a message which could not be queued before stopping stays on the broker
+ */
+func TestBrokerAckAfterQueue(t *testing.T) {
+	Context := testContext()
+	Context.Messages = make(chan InputMessage, 1)
+	in := &_inBrokerConfig{Topics: []string{"alerts"}, ReconnectMin: 10}
+
+	var lock sync.Mutex
+	var acked []string
+	connects := 0
+	consume := func(ctx context.Context, Context *_context, in *_inBrokerConfig, timeout time.Duration) error {
+		lock.Lock()
+		connects++
+		first := connects == 1
+		lock.Unlock()
+		if first {
+			return errors.New("connection refused")
+		}
+		for _, payload := range []string{"first", "second"} {
+			if !queueBrokerMessage(Context, in, []byte(payload), "alerts") {
+				return nil
+			}
+			lock.Lock()
+			acked = append(acked, payload)
+			lock.Unlock()
+		}
+		<-ctx.Done()
+		return nil
+	}
+
+	Context.InputsReady.Add(1)
+	go inputBroker(Context, in, "TEST", consume)
+	Context.InputsReady.Wait()
+
+	// the queue is full with the first message, the second one is blocked
+	deadline := time.Now().Add(time.Second)
+	for {
+		lock.Lock()
+		done := len(acked) == 1
+		lock.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("first message not acked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	close(Context.StopChan)
+	Context.ActiveInputs.Wait()
+
+	if !reflect.DeepEqual(acked, []string{"first"}) {
+		t.Errorf("acked %v, want [first]", acked)
+	}
+	if connects != 2 {
+		t.Errorf("%d connects, want 2", connects)
+	}
+	if msg := <-Context.Messages; msg.Body != "first" {
+		t.Errorf("queued %q, want first", msg.Body)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+	Time     int64 `json:"time"`
+	TimeNano int64 `json:"timeNano"`
+}
+
+func inputDocker(Context *_context, in *_inDockerConfig) {
+	log.Printf("Starting DOCKER input: %s", in.Socket)
+	Context.ActiveInputs.Add(1)
+	defer Context.ActiveInputs.Done()
+	Context.InputsReady.Done()
+
+	if in.Socket == "" {
+		in.Socket = "/var/run/docker.sock"
+	}
+	if in.MethodPrefix == "" {
+		in.MethodPrefix = "container."
+	}
+	if len(in.Events) == 0 {
+		in.Events = []string{"die", "oom"}
+	}
+
+	timeout := time.Duration(in.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = Context.InputTimeout
+	}
+	backoff_min := time.Duration(in.ReconnectMin) * time.Millisecond
+	if backoff_min == 0 {
+		backoff_min = time.Second
+	}
+	backoff_max := time.Duration(in.ReconnectMax) * time.Millisecond
+	if backoff_max < backoff_min {
+		backoff_max = 60 * time.Second
+	}
+
+	// Cancel the event stream on stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-Context.StopChan
+		cancel()
+	}()
+
+	// All API calls go through the unix socket, the host part of the URL is ignored
+	http_client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				dialer := net.Dialer{Timeout: timeout}
+				return dialer.DialContext(ctx, "unix", in.Socket)
+			},
+		},
+	}
+
+	backoff := backoff_min
+	for {
+		if IsStopping(Context) {
+			break
+		}
+
+		started := time.Now()
+		err := dockerStreamEvents(ctx, Context, in, http_client, timeout)
+		if IsStopping(Context) {
+			break
+		}
+		if err != nil {
+			log.Printf("INPUT-DOCKER: event stream on %s failed: %s", in.Socket, err)
+		}
+
+		// Reset the backoff if the stream was healthy for a while
+		if time.Since(started) > backoff_max {
+			backoff = backoff_min
+		}
+
+		// Interruptable sleep
+		select {
+		case <-time.After(backoff):
+		case <-Context.StopChan:
+		}
+		backoff *= 2
+		if backoff > backoff_max {
+			backoff = backoff_max
+		}
+	}
+	log.Printf("Stopping DOCKER input: %s", in.Socket)
+}
+
+func dockerStreamEvents(ctx context.Context, Context *_context, in *_inDockerConfig,
+	http_client *http.Client, timeout time.Duration) error {
+
+	filters := map[string][]string{
+		"type":  {"container"},
+		"event": in.Events,
+	}
+	if len(in.Labels) > 0 {
+		filters["label"] = in.Labels
+	}
+	filters_json, err := json.Marshal(filters)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		"http://docker/events?filters="+url.QueryEscape(string(filters_json)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http_client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		excerpt, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(excerpt)))
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event dockerEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("event stream closed by the server")
+			}
+			return err
+		}
+		if event.Type != "container" {
+			continue
+		}
+
+		message, err := dockerEventMessage(ctx, in, http_client, timeout, &event)
+		if err != nil {
+			log.Printf("INPUT-DOCKER: error encoding event %s for %s : %s",
+				event.Action, event.Actor.ID, err)
+			continue
+		}
+		Context.Messages <- InputMessage{Body: message}
+	}
+}
+
+func dockerEventMessage(ctx context.Context, in *_inDockerConfig,
+	http_client *http.Client, timeout time.Duration, event *dockerEvent) (string, error) {
+
+	// "health_status: unhealthy" and "exec_start: sh" carry a detail after the colon
+	action := event.Action
+	if idx := strings.Index(action, ":"); idx != -1 {
+		action = action[:idx]
+	}
+
+	// Docker mixes container labels with the event attributes
+	labels := make(map[string]string)
+	for k, v := range event.Actor.Attributes {
+		switch k {
+		case "name", "image", "exitCode", "signal", "execDuration":
+			continue
+		}
+		labels[k] = v
+	}
+
+	params := map[string]interface{}{
+		"id":     event.Actor.ID,
+		"name":   event.Actor.Attributes["name"],
+		"image":  event.Actor.Attributes["image"],
+		"action": event.Action,
+		"labels": labels,
+		"time":   event.Time,
+	}
+	if exit_code, ok := event.Actor.Attributes["exitCode"]; ok {
+		if code, err := strconv.Atoi(exit_code); err == nil {
+			params["exit_code"] = code
+		} else {
+			params["exit_code"] = exit_code
+		}
+	}
+	if in.LogLines > 0 && event.Actor.ID != "" {
+		lines, err := dockerContainerLogs(ctx, http_client, timeout, event.Actor.ID, in.LogLines)
+		if err != nil {
+			log.Printf("INPUT-DOCKER: error reading logs of %s : %s", event.Actor.ID, err)
+		}
+		params["logs"] = lines
+	}
+
+	message, err := json.Marshal(JsonRpcRequest{
+		JSONRPC: "2.0",
+		Method:  in.MethodPrefix + action,
+		Params:  params,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+/*
+ * Returns the last lines of container's stdout and stderr
+ */
+func dockerContainerLogs(ctx context.Context, http_client *http.Client,
+	timeout time.Duration, id string, lines uint32) ([]string, error) {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("http://docker/containers/%s/logs?stdout=1&stderr=1&tail=%d",
+			url.PathEscape(id), lines), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http_client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, lines)
+	scanner := bufio.NewScanner(strings.NewReader(string(dockerDemuxLogs(body))))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		result = append(result, scanner.Text())
+	}
+	return result, scanner.Err()
+}
+
+/*
+ * Containers without TTY return stdout and stderr multiplexed in frames
+ * with 8 bytes header: [stream, 0, 0, 0, size(4 bytes big endian)]
+ */
+func dockerDemuxLogs(data []byte) []byte {
+	if len(data) < 8 || data[0] > 2 || data[1] != 0 || data[2] != 0 || data[3] != 0 {
+		return data // raw TTY stream
+	}
+
+	output := make([]byte, 0, len(data))
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data[4:8]))
+		data = data[8:]
+		if size > len(data) {
+			size = len(data)
+		}
+		output = append(output, data[:size]...)
+		data = data[size:]
+	}
+	return output
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * Stand-in for the Docker API on a unix socket. The first failures connections
+ * to /events get 500, the next ones get the events and the stream is closed.
+ */
+type fakeDocker struct {
+	sync.Mutex
+	server   *httptest.Server
+	socket   string
+	failures int
+	events   []string
+	logs     map[string][]string // container id -> stdout lines
+	connects []time.Time
+	filters  []map[string][]string
+}
+
+func newFakeDocker(t *testing.T) *fakeDocker {
+	docker := &fakeDocker{
+		socket: filepath.Join(t.TempDir(), "docker.sock"),
+		logs:   map[string][]string{},
+	}
+	listener, err := net.Listen("unix", docker.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docker.server = httptest.NewUnstartedServer(http.HandlerFunc(docker.handle))
+	docker.server.Listener = listener
+	docker.server.Start()
+	t.Cleanup(docker.server.Close)
+	return docker
+}
+
+func (docker *fakeDocker) handle(w http.ResponseWriter, r *http.Request) {
+	docker.Lock()
+	defer docker.Unlock()
+
+	switch {
+	case r.URL.Path == "/events":
+		docker.connects = append(docker.connects, time.Now())
+		var filters map[string][]string
+		json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+		docker.filters = append(docker.filters, filters)
+		if len(docker.connects) <= docker.failures {
+			http.Error(w, "daemon is starting", http.StatusInternalServerError)
+			return
+		}
+		for _, event := range docker.events {
+			fmt.Fprintln(w, event)
+		}
+
+	case strings.HasPrefix(r.URL.Path, "/containers/") && strings.HasSuffix(r.URL.Path, "/logs"):
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/logs")
+		for ii, line := range docker.logs[id] {
+			// multiplexed frames, stderr for the odd lines
+			header := make([]byte, 8)
+			header[0] = byte(1 + ii%2)
+			binary.BigEndian.PutUint32(header[4:], uint32(len(line)+1))
+			w.Write(header)
+			w.Write([]byte(line + "\n"))
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func dockerTestEvent(event_type, action, id string, attributes map[string]string) string {
+	event := dockerEvent{Type: event_type, Action: action, Time: 1700000000}
+	event.Actor.ID = id
+	event.Actor.Attributes = attributes
+	data, _ := json.Marshal(event)
+	return string(data)
+}
+
+func runDockerInput(t *testing.T, in *_inDockerConfig) *_context {
+	Context := testContext()
+	Context.InputsReady.Add(1)
+	go inputDocker(Context, in)
+	t.Cleanup(func() {
+		close(Context.StopChan)
+		Context.ActiveInputs.Wait()
+	})
+	return Context
+}
+
+func TestDockerEventsRouting(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.events = []string{
+		dockerTestEvent("network", "connect", "net1", nil),
+		dockerTestEvent("container", "die", "c1", map[string]string{
+			"name": "web", "image": "nginx", "exitCode": "137", "com.example.team": "ops"}),
+		dockerTestEvent("container", "health_status: unhealthy", "c2", map[string]string{"name": "db"}),
+	}
+	docker.logs["c1"] = []string{"starting", "killed"}
+
+	Context := runDockerInput(t, &_inDockerConfig{
+		Socket:       docker.socket,
+		Events:       []string{"die", "health_status"},
+		Labels:       []string{"com.example.team=ops"},
+		MethodPrefix: "docker.",
+		LogLines:     10,
+		ReconnectMin: 1000,
+	})
+
+	die := decodeMessage(t, nextMessage(t, Context))
+	if die.Method != "docker.die" {
+		t.Fatalf("method of die event is %s, the network event must be skipped", die.Method)
+	}
+	params := die.Params.(map[string]interface{})
+	if params["name"] != "web" || params["image"] != "nginx" || params["exit_code"] != float64(137) {
+		t.Errorf("unexpected params of die event %v", params)
+	}
+	if labels := params["labels"].(map[string]interface{}); len(labels) != 1 || labels["com.example.team"] != "ops" {
+		t.Errorf("labels must not contain the event attributes: %v", labels)
+	}
+	if logs := fmt.Sprint(params["logs"]); logs != "[starting killed]" {
+		t.Errorf("logs of stdout and stderr frames are %s", logs)
+	}
+
+	health := decodeMessage(t, nextMessage(t, Context))
+	if health.Method != "docker.health_status" {
+		t.Errorf("the detail after the colon must not be in the method: %s", health.Method)
+	}
+	if action := health.Params.(map[string]interface{})["action"]; action != "health_status: unhealthy" {
+		t.Errorf("action param is %v", action)
+	}
+
+	docker.Lock()
+	filters := docker.filters[0]
+	docker.Unlock()
+	if fmt.Sprint(filters["type"]) != "[container]" || fmt.Sprint(filters["event"]) != "[die health_status]" ||
+		fmt.Sprint(filters["label"]) != "[com.example.team=ops]" {
+		t.Errorf("unexpected event filters %v", filters)
+	}
+}
+
+func TestDockerReconnectBackoff(t *testing.T) {
+	docker := newFakeDocker(t)
+	docker.failures = 4
+	docker.events = []string{dockerTestEvent("container", "oom", "c1", map[string]string{"name": "web"})}
+
+	Context := runDockerInput(t, &_inDockerConfig{
+		Socket:       docker.socket,
+		ReconnectMin: 20,
+		ReconnectMax: 80,
+	})
+
+	oom := decodeMessage(t, nextMessage(t, Context))
+	if oom.Method != "container.oom" {
+		t.Fatalf("default method prefix is not used: %s", oom.Method)
+	}
+
+	docker.Lock()
+	connects := append([]time.Time{}, docker.connects...)
+	docker.Unlock()
+	if len(connects) < 5 {
+		t.Fatalf("%d connections, the failed ones must be retried", len(connects))
+	}
+	// doubled from reconnect-min up to reconnect-max
+	for ii, min := range []time.Duration{20, 40, 80, 80} {
+		if gap := connects[ii+1].Sub(connects[ii]); gap < min*time.Millisecond {
+			t.Errorf("reconnect %d after %s, expected at least %dms", ii+1, gap, min)
+		}
+	}
+	if gap := connects[2].Sub(connects[1]); gap > 500*time.Millisecond {
+		t.Errorf("reconnect after %s, the backoff is too long", gap)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runFolderInput(t *testing.T, in *_inFolderConfig) *_context {
+	t.Helper()
+	Context := testContext()
+	in.ScanTime = 50
+	Context.InputsReady.Add(1)
+	go inputFolder(Context, in)
+	Context.InputsReady.Wait()
+	t.Cleanup(func() {
+		close(Context.StopChan)
+		Context.ActiveInputs.Wait()
+	})
+	return Context
+}
+
+/*
+ * Writes the file as the senders should, with the tmp suffix and a rename
+ */
+func writeFolderFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path+".tmp", []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFolderWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFolderFile(t, filepath.Join(dir, "before.json"), `{"method":"before"}`)
+	in := &_inFolderConfig{Path: dir, Processed: "move"}
+	Context := runFolderInput(t, in)
+
+	if msg := nextMessage(t, Context); msg.Body != `{"method":"before"}` {
+		t.Errorf("message %q, want the file written before the start", msg.Body)
+	}
+
+	// a file being written is read after the rename
+	tmp := filepath.Join(dir, "a.json.tmp")
+	os.WriteFile(tmp, []byte(`{"method":"a"}`), 0644)
+	noMoreMessages(t, Context, 50*time.Millisecond)
+	os.Rename(tmp, filepath.Join(dir, "a.json"))
+	if msg := nextMessage(t, Context); msg.Body != `{"method":"a"}` {
+		t.Errorf("message %q, want the renamed file", msg.Body)
+	}
+
+	// a new sub directory is watched too, the done files are not read again
+	sub := filepath.Join(dir, "host1")
+	os.Mkdir(sub, 0755)
+	time.Sleep(20 * time.Millisecond)
+	writeFolderFile(t, filepath.Join(sub, "b.json"), `{"method":"b"}`)
+	if msg := nextMessage(t, Context); msg.Body != `{"method":"b"}` {
+		t.Errorf("message %q, want the file of the sub directory", msg.Body)
+	}
+	noMoreMessages(t, Context, 100*time.Millisecond)
+
+	for _, name := range []string{"before.json", "a.json", "b.json"} {
+		if _, err := os.Stat(filepath.Join(dir, "done", name)); err != nil {
+			t.Errorf("%s not moved to done: %s", name, err)
+		}
+	}
+}
+
+func TestFolderFilters(t *testing.T) {
+	dir := t.TempDir()
+	recursive := false
+	Context := runFolderInput(t, &_inFolderConfig{Path: dir, FilePrefix: "alert-", FileSuffix: ".json",
+		Recursive: &recursive})
+
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	writeFolderFile(t, filepath.Join(dir, "sub", "alert-1.json"), `{"method":"sub"}`)
+	writeFolderFile(t, filepath.Join(dir, "other-1.json"), `{"method":"other"}`)
+	writeFolderFile(t, filepath.Join(dir, "alert-1.txt"), `{"method":"txt"}`)
+	writeFolderFile(t, filepath.Join(dir, "alert-2.json"), `{"method":"alert"}`)
+
+	if msg := nextMessage(t, Context); msg.Body != `{"method":"alert"}` {
+		t.Errorf("message %q, want only the matching file", msg.Body)
+	}
+	noMoreMessages(t, Context, 100*time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "alert-2.json")); !os.IsNotExist(err) {
+		t.Error("processed file not deleted")
+	}
+}
+
+func TestFolderFailed(t *testing.T) {
+	dir := t.TempDir()
+	Context := runFolderInput(t, &_inFolderConfig{Path: dir})
+
+	writeFolderFile(t, filepath.Join(dir, "bad.json"), `{"method":`)
+	deadline := time.Now().Add(time.Second)
+	sidecar := filepath.Join(dir, "failed", "bad.json.error")
+	for {
+		if _, err := os.Stat(sidecar); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if reason, err := os.ReadFile(sidecar); err != nil || !strings.Contains(string(reason), "JSON") {
+		t.Errorf("error file %q %v, want the JSON error", reason, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed", "bad.json")); err != nil {
+		t.Errorf("invalid file not moved to failed: %s", err)
+	}
+	noMoreMessages(t, Context, 50*time.Millisecond)
+}
+
+func TestFolderPoll(t *testing.T) {
+	dir := t.TempDir()
+	Context := runFolderInput(t, &_inFolderConfig{Path: dir, Watch: "poll"})
+
+	writeFolderFile(t, filepath.Join(dir, "a.json"), `{"method":"a"}`)
+	if msg := nextMessage(t, Context); msg.Body != `{"method":"a"}` {
+		t.Errorf("message %q, want the file found by the scan", msg.Body)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func runSocketInput(t *testing.T, in *_inSocketConfig) *_context {
+	t.Helper()
+	Context := testContext()
+	Context.InputTimeout = 100 * time.Millisecond
+	Context.InputsReady.Add(1)
+	go inputSocket(Context, in)
+	Context.InputsReady.Wait()
+	t.Cleanup(func() {
+		close(Context.StopChan)
+		Context.ActiveInputs.Wait()
+	})
+	return Context
+}
+
+func sendSocket(t *testing.T, network, address, message string) {
+	t.Helper()
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(message))
+	conn.(interface{ CloseWrite() error }).CloseWrite()
+}
+
+func TestSocketUnixMode(t *testing.T) {
+	dir := t.TempDir()
+	in := &_inSocketConfig{Type: "unix", Address: filepath.Join(dir, "notifier.sock"), Mode: "0620"}
+	Context := runSocketInput(t, in)
+
+	stat, err := os.Stat(in.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode()&os.ModeSocket == 0 || stat.Mode().Perm() != 0620 {
+		t.Errorf("socket mode %s, want socket 0620", stat.Mode())
+	}
+	// the directory of the bind is removed
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files in the directory, want only the socket", len(entries))
+	}
+
+	sendSocket(t, "unix", in.Address, ` {"method":"a"}`+"\n")
+	msg := nextMessage(t, Context)
+	if msg.Body != `{"method":"a"}` {
+		t.Errorf("message %q", msg.Body)
+	}
+	if msg.Peer["uid"] != uint32(os.Getuid()) || msg.Peer["pid"] != int32(os.Getpid()) {
+		t.Errorf("peer %v, want this process", msg.Peer)
+	}
+}
+
+func TestSocketPeerCred(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+	tests := []struct {
+		name    string
+		in      *_inSocketConfig
+		allowed bool
+	}{
+		{"no lists", &_inSocketConfig{}, true},
+		{"allowed uid", &_inSocketConfig{AllowUids: []int{uid + 1, uid}}, true},
+		{"allowed gid", &_inSocketConfig{AllowUids: []int{uid + 1}, AllowGids: []int{gid}}, true},
+		{"not allowed", &_inSocketConfig{AllowUids: []int{uid + 1}, AllowGids: []int{gid + 1}}, false},
+		{"denied uid", &_inSocketConfig{DenyUids: []int{uid}}, false},
+		{"denied gid over allowed uid", &_inSocketConfig{AllowUids: []int{uid}, DenyGids: []int{gid}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.in.Type = "unix"
+			test.in.Address = filepath.Join(t.TempDir(), "notifier.sock")
+			Context := runSocketInput(t, test.in)
+
+			sendSocket(t, "unix", test.in.Address, `{"method":"a"}`)
+			if test.allowed {
+				nextMessage(t, Context)
+			} else {
+				noMoreMessages(t, Context, 100*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestSocketTcpPeer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	Context := runSocketInput(t, &_inSocketConfig{Type: "tcp", Address: address})
+	sendSocket(t, "tcp", address, `{"method":"a"}`)
+	if msg := nextMessage(t, Context); msg.Peer["address"] != "127.0.0.1" {
+		t.Errorf("peer %v, want the client address", msg.Peer)
+	}
+}
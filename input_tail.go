@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const tailMaxRecord = 1024 * 1024
+
+type _tailOffset struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+type tailFollower struct {
+	in     *_inTailConfig
+	file   *os.File
+	inode  uint64
+	offset int64 // position of the last fully processed record
+	saved  int64 // last persisted offset
+	fifo   bool
+
+	started bool // the first open decides where to start reading
+	rotated bool // the next open starts at the beginning of the new file
+}
+
+func inputTail(Context *_context, in *_inTailConfig) {
+	log.Printf("Starting TAIL input: %s", in.Path)
+	Context.ActiveInputs.Add(1)
+	defer Context.ActiveInputs.Done()
+	Context.InputsReady.Done()
+
+	if in.Format == "" {
+		in.Format = "lines"
+	}
+	if in.Format != "lines" && in.Format != "journal-export" {
+		log.Fatalf("INPUT-TAIL: unknown format \"%s\" for %s", in.Format, in.Path)
+	}
+	for ii := range in.Rules {
+		rule := &in.Rules[ii]
+		regex, err := regexp.Compile(rule.Match)
+		if err != nil {
+			log.Fatalf("INPUT-TAIL: invalid rule regex \"%s\" for %s : %s", rule.Match, in.Path, err)
+		}
+		rule.regex = regex
+		if rule.Field == "" {
+			rule.Field = "MESSAGE"
+		}
+	}
+
+	poll_t := time.Duration(in.PollTime) * time.Millisecond
+	if poll_t == 0 {
+		poll_t = 500 * time.Millisecond
+	}
+
+	tf := &tailFollower{in: in}
+	defer tf.close()
+
+	pending := make([]byte, 0, 64*1024)
+	buf := make([]byte, 64*1024)
+	feed := func(data []byte) {
+		pending = append(pending, data...)
+		consumed := tailProcess(Context, in, pending)
+		tf.offset += int64(consumed)
+		pending = append(pending[:0], pending[consumed:]...)
+
+		if len(pending) > tailMaxRecord {
+			log.Printf("INPUT-TAIL: dropping %d bytes from %s : record too long", len(pending), in.Path)
+			tf.offset += int64(len(pending))
+			pending = pending[:0]
+		}
+	}
+	for {
+		if IsStopping(Context) {
+			break
+		}
+
+		if tf.file == nil {
+			if err := tf.open(); err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("INPUT-TAIL: Error opening %s : %s", in.Path, err)
+				}
+				select {
+				case <-time.After(poll_t):
+				case <-Context.StopChan:
+				}
+				continue
+			}
+			pending = pending[:0]
+		}
+
+		if tf.fifo { // reading a FIFO blocks, wake up to check for stop
+			tf.file.SetReadDeadline(time.Now().Add(poll_t))
+		}
+		n, err := tf.file.Read(buf)
+		if n > 0 {
+			feed(buf[:n])
+			continue
+		}
+		if tf.fifo && errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		if err != nil && err != io.EOF {
+			log.Printf("INPUT-TAIL: Error reading %s : %s", in.Path, err)
+			tf.close()
+			continue
+		}
+
+		// EOF: persist progress and check for rotation or truncation
+		tf.saveOffset()
+		select {
+		case <-time.After(poll_t):
+		case <-Context.StopChan:
+			continue
+		}
+
+		if tf.fifo {
+			continue
+		}
+		switch tf.checkRotation() {
+		case "rotated":
+			log.Printf("INPUT-TAIL: %s was rotated, reopening", in.Path)
+			// the lines written to the old file since the last read are still in it
+			for {
+				n, err := tf.file.Read(buf)
+				if n > 0 {
+					feed(buf[:n])
+				}
+				if n == 0 || err != nil {
+					break
+				}
+			}
+			if len(pending) > 0 && in.Format == "lines" {
+				tailProcess(Context, in, append(pending, '\n'))
+			}
+			tf.close()
+			tf.rotated = true
+		case "truncated":
+			log.Printf("INPUT-TAIL: %s was truncated, reading from the start", in.Path)
+			pending = pending[:0]
+			tf.offset = 0
+			if _, err := tf.file.Seek(0, io.SeekStart); err != nil {
+				tf.close()
+			}
+		}
+	}
+	tf.saveOffset()
+	log.Printf("Stopping TAIL input: %s", in.Path)
+}
+
+func (tf *tailFollower) open() error {
+	in := tf.in
+
+	// O_RDWR keeps a FIFO open even when all writers are gone
+	stat, err := os.Stat(in.Path)
+	if err != nil {
+		return err
+	}
+	tf.fifo = stat.Mode()&os.ModeNamedPipe != 0
+	flags := os.O_RDONLY
+	if tf.fifo {
+		flags = os.O_RDWR
+	}
+
+	file, err := os.OpenFile(in.Path, flags, 0)
+	if err != nil {
+		return err
+	}
+	if tf.fifo {
+		tf.file = file
+		return nil
+	}
+
+	stat, err = file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	inode := stat.Sys().(*syscall.Stat_t).Ino
+
+	switch {
+	case tf.rotated:
+		tf.offset = 0
+	case tf.started && tf.inode == inode:
+		// reopened after an error, keep the current offset
+	case tf.started:
+		tf.offset = 0
+	default:
+		tf.offset = tf.initialOffset(inode, stat.Size())
+	}
+	if tf.offset > stat.Size() {
+		tf.offset = 0
+	}
+	if _, err := file.Seek(tf.offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+
+	tf.file = file
+	tf.inode = inode
+	tf.saved = -1 // force saving the new position
+	tf.started = true
+	tf.rotated = false
+	return nil
+}
+
+func (tf *tailFollower) close() {
+	if tf.file != nil {
+		tf.file.Close()
+		tf.file = nil
+	}
+}
+
+func (tf *tailFollower) checkRotation() string {
+	stat, err := os.Stat(tf.in.Path)
+	if err != nil {
+		return "" // file is being recreated, wait for it
+	}
+	if stat.Sys().(*syscall.Stat_t).Ino != tf.inode {
+		return "rotated"
+	}
+	if stat.Size() < tf.offset {
+		return "truncated"
+	}
+	return ""
+}
+
+/*
+ * Continues from the persisted offset if the file is the same,
+ * reads the whole file if it was rotated while we were down,
+ * otherwise starts at the end unless from-start is set.
+ */
+func (tf *tailFollower) initialOffset(inode uint64, size int64) int64 {
+	if tf.in.OffsetFile != "" {
+		content, err := os.ReadFile(tf.in.OffsetFile)
+		if err == nil {
+			var state _tailOffset
+			if err := json.Unmarshal(content, &state); err == nil {
+				if state.Inode == inode {
+					return state.Offset
+				}
+				return 0
+			}
+			log.Printf("INPUT-TAIL: Error parsing offset file %s : %s", tf.in.OffsetFile, err)
+		} else if !os.IsNotExist(err) {
+			log.Printf("INPUT-TAIL: Error reading offset file %s : %s", tf.in.OffsetFile, err)
+		}
+	}
+	if tf.in.FromStart {
+		return 0
+	}
+	return size
+}
+
+func (tf *tailFollower) saveOffset() {
+	if tf.in.OffsetFile == "" || tf.fifo || tf.inode == 0 || tf.saved == tf.offset {
+		return
+	}
+	content, _ := json.Marshal(_tailOffset{Inode: tf.inode, Offset: tf.offset})
+
+	// write and rename, so a crash never leaves a half written offset
+	tmp := tf.in.OffsetFile + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		log.Printf("INPUT-TAIL: Error writing offset file %s : %s", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, tf.in.OffsetFile); err != nil {
+		log.Printf("INPUT-TAIL: Error writing offset file %s : %s", tf.in.OffsetFile, err)
+		return
+	}
+	tf.saved = tf.offset
+}
+
+/*
+ * Processes all complete records in data and returns the number of consumed bytes
+ */
+func tailProcess(Context *_context, in *_inTailConfig, data []byte) int {
+	consumed := 0
+	for {
+		var n int
+		var fields map[string]string
+		if in.Format == "journal-export" {
+			n, fields = parseJournalEntry(data[consumed:])
+		} else {
+			idx := bytes.IndexByte(data[consumed:], '\n')
+			if idx == -1 {
+				return consumed
+			}
+			n = idx + 1
+			fields = map[string]string{
+				"MESSAGE": strings.TrimRight(string(data[consumed:consumed+idx]), "\r"),
+			}
+		}
+		if n == 0 {
+			return consumed
+		}
+		consumed += n
+
+		if len(fields) > 0 {
+			tailMatch(Context, in, fields)
+		}
+	}
+}
+
+func tailMatch(Context *_context, in *_inTailConfig, fields map[string]string) {
+	for ii := range in.Rules {
+		rule := &in.Rules[ii]
+		value, ok := fields[rule.Field]
+		if !ok {
+			continue
+		}
+		match := rule.regex.FindStringSubmatch(value)
+		if match == nil {
+			continue
+		}
+
+		params := map[string]interface{}{
+			"path": in.Path,
+			"line": value,
+		}
+		for idx, name := range rule.regex.SubexpNames() {
+			if name != "" {
+				params[name] = match[idx]
+			}
+		}
+		if in.Format == "journal-export" {
+			params["journal"] = fields
+		}
+
+		message, err := json.Marshal(JsonRpcRequest{
+			JSONRPC: "2.0",
+			Method:  rule.Method,
+			Params:  params,
+		})
+		if err != nil {
+			log.Printf("INPUT-TAIL: error encoding message from %s : %s", in.Path, err)
+			return
+		}
+		Context.Messages <- InputMessage{Body: string(message)}
+
+		if !rule.Continue {
+			return
+		}
+	}
+}
+
+/*
+ * Parses one entry of the journal export format:
+ *   FIELD=value\n
+ *   FIELD\n<64bit little endian size><binary data>\n
+ * Entries are separated by an empty line.
+ * Returns 0 if the entry is not complete yet.
+ */
+func parseJournalEntry(data []byte) (int, map[string]string) {
+	fields := make(map[string]string)
+	pos := 0
+	for {
+		idx := bytes.IndexByte(data[pos:], '\n')
+		if idx == -1 {
+			return 0, nil
+		}
+		line := data[pos : pos+idx]
+		pos += idx + 1
+
+		if len(line) == 0 { // end of entry
+			return pos, fields
+		}
+
+		if eq := bytes.IndexByte(line, '='); eq != -1 {
+			fields[string(line[:eq])] = string(line[eq+1:])
+			continue
+		}
+
+		// binary field
+		if len(data)-pos < 8 {
+			return 0, nil
+		}
+		size := binary.LittleEndian.Uint64(data[pos : pos+8])
+		if size > tailMaxRecord {
+			log.Printf("INPUT-TAIL: journal field %s is too long, skipping", line)
+			return len(data), nil
+		}
+		pos += 8
+		if uint64(len(data)-pos) < size+1 {
+			return 0, nil
+		}
+		fields[string(line)] = string(data[pos : pos+int(size)])
+		pos += int(size) + 1
+	}
+}
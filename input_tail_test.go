@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+/*
+ * Journal export field with binary data, as written for values with newlines
+ */
+func journalBinary(name string, value string) string {
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, uint64(len(value)))
+	return name + "\n" + string(size) + value + "\n"
+}
+
+func TestParseJournalEntry(t *testing.T) {
+	entry := "MESSAGE=disk full\nPRIORITY=3\n_SYSTEMD_UNIT=backup.service\n\n"
+	binary_entry := "PRIORITY=2\n" + journalBinary("MESSAGE", "line one\nline two") + "\n"
+
+	tests := []struct {
+		name     string
+		data     string
+		consumed int
+		fields   map[string]string
+	}{
+		{"text fields", entry + "MESSAGE=next", len(entry), map[string]string{
+			"MESSAGE": "disk full", "PRIORITY": "3", "_SYSTEMD_UNIT": "backup.service"}},
+		{"value with =", "MESSAGE=a=b\n\n", 13, map[string]string{"MESSAGE": "a=b"}},
+		{"binary field", binary_entry, len(binary_entry), map[string]string{
+			"PRIORITY": "2", "MESSAGE": "line one\nline two"}},
+		{"empty binary field", journalBinary("MESSAGE", "") + "\n", 18, map[string]string{"MESSAGE": ""}},
+		{"incomplete entry", "MESSAGE=disk full\nPRIORITY=3\n", 0, nil},
+		{"incomplete line", "MESSAGE=disk", 0, nil},
+		{"incomplete binary size", "MESSAGE\n\x05\x00\x00", 0, nil},
+		{"incomplete binary data", binary_entry[:len(binary_entry)-5], 0, nil},
+		{"binary data without newline", binary_entry[:len(binary_entry)-2], 0, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			consumed, fields := parseJournalEntry([]byte(test.data))
+			if consumed != test.consumed {
+				t.Errorf("consumed %d, want %d", consumed, test.consumed)
+			}
+			if !reflect.DeepEqual(fields, test.fields) {
+				t.Errorf("fields %q, want %q", fields, test.fields)
+			}
+		})
+	}
+}
+
+func TestParseJournalEntryTooLong(t *testing.T) {
+	size := make([]byte, 8)
+	binary.LittleEndian.PutUint64(size, tailMaxRecord+1)
+	data := []byte("MESSAGE\n" + string(size) + "data")
+
+	consumed, fields := parseJournalEntry(data)
+	if consumed != len(data) || fields != nil {
+		t.Errorf("consumed %d fields %v, want the data skipped", consumed, fields)
+	}
+}
+
+func tailTestInput(format string, rules ..._inTailRuleConfig) *_inTailConfig {
+	in := &_inTailConfig{Path: "/var/log/test.log", Format: format, Rules: rules}
+	for ii := range in.Rules {
+		rule := &in.Rules[ii]
+		rule.regex = regexp.MustCompile(rule.Match)
+		if rule.Field == "" {
+			rule.Field = "MESSAGE"
+		}
+	}
+	return in
+}
+
+/*
+ * Methods and params of the messages produced from data
+ */
+func tailMessages(t *testing.T, in *_inTailConfig, data string) (int, []JsonRpcRequest) {
+	t.Helper()
+	Context := testContext()
+	consumed := tailProcess(Context, in, []byte(data))
+	var requests []JsonRpcRequest
+	for len(Context.Messages) > 0 {
+		requests = append(requests, decodeMessage(t, <-Context.Messages))
+	}
+	return consumed, requests
+}
+
+func requestMethods(requests []JsonRpcRequest) []string {
+	methods := []string{}
+	for _, request := range requests {
+		methods = append(methods, request.Method)
+	}
+	return methods
+}
+
+func TestTailRules(t *testing.T) {
+	rules := []_inTailRuleConfig{
+		{Match: `(?P<level>ERROR|FATAL)`, Method: "log.error", Continue: true},
+		{Match: `disk`, Method: "log.disk"},
+		{Match: `.`, Method: "log.any"},
+	}
+
+	tests := []struct {
+		line    string
+		methods []string
+	}{
+		{"ERROR disk full", []string{"log.error", "log.disk"}},    // continue to the next rule, stop after disk
+		{"ERROR out of memory", []string{"log.error", "log.any"}}, // continue skips the not matching rule
+		{"disk mounted", []string{"log.disk"}},
+		{"started", []string{"log.any"}},
+		{"", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			_, requests := tailMessages(t, tailTestInput("lines", rules...), test.line+"\n")
+			if methods := requestMethods(requests); !reflect.DeepEqual(methods, test.methods) {
+				t.Errorf("methods %v, want %v", methods, test.methods)
+			}
+		})
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	in := tailTestInput("lines", _inTailRuleConfig{Match: `^(?P<user>\w+) failed`, Method: "auth"})
+
+	consumed, requests := tailMessages(t, in, "root failed\r\nok\nbob failed\nalice fa")
+	if consumed != len("root failed\r\nok\nbob failed\n") {
+		t.Errorf("consumed %d, want the incomplete line left", consumed)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("%d messages, want 2", len(requests))
+	}
+	want := map[string]interface{}{"path": "/var/log/test.log", "line": "root failed", "user": "root"}
+	if !reflect.DeepEqual(requests[0].Params, want) {
+		t.Errorf("params %v, want %v", requests[0].Params, want)
+	}
+	if params := requests[1].Params.(map[string]interface{}); params["user"] != "bob" {
+		t.Errorf("params %v, want user bob", params)
+	}
+}
+
+func TestTailJournal(t *testing.T) {
+	in := tailTestInput("journal-export",
+		_inTailRuleConfig{Match: `^[0-3]$`, Field: "PRIORITY", Method: "journal.error", Continue: true},
+		_inTailRuleConfig{Match: `(?P<unit>\w+)\.service`, Field: "_SYSTEMD_UNIT", Method: "journal.unit"},
+	)
+	data := "MESSAGE=disk full\nPRIORITY=2\n_SYSTEMD_UNIT=backup.service\n\n" +
+		"MESSAGE=started\nPRIORITY=6\n\n" +
+		"PRIORITY=3\n" + journalBinary("MESSAGE", "multi\nline") + "\n" +
+		"MESSAGE=incomplete\n"
+
+	consumed, requests := tailMessages(t, in, data)
+	if consumed != len(data)-len("MESSAGE=incomplete\n") {
+		t.Errorf("consumed %d, want the incomplete entry left", consumed)
+	}
+	if methods := requestMethods(requests); !reflect.DeepEqual(methods,
+		[]string{"journal.error", "journal.unit", "journal.error"}) {
+		t.Fatalf("methods %v", methods)
+	}
+
+	params := requests[1].Params.(map[string]interface{})
+	if params["unit"] != "backup" || params["line"] != "backup.service" {
+		t.Errorf("params %v, want unit backup", params)
+	}
+	journal := params["journal"].(map[string]interface{})
+	if journal["MESSAGE"] != "disk full" {
+		t.Errorf("journal %v, want the entry fields", journal)
+	}
+	journal = requests[2].Params.(map[string]interface{})["journal"].(map[string]interface{})
+	if journal["MESSAGE"] != "multi\nline" {
+		t.Errorf("journal %v, want the binary MESSAGE", journal)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -14,6 +16,7 @@ import (
 	"strings"
 	"syscall"
 	"time"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -21,49 +24,66 @@ import (
 func StartInputs(Context *_context) {
 	inputs := &Context.Config.Inputs
 	for ii := range len(inputs.Sockets) {
+		Context.InputsReady.Add(1)
 		go inputSocket(Context, &inputs.Sockets[ii])
 	}
 	for ii := range len(inputs.Folders) {
+		Context.InputsReady.Add(1)
 		go inputFolder(Context, &inputs.Folders[ii])
 	}
 	for ii := range len(inputs.Pipes) {
+		Context.InputsReady.Add(1)
 		go inputPipe(Context, &inputs.Pipes[ii])
 	}
 	for ii := range len(inputs.Http) {
+		Context.InputsReady.Add(1)
 		go inputHttp(Context, &inputs.Http[ii])
 	}
-}
-
-func inputSocket(Context *_context, in *_inSocketConfig) {
-	log.Printf("Starting SOCKET input: %s:%s", in.Type, in.Address)
-	Context.ActiveInputs.Add(1)
-	defer Context.ActiveInputs.Done()
-
-	if in.Type == "udp" {
-		log.Fatalf("udp sockets are not supported")
-		return
+	for ii := range len(inputs.Docker) {
+		Context.InputsReady.Add(1)
+		go inputDocker(Context, &inputs.Docker[ii])
 	}
-
-	if in.Type == "unix" {
-		// Remove the socket file if it already exists
-		os.Remove(in.Address)
-		defer os.Remove(in.Address)
+	for ii := range len(inputs.Tail) {
+		Context.InputsReady.Add(1)
+		go inputTail(Context, &inputs.Tail[ii])
 	}
-
-	timeout := time.Duration(in.Timeout) * time.Millisecond
-	if timeout == 0 {
-		timeout = Context.InputTimeout
+	for ii := range len(inputs.Mqtt) {
+		Context.InputsReady.Add(1)
+		go inputMqtt(Context, &inputs.Mqtt[ii])
 	}
+	for ii := range len(inputs.Nats) {
+		Context.InputsReady.Add(1)
+		go inputNats(Context, &inputs.Nats[ii])
+	}
+	for ii := range len(inputs.Redis) {
+		Context.InputsReady.Add(1)
+		go inputRedis(Context, &inputs.Redis[ii])
+	}
+	for ii := range len(inputs.Amqp) {
+		Context.InputsReady.Add(1)
+		go inputAmqp(Context, &inputs.Amqp[ii])
+	}
+	for ii := range len(inputs.Kafka) {
+		Context.InputsReady.Add(1)
+		go inputKafka(Context, &inputs.Kafka[ii])
+	}
+}
 
-	// Setup Listener
-	unix_timeout := unix.Timeval{Sec: int64(timeout / time.Second), Usec: int64(timeout % time.Second)}
+/*
+ * Listens with SO_REUSEPORT, so several processes could share the address.
+ * Unix sockets do not support it, since Linux 6.10 it is an error.
+ */
+func listenSocket(network, address string, timeout time.Duration) (net.Listener, error) {
+	unix_timeout := unix.Timeval{Sec: int64(timeout / time.Second), Usec: int64(timeout % time.Second / time.Microsecond)}
 	lc := net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
 			var opErr error
 			if err := c.Control(func(fd uintptr) {
-				opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
-				if opErr != nil {
-					return
+				if network != "unix" {
+					opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+					if opErr != nil {
+						return
+					}
 				}
 				opErr = unix.SetsockoptTimeval(int(fd), unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix_timeout)
 			}); err != nil {
@@ -72,13 +92,75 @@ func inputSocket(Context *_context, in *_inSocketConfig) {
 			return opErr
 		},
 	}
+	return lc.Listen(context.Background(), network, address)
+}
 
-	// Start listener
-	l, err := lc.Listen(context.Background(), in.Type, in.Address)
+/*
+ * Binds the unix socket in a new 0700 directory next to the address and moves it
+ * in place after the mode and owner are set, so it is never reachable with the umask ones
+ */
+func listenUnixSocket(in *_inSocketConfig, timeout time.Duration) (net.Listener, error) {
+	tmp_dir, err := os.MkdirTemp(filepath.Dir(in.Address), ".sock-")
 	if err != nil {
-		log.Fatalf("INPUT-SOCKET: Error listening on socket %s: %v", in.Address, err)
+		return nil, err
+	}
+	defer os.RemoveAll(tmp_dir)
+
+	tmp_path := filepath.Join(tmp_dir, filepath.Base(in.Address))
+	l, err := listenSocket("unix", tmp_path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	// the socket file is removed on exit by its final path
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := setFilePerms(tmp_path, in.Mode, in.Owner, in.Group); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("setting permissions: %w", err)
+	}
+	if err := os.Rename(tmp_path, in.Address); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func inputSocket(Context *_context, in *_inSocketConfig) {
+	log.Printf("Starting SOCKET input: %s:%s", in.Type, in.Address)
+	Context.ActiveInputs.Add(1)
+	defer Context.ActiveInputs.Done()
+
+	if in.Type == "udp" {
+		log.Fatalf("udp sockets are not supported")
+		return
+	}
+
+	timeout := time.Duration(in.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = Context.InputTimeout
+	}
+
+	// Use the socket passed by systemd or create own
+	l, activated := activatedListener(in.Name, in.Type, in.Address)
+	if !activated {
+		if in.Type == "unix" {
+			// Remove the socket file if it already exists
+			os.Remove(in.Address)
+			defer os.Remove(in.Address)
+		}
+
+		var err error
+		if in.Type == "unix" && !strings.HasPrefix(in.Address, "@") {
+			l, err = listenUnixSocket(in, timeout)
+		} else {
+			l, err = listenSocket(in.Type, in.Address, timeout)
+		}
+		if err != nil {
+			log.Fatalf("INPUT-SOCKET: Error listening on socket %s: %v", in.Address, err)
+		}
 	}
 	defer l.Close()
+	Context.InputsReady.Done()
 
 	// Wait for stop
 	go func() {
@@ -105,6 +187,23 @@ func inputSocket(Context *_context, in *_inSocketConfig) {
 		go func(c net.Conn) {
 			defer c.Close()
 
+			var peer map[string]interface{}
+			if in.Type == "unix" {
+				cred, err := getPeerCred(c)
+				if err != nil {
+					log.Printf("INPUT-SOCKET: Error reading peer credentials on socket %s: %v", in.Address, err)
+					return
+				}
+				if !isPeerAllowed(in, cred) {
+					log.Printf("INPUT-SOCKET: Peer pid=%d uid=%d gid=%d is not allowed on socket %s",
+						cred.Pid, cred.Uid, cred.Gid, in.Address)
+					return
+				}
+				peer = peerInfo(cred)
+			} else if host, _, err := net.SplitHostPort(c.RemoteAddr().String()); err == nil {
+				peer = map[string]interface{}{"address": host}
+			}
+
 			c.SetReadDeadline(time.Now().Add(timeout))
 			buf, err := io.ReadAll(conn)
 			if err != nil {
@@ -115,7 +214,7 @@ func inputSocket(Context *_context, in *_inSocketConfig) {
 			message := string(buf)
 			message = strings.TrimSpace(message)
 			if message != "" {
-				Context.Messages <- message
+				Context.Messages <- InputMessage{Body: message, Peer: peer}
 			}
 		}(conn)
 	}
@@ -126,129 +225,389 @@ func inputFolder(Context *_context, in *_inFolderConfig) {
 	log.Printf("Starting FOLDER input: %s", in.Path)
 	Context.ActiveInputs.Add(1)
 	defer Context.ActiveInputs.Done()
+	Context.InputsReady.Done()
+
+	in.Path = filepath.Clean(in.Path)
+	if in.TmpSuffix == "" {
+		in.TmpSuffix = ".tmp"
+	}
+	if in.DoneDir == "" {
+		in.DoneDir = filepath.Join(in.Path, "done")
+	}
+	if in.FailedDir == "" {
+		in.FailedDir = filepath.Join(in.Path, "failed")
+	}
+	in.DoneDir = filepath.Clean(in.DoneDir)
+	in.FailedDir = filepath.Clean(in.FailedDir)
+	if in.Recursive == nil {
+		recursive := true
+		in.Recursive = &recursive
+	}
 
 	scan_t := time.Duration(in.ScanTime) * time.Millisecond
+	if scan_t == 0 {
+		scan_t = time.Second
+	}
+
+	if in.Watch != "poll" {
+		err := folderWatch(Context, in, scan_t)
+		if err == nil {
+			log.Printf("Stopping FOLDER input: %s", in.Path)
+			return
+		}
+		log.Printf("INPUT-FOLDER: inotify on %s failed, fallback to polling : %s", in.Path, err)
+	}
+
 	for {
 		if IsStopping(Context) {
 			log.Printf("Stopping FOLDER input: %s", in.Path)
 			return
 		}
-		err := filepath.WalkDir(in.Path,
-			func(path string, d fs.DirEntry, err error) error {
-				if err != nil {
+		folderScan(Context, in, in.Path)
+
+		// Interruptable sleep
+		select {
+		case <-time.After(scan_t):
+		case <-Context.StopChan:
+		}
+	}
+}
+
+/*
+ * Waits for IN_CLOSE_WRITE and IN_MOVED_TO events, so only complete files are read.
+ * Returns error if inotify cannot be used and the caller should poll instead.
+ */
+func folderWatch(Context *_context, in *_inFolderConfig, scan_t time.Duration) error {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	// non-blocking fd goes to the runtime poller and supports read deadlines
+	ifile := os.NewFile(uintptr(fd), "inotify:"+in.Path)
+	defer ifile.Close()
+
+	const mask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_CREATE |
+		unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+	watches := make(map[int]string)
+
+	addWatch := func(dir string) error {
+		wd, err := unix.InotifyAddWatch(fd, dir, mask)
+		if err != nil {
+			return fmt.Errorf("watch %s : %w", dir, err)
+		}
+		watches[wd] = dir
+		return nil
+	}
+	addTree := func(root string) error {
+		if !*in.Recursive {
+			return addWatch(root)
+		}
+		return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == root {
 					return err
 				}
-				if d.IsDir() {
-					return nil // skip directories
-				}
+				log.Printf("INPUT-FOLDER: Error scanning %s : %s", path, err)
+				return nil
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			if folderIsExcluded(in, path) {
+				return filepath.SkipDir
+			}
+			return addWatch(path)
+		})
+	}
 
-				fileName := d.Name()
-				if in.FilePrefix != "" &&
-					!strings.HasPrefix(fileName, in.FilePrefix) {
-					return nil
+	if err := addTree(in.Path); err != nil {
+		return err
+	}
+	// pick up the files written while we were not watching
+	folderScan(Context, in, in.Path)
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.PathMax))
+	for {
+		if IsStopping(Context) {
+			return nil
+		}
+
+		ifile.SetReadDeadline(time.Now().Add(scan_t))
+		n, err := ifile.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			return err
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := ""
+			if event.Len > 0 {
+				raw := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+				name = strings.TrimRight(string(raw), "\x00")
+			}
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+				log.Printf("INPUT-FOLDER: inotify queue overflow on %s, rescanning", in.Path)
+				folderScan(Context, in, in.Path)
+				continue
+			}
+			dir, ok := watches[int(event.Wd)]
+			if !ok {
+				continue
+			}
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(watches, int(event.Wd))
+				if dir == in.Path {
+					return fmt.Errorf("%s was removed", in.Path)
 				}
-				if in.FileSuffix != "" &&
-					!strings.HasSuffix(fileName, in.FileSuffix) {
-					return nil
+				continue
+			}
+			if event.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+				continue // IN_IGNORED follows
+			}
+
+			path := filepath.Join(dir, name)
+			if event.Mask&unix.IN_ISDIR != 0 {
+				if *in.Recursive && !folderIsExcluded(in, path) &&
+					event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+					if err := addTree(path); err != nil {
+						log.Printf("INPUT-FOLDER: Error watching %s : %s", path, err)
+					}
+					folderScan(Context, in, path) // files could be there before the watch
 				}
+				continue
+			}
+			if event.Mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0 {
+				folderProcessFile(Context, in, path)
+			}
+		}
+	}
+}
 
-				content, err := os.ReadFile(path)
-				if err != nil {
-					return err
+func folderScan(Context *_context, in *_inFolderConfig, root string) {
+	err := filepath.WalkDir(root,
+		func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				log.Printf("INPUT-FOLDER: Error scanning %s : %s", path, err)
+				if d != nil && d.IsDir() {
+					return filepath.SkipDir
 				}
-				if err := os.Remove(path); err != nil {
-					return err
+				return nil
+			}
+			if d.IsDir() {
+				if path == root {
+					return nil
 				}
-
-				message := string(content)
-				message = strings.TrimSpace(message)
-				if message != "" {
-					Context.Messages <- message
+				if !*in.Recursive || folderIsExcluded(in, path) {
+					return filepath.SkipDir
 				}
 				return nil
-			})
-		if err != nil {
-			log.Fatalf("INPUT-FOLDER: Error scanning %s : %v\n", in.Path, err)
+			}
+			folderProcessFile(Context, in, path)
+			return nil
+		})
+	if err != nil {
+		log.Printf("INPUT-FOLDER: Error scanning %s : %s", root, err)
+	}
+}
+
+func folderIsExcluded(in *_inFolderConfig, dir string) bool {
+	return dir == in.DoneDir || dir == in.FailedDir
+}
+
+func folderProcessFile(Context *_context, in *_inFolderConfig, path string) {
+	fileName := filepath.Base(path)
+	if strings.HasSuffix(fileName, in.TmpSuffix) {
+		return // still being written, wait for the rename
+	}
+	if in.FilePrefix != "" &&
+		!strings.HasPrefix(fileName, in.FilePrefix) {
+		return
+	}
+	if in.FileSuffix != "" &&
+		!strings.HasSuffix(fileName, in.FileSuffix) {
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("INPUT-FOLDER: Error reading %s : %s", path, err)
 		}
+		return
+	}
 
-		// Interruptable sleep
-		select {
-		case <-time.After(scan_t):
-		case <-Context.StopChan:
+	message := string(content)
+	message = strings.TrimSpace(message)
+	if message != "" {
+		var request JsonRpcRequest
+		if err := json.Unmarshal([]byte(message), &request); err != nil {
+			log.Printf("INPUT-FOLDER: Invalid JSON-RPC in %s : %s", path, err)
+			folderFailedFile(in, path, err)
+			return
+		}
+	}
+
+	if in.Processed == "move" {
+		if err := folderMoveFile(path, in.DoneDir); err != nil {
+			log.Printf("INPUT-FOLDER: Error moving %s to %s : %s", path, in.DoneDir, err)
+			return
 		}
+	} else if err := os.Remove(path); err != nil {
+		log.Printf("INPUT-FOLDER: Error removing %s : %s", path, err)
+		return
+	}
+
+	if message != "" {
+		Context.Messages <- InputMessage{Body: message}
 	}
 }
 
+func folderFailedFile(in *_inFolderConfig, path string, reason error) {
+	if in.Failed == "delete" {
+		if err := os.Remove(path); err != nil {
+			log.Printf("INPUT-FOLDER: Error removing %s : %s", path, err)
+		}
+		return
+	}
+
+	if err := folderMoveFile(path, in.FailedDir); err != nil {
+		log.Printf("INPUT-FOLDER: Error moving %s to %s : %s", path, in.FailedDir, err)
+		return
+	}
+	sidecar := filepath.Join(in.FailedDir, filepath.Base(path)+".error")
+	if err := os.WriteFile(sidecar, []byte(reason.Error()+"\n"), 0644); err != nil {
+		log.Printf("INPUT-FOLDER: Error writing %s : %s", sidecar, err)
+	}
+}
+
+func folderMoveFile(path string, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+}
+
 func inputPipe(Context *_context, in *_inPipeConfig) {
 	log.Printf("Starting PIPE input on %s", in.Path)
 	Context.ActiveInputs.Add(1)
 	defer Context.ActiveInputs.Done()
 
+	if in.Mode == "" {
+		in.Mode = "0666"
+	}
+	delimiter := []byte("\n")
+	if in.Delimiter != nil {
+		delimiter = []byte(*in.Delimiter)
+	}
+	if len(delimiter) == 0 {
+		// every read is one message, as a whole multi-line JSON
+		log.Printf("INPUT-PIPE: %s has no delimiter, writes queued together in the pipe are read as one message",
+			in.Path)
+	}
+	timeout := time.Duration(in.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = Context.InputTimeout
+	}
+
 	// Create pipe
-	err := syscall.Mkfifo(in.Path, 0666)
+	err := syscall.Mkfifo(in.Path, 0600)
 	if err != nil && !os.IsExist(err) {
 		log.Fatalf("INPUT-PIPE: Error creating named pipe %s : %s", in.Path, err)
 		return
 	}
+	if stat, err := os.Stat(in.Path); err != nil || stat.Mode()&os.ModeNamedPipe == 0 {
+		log.Fatalf("INPUT-PIPE: %s is not a named pipe", in.Path)
+		return
+	}
+	// mkfifo is subject to umask, set the permissions explicitly
+	if err := setFilePerms(in.Path, in.Mode, in.Owner, in.Group); err != nil {
+		log.Fatalf("INPUT-PIPE: Error setting permissions of %s : %s", in.Path, err)
+		return
+	}
+
+	// O_NONBLOCK puts the pipe in the runtime poller, no fd limits of select()
+	reader, err := os.OpenFile(in.Path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		log.Fatalf("INPUT-PIPE: Error opening named pipe %s : %s", in.Path, err)
+		return
+	}
+	defer reader.Close()
+
+	// Keep a write end open, so the reader never sees EOF when writers come and go
+	writer, err := os.OpenFile(in.Path, os.O_WRONLY, 0)
+	if err != nil {
+		log.Fatalf("INPUT-PIPE: Error opening named pipe %s : %s", in.Path, err)
+		return
+	}
+	defer writer.Close()
+	Context.InputsReady.Done()
+
+	// Wait for stop
+	go func() {
+		<-Context.StopChan
+		reader.Close()
+	}()
 
 	// Process messages
+	pending := make([]byte, 0, 64*1024)
+	buf := make([]byte, 64*1024)
 	for {
-		fd, err := syscall.Open(in.Path,
-			syscall.O_RDONLY|syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0666)
-		if err != nil {
-			log.Fatalf("INPUT-PIPE: Error opening named pipe %s : %s", in.Path, err)
-			return
+		// a last message without delimiter is sent when nothing more comes for timeout
+		if len(pending) > 0 {
+			reader.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			reader.SetReadDeadline(time.Time{})
 		}
-		defer syscall.Close(fd)
-
-		// prepare select
-		rfdset := &syscall.FdSet{}
-		fdset_ZERO(rfdset)
-
-		buf := make([]byte, 1024*1024)
-		for {
-			if IsStopping(Context) {
-				log.Printf("Stopping PIPE input: %s", in.Path)
-				return
+		n, err := reader.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			if message := strings.TrimSpace(string(pending)); message != "" {
+				Context.Messages <- InputMessage{Body: message}
 			}
-
-			// check File Description status
-			fdset_Set(rfdset, fd)
-			timeout := syscall.Timeval{Sec: 0, Usec: 100_000}
-
-			n, err_s := syscall.Select(fd+1, rfdset, nil, nil, &timeout)
-			if err_s != nil {
-				if err_s == syscall.EAGAIN || err_s == syscall.EINTR {
-					continue
-				}
-				log.Fatalf("INPUT-PIPE: Error polling the pipe %s : %s", in.Path, err_s)
+			pending = pending[:0]
+			continue
+		}
+		if err != nil {
+			if IsStopping(Context) || errors.Is(err, os.ErrClosed) {
 				break
 			}
-			if n == 0 || !fdset_IsSet(rfdset, fd) {
-				continue // select timeout
+			log.Printf("INPUT-PIPE: Error reading from pipe %s : %s", in.Path, err)
+			continue
+		}
+		if len(delimiter) == 0 {
+			if message := strings.TrimSpace(string(buf[:n])); message != "" {
+				Context.Messages <- InputMessage{Body: message}
 			}
+			continue
+		}
+		pending = append(pending, buf[:n]...)
 
-			// ready to read
-			n, err_r := syscall.Read(fd, buf)
-			if err_r != nil {
-				if err_r == syscall.EAGAIN || err_r == syscall.EINTR {
-					continue
-				}
-				log.Fatalf("INPUT-PIPE: Error reading from pipe %s : %s", in.Path, err_r)
-				break
-			}
-			if n == 0 { // EOF
+		// Writes up to PIPE_BUF are atomic, so messages from different writers
+		// are not interleaved if each ends with the delimiter
+		start := 0
+		for {
+			idx := bytes.Index(pending[start:], delimiter)
+			if idx == -1 {
 				break
 			}
-
-			message := string(buf[:n])
-			message = strings.TrimSpace(message)
+			message := strings.TrimSpace(string(pending[start : start+idx]))
+			start += idx + len(delimiter)
 			if message != "" {
-				Context.Messages <- message
+				Context.Messages <- InputMessage{Body: message}
 			}
 		}
-		syscall.Close(fd)
+		pending = append(pending[:0], pending[start:]...)
+
+		if len(pending) > 1024*1024 {
+			log.Printf("INPUT-PIPE: dropping %d bytes from %s : missing delimiter", len(pending), in.Path)
+			pending = pending[:0]
+		}
 	}
+	log.Printf("Stopping PIPE input: %s", in.Path)
 }
 
 func inputHttp(Context *_context, in *_inHttpConfig) {
@@ -261,29 +620,17 @@ func inputHttp(Context *_context, in *_inHttpConfig) {
 		timeout = Context.InputTimeout
 	}
 
-	// Setup Listener
-	unix_timeout := unix.Timeval{Sec: int64(timeout / time.Second), Usec: int64(timeout % time.Second)}
-	lc := net.ListenConfig{
-		Control: func(network, address string, c syscall.RawConn) error {
-			var opErr error
-			if err := c.Control(func(fd uintptr) {
-				opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
-				if opErr != nil {
-					return
-				}
-				opErr = unix.SetsockoptTimeval(int(fd), unix.SOL_SOCKET, unix.SO_RCVTIMEO, &unix_timeout)
-			}); err != nil {
-				return err
-			}
-			return opErr
-		},
-	}
-	// Start listener
-	l, err := lc.Listen(context.Background(), "tcp", in.Address)
-	if err != nil {
-		log.Fatalf("INPUT-HTTP: Error listening on socket %s: %v", in.Address, err)
+	// Use the socket passed by systemd or create own
+	l, activated := activatedListener(in.Name, "tcp", in.Address)
+	if !activated {
+		var err error
+		l, err = listenSocket("tcp", in.Address, timeout)
+		if err != nil {
+			log.Fatalf("INPUT-HTTP: Error listening on socket %s: %v", in.Address, err)
+		}
 	}
 	defer l.Close()
+	Context.InputsReady.Done()
 
 	// Setup HTTP server
 	http_handler := func(w http.ResponseWriter, r *http.Request) {
@@ -300,7 +647,11 @@ func inputHttp(Context *_context, in *_inHttpConfig) {
 		message := string(body)
 		message = strings.TrimSpace(message)
 		if message != "" {
-			Context.Messages <- message
+			var peer map[string]interface{}
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				peer = map[string]interface{}{"address": host}
+			}
+			Context.Messages <- InputMessage{Body: message, Peer: peer}
 		}
 	}
 
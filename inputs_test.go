@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func runPipeInput(t *testing.T, in *_inPipeConfig) (*_context, *os.File) {
+	t.Helper()
+	Context := testContext()
+	Context.InputTimeout = 100 * time.Millisecond
+	in.Path = filepath.Join(t.TempDir(), "notifier.pipe")
+	Context.InputsReady.Add(1)
+	go inputPipe(Context, in)
+	Context.InputsReady.Wait()
+	t.Cleanup(func() {
+		close(Context.StopChan)
+		Context.ActiveInputs.Wait()
+	})
+
+	writer, err := os.OpenFile(in.Path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { writer.Close() })
+	return Context, writer
+}
+
+func noMoreMessages(t *testing.T, Context *_context, wait time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-Context.Messages:
+		t.Errorf("unexpected message %q", msg.Body)
+	case <-time.After(wait):
+	}
+}
+
+func TestPipeDelimiter(t *testing.T) {
+	Context, writer := runPipeInput(t, &_inPipeConfig{})
+
+	// several messages in one write, one split across two writes
+	writer.WriteString(`{"method":"a"}` + "\n" + `{"method":"b"}` + "\n\n" + `{"method":`)
+	writer.WriteString(`"c"}` + "\n")
+
+	for _, want := range []string{`{"method":"a"}`, `{"method":"b"}`, `{"method":"c"}`} {
+		if msg := nextMessage(t, Context); msg.Body != want {
+			t.Errorf("message %q, want %q", msg.Body, want)
+		}
+	}
+	noMoreMessages(t, Context, 50*time.Millisecond)
+}
+
+func TestPipeTrailingMessage(t *testing.T) {
+	delimiter := "\x00"
+	Context, writer := runPipeInput(t, &_inPipeConfig{Delimiter: &delimiter})
+
+	writer.WriteString("{\"method\":\"a\",\n\"params\":{}}\x00{\"method\":\"b\"}")
+	if msg := nextMessage(t, Context); msg.Body != "{\"method\":\"a\",\n\"params\":{}}" {
+		t.Errorf("message %q, want the multi-line JSON", msg.Body)
+	}
+	// without the delimiter it is sent after the timeout
+	start := time.Now()
+	if msg := nextMessage(t, Context); msg.Body != `{"method":"b"}` {
+		t.Errorf("message %q, want the last one", msg.Body)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("last message sent before the timeout")
+	}
+	noMoreMessages(t, Context, 150*time.Millisecond)
+}
+
+func TestPipeWithoutDelimiter(t *testing.T) {
+	delimiter := ""
+	Context, writer := runPipeInput(t, &_inPipeConfig{Delimiter: &delimiter})
+
+	writer.WriteString("{\"method\": \"a\",\n \"params\": {}}\n")
+	if msg := nextMessage(t, Context); msg.Body != "{\"method\": \"a\",\n \"params\": {}}" {
+		t.Errorf("message %q, want the whole read", msg.Body)
+	}
+	noMoreMessages(t, Context, 50*time.Millisecond)
+}
+
+func TestPipeMode(t *testing.T) {
+	_, writer := runPipeInput(t, &_inPipeConfig{Mode: "0620"})
+	stat, err := os.Stat(writer.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode()&os.ModeNamedPipe == 0 || stat.Mode().Perm() != 0620 {
+		t.Errorf("pipe mode %s, want named pipe 0620", stat.Mode())
+	}
+}
@@ -13,8 +13,13 @@ import (
 )
 
 var ActiveWorkers AtomicCounter
+var PendingMessages AtomicCounter // waiting in a digest window or a rate limit delay
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == execSandboxArg {
+		runExecSandbox(os.Args[2:]) // does not return
+	}
+
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
@@ -30,38 +35,82 @@ func main() {
 	if err := InitConfig(configName, Context); err != nil {
 		log.Fatal(err)
 	}
+	initSocketActivation()
+	watchdog := initSdNotify()
 	StartInputs(Context)
+	Context.InputsReady.Wait()
+	sdNotify("READY=1")
+
+	// Watchdog and status are sent from the main loop, so a stuck loop is detected
+	status_t := 5 * time.Second
+	if watchdog > 0 && watchdog < status_t {
+		status_t = watchdog
+	}
+	status_ticker := time.NewTicker(status_t)
+	defer status_ticker.Stop()
+	dedup_ticker := time.NewTicker(time.Second)
+	defer dedup_ticker.Stop()
 
 	stopped := false
+	var parked *InputMessage // waits for a free worker
 	for {
+		// without free worker no message is taken, the tickers and signals are still served
+		messages := Context.Messages
+		if parked != nil {
+			if ActiveWorkers.Get() < int64(Context.Config.Workers) {
+				handleMessage(Context, *parked)
+				parked = nil
+			} else {
+				messages = nil
+			}
+		}
+
 		select {
-		case msg := <-Context.Messages:
+		case <-status_ticker.C:
+			if watchdog > 0 {
+				sdNotify("WATCHDOG=1")
+			}
+			sdNotifyStatus(Context)
+		case <-dedup_ticker.C:
+			dedupFollowups(Context, false)
+		case msg := <-messages:
 			if ActiveWorkers.Get() < int64(Context.Config.Workers) {
 				handleMessage(Context, msg)
 			} else {
-				time.Sleep(100 * time.Millisecond)
+				parked = &msg // the message is not dropped
 			}
 		case sig := <-signalChan:
 			if sig == syscall.SIGINT || sig == syscall.SIGTERM {
 				if !stopped {
 					log.Print("Received SIGTERM: try to stop gracefully")
+					sdNotify("STOPPING=1")
 					close(Context.StopChan)
 					Context.ActiveInputs.Wait()
 					stopped = true
 				}
 			} else if sig == syscall.SIGHUP {
 				log.Print("Received SIGHUP: reload config")
+				sdNotifyReloading()
 				new_Context := Reload(configName, Context)
 				if new_Context == nil {
+					sdNotify("READY=1")
 					continue
 				}
+				reloadDedup(Context, new_Context)
 				Context = new_Context
 				StartInputs(Context)
+				Context.InputsReady.Wait()
+				sdNotify("READY=1")
 			}
 		default:
-			if stopped {
-				for ActiveWorkers.Get() > 0 {
+			if stopped && parked == nil && len(Context.Messages) == 0 { // queued messages are handled before exit
+				dedupFollowups(Context, true)
+				for {
+					// the outputs of the last messages may not be started yet
 					time.Sleep(100 * time.Millisecond)
+					if ActiveWorkers.Get() == 0 && PendingMessages.Get() == 0 {
+						break
+					}
 				}
 				os.Exit(0)
 			}
@@ -69,38 +118,127 @@ func main() {
 	}
 }
 
-func handleMessage(Context *_context, msg string) {
-	msg_ctx := MessageContext{
+func handleMessage(Context *_context, in_msg InputMessage) {
+	msg_ctx := &MessageContext{
 		Context: Context,
+		Peer:    in_msg.Peer,
 	}
 
-	msg = strings.TrimSpace(msg)
+	msg := strings.TrimSpace(in_msg.Body)
 	if err := json.Unmarshal([]byte(msg), &msg_ctx.JsonRpc); err != nil {
 		log.Printf("Message: error decoding JSON-RPC: %s | err: %s", msg, err)
 		return
 	}
 	msg_ctx.JSONPath_Cache = make(map[string]string)
 
-	method, ok := Context.Config.Methods[msg_ctx.JsonRpc.Method]
+	rateLimit(msg_ctx, Context.Config.RateLimit, "source", sourceKey(msg_ctx.Peer), func() {
+		routeMessage(msg_ctx)
+	})
+}
+
+/*
+ * Finds the method of the message, applies its rate limit and dedup
+ */
+func routeMessage(msg_ctx *MessageContext) {
+	Context := msg_ctx.Context
+	method_name := msg_ctx.JsonRpc.Method
+	method, ok := Context.Config.Methods[method_name]
 	if !ok {
-		method, ok = Context.Config.Methods["default"]
+		method_name = "default"
+		method, ok = Context.Config.Methods[method_name]
 		if !ok {
 			log.Printf("Message: cannot handle method %s", msg_ctx.JsonRpc.Method)
 			return
 		}
 	}
 
-	for i := range len(method.Email) {
-		go outputEmail(&msg_ctx, &method.Email[i])
+	rateLimit(msg_ctx, method.RateLimit, "method "+method_name, "", func() {
+		if method.Dedup != nil && !dedupMessage(msg_ctx, method_name, method.Dedup) {
+			return
+		}
+		dispatchMessage(msg_ctx, &method)
+	})
+}
+
+/*
+ * Runs all outputs of the method
+ */
+func dispatchMessage(msg_ctx *MessageContext, method *_methodConfig) {
+	if len(method.Steps) > 0 {
+		go runSteps(msg_ctx, method)
+	}
+
+	for i := range method.Email {
+		runOutput(msg_ctx, "email", method.Email[i].RateLimit, &method.Email[i], outputEmail)
 	}
-	for i := range len(method.Socket) {
-		go outputSocket(&msg_ctx, &method.Socket[i])
+	for i := range method.Socket {
+		runOutput(msg_ctx, "socket", method.Socket[i].RateLimit, &method.Socket[i], outputSocket)
 	}
 	for i := range method.Http {
-		go outputHttp(&msg_ctx, &method.Http[i])
+		runOutput(msg_ctx, "http", method.Http[i].RateLimit, &method.Http[i], outputHttp)
 	}
 	for i := range method.Exec {
-		go execCommand(&msg_ctx, &method.Exec[i])
+		runOutput(msg_ctx, "exec", method.Exec[i].RateLimit, &method.Exec[i], execCommand)
+	}
+	for i := range method.Slack {
+		runOutput(msg_ctx, "slack", method.Slack[i].RateLimit, &method.Slack[i], outputSlack)
+	}
+	for i := range method.Mattermost {
+		runOutput(msg_ctx, "mattermost", method.Mattermost[i].RateLimit, &method.Mattermost[i], outputMattermost)
+	}
+	for i := range method.Teams {
+		runOutput(msg_ctx, "teams", method.Teams[i].RateLimit, &method.Teams[i], outputTeams)
+	}
+	for i := range method.Discord {
+		runOutput(msg_ctx, "discord", method.Discord[i].RateLimit, &method.Discord[i], outputDiscord)
+	}
+	for i := range method.Telegram {
+		runOutput(msg_ctx, "telegram", method.Telegram[i].RateLimit, &method.Telegram[i], outputTelegram)
+	}
+	for i := range method.Ntfy {
+		runOutput(msg_ctx, "ntfy", method.Ntfy[i].RateLimit, &method.Ntfy[i], outputNtfy)
+	}
+	for i := range method.Gotify {
+		runOutput(msg_ctx, "gotify", method.Gotify[i].RateLimit, &method.Gotify[i], outputGotify)
+	}
+	for i := range method.Pushover {
+		runOutput(msg_ctx, "pushover", method.Pushover[i].RateLimit, &method.Pushover[i], outputPushover)
+	}
+	for i := range method.PagerDuty {
+		runOutput(msg_ctx, "pagerduty", method.PagerDuty[i].RateLimit, &method.PagerDuty[i], outputPagerDuty)
+	}
+	for i := range method.Opsgenie {
+		runOutput(msg_ctx, "opsgenie", method.Opsgenie[i].RateLimit, &method.Opsgenie[i], outputOpsgenie)
+	}
+	for i := range method.Syslog {
+		runOutput(msg_ctx, "syslog", method.Syslog[i].RateLimit, &method.Syslog[i], outputSyslog)
+	}
+	for i := range method.Zabbix {
+		runOutput(msg_ctx, "zabbix", method.Zabbix[i].RateLimit, &method.Zabbix[i], outputZabbix)
+	}
+	for i := range method.Statsd {
+		runOutput(msg_ctx, "statsd", method.Statsd[i].RateLimit, &method.Statsd[i], outputStatsd)
+	}
+	for i := range method.Graphite {
+		runOutput(msg_ctx, "graphite", method.Graphite[i].RateLimit, &method.Graphite[i], outputGraphite)
+	}
+	for i := range method.Influxdb {
+		runOutput(msg_ctx, "influxdb", method.Influxdb[i].RateLimit, &method.Influxdb[i], outputInflux)
+	}
+	for i := range method.Mqtt {
+		runOutput(msg_ctx, "mqtt", method.Mqtt[i].RateLimit, &method.Mqtt[i], outputMqtt)
+	}
+	for i := range method.Nats {
+		runOutput(msg_ctx, "nats", method.Nats[i].RateLimit, &method.Nats[i], outputNats)
+	}
+	for i := range method.Redis {
+		runOutput(msg_ctx, "redis", method.Redis[i].RateLimit, &method.Redis[i], outputRedis)
+	}
+	for i := range method.Amqp {
+		runOutput(msg_ctx, "amqp", method.Amqp[i].RateLimit, &method.Amqp[i], outputAmqp)
+	}
+	for i := range method.Kafka {
+		runOutput(msg_ctx, "kafka", method.Kafka[i].RateLimit, &method.Kafka[i], outputKafka)
 	}
 }
 
@@ -119,6 +257,9 @@ func Reload(configName string, old_Context *_context) *_context {
 	for msg := range old_Context.Messages {
 		new_Context.Messages <- msg
 	}
+	closeBrokerOutputs(old_Context)
+	closeSyslogOutputs(old_Context)
+	closeEmailOutputs(old_Context)
 
 	return new_Context
 }
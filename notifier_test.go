@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+/*
+ * The test binary is /proc/self/exe of the sandboxed commands,
+ * it runs the sandbox helper as main() does
+ */
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == execSandboxArg {
+		runExecSandbox(os.Args[2:]) // does not return
+	}
+	if probe := os.Getenv(sandboxProbeEnv); probe != "" {
+		runSandboxProbe(probe) // does not return
+	}
+	if name := os.Getenv(activationProbeEnv); name != "" {
+		runActivationProbe(name) // does not return
+	}
+	os.Exit(m.Run())
+}
+
+/*
+ * Context of a running notifier for the inputs and outputs under test
+ */
+func testContext() *_context {
+	Context := &_context{
+		InputTimeout:  time.Second,
+		OutputTimeout: time.Second,
+		ExecTimeout:   time.Second,
+		Messages:      make(chan InputMessage, 100),
+		StopChan:      make(chan bool),
+	}
+	Context.Config.Workers = 10
+	return Context
+}
+
+/*
+ * Message with params decoded from JSON, as the inputs pass them
+ */
+func testMessage(t *testing.T, Context *_context, method string, params string) *MessageContext {
+	t.Helper()
+	msg_ctx := &MessageContext{
+		JsonRpc:        JsonRpcRequest{JSONRPC: "2.0", Method: method},
+		JSONPath_Cache: make(map[string]string),
+		Context:        Context,
+	}
+	if err := json.Unmarshal([]byte(params), &msg_ctx.JsonRpc.Params); err != nil {
+		t.Fatalf("invalid params %s : %s", params, err)
+	}
+	return msg_ctx
+}
+
+/*
+ * Next message of the inputs, fails after a second
+ */
+func nextMessage(t *testing.T, Context *_context) InputMessage {
+	t.Helper()
+	select {
+	case msg := <-Context.Messages:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message from the input")
+	}
+	return InputMessage{}
+}
+
+func decodeMessage(t *testing.T, msg InputMessage) JsonRpcRequest {
+	t.Helper()
+	var request JsonRpcRequest
+	if err := json.Unmarshal([]byte(msg.Body), &request); err != nil {
+		t.Fatalf("invalid JSON-RPC message %s : %s", msg.Body, err)
+	}
+	return request
+}
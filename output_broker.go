@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/nats-io/nats.go"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+type brokerMessage struct {
+	topic    string // MQTT/Kafka topic, NATS subject, Redis stream or channel, AMQP routing key
+	key      string // Kafka partitioning key
+	exchange string // AMQP exchange
+	payload  []byte
+}
+
+/*
+ * Client kept open per output and shared by its messages,
+ * publish returns after the broker has accepted the message
+ */
+type brokerClient interface {
+	publish(msg *brokerMessage, timeout time.Duration) error
+	close()
+}
+
+type brokerDialer func(out *_outBrokerConfig, timeout time.Duration) (brokerClient, error)
+
+func outputMqtt(msg_ctx *MessageContext, out *_outBrokerConfig) {
+	outputBroker(msg_ctx, out, "MQTT", dialMqtt)
+}
+
+func outputNats(msg_ctx *MessageContext, out *_outBrokerConfig) {
+	outputBroker(msg_ctx, out, "NATS", dialNats)
+}
+
+func outputRedis(msg_ctx *MessageContext, out *_outBrokerConfig) {
+	outputBroker(msg_ctx, out, "REDIS", dialRedis)
+}
+
+func outputAmqp(msg_ctx *MessageContext, out *_outBrokerConfig) {
+	outputBroker(msg_ctx, out, "AMQP", dialAmqp)
+}
+
+func outputKafka(msg_ctx *MessageContext, out *_outBrokerConfig) {
+	outputBroker(msg_ctx, out, "KAFKA", dialKafka)
+}
+
+/*
+ * Publishes the message, on failure reconnects and tries again up to "retries" times
+ */
+func outputBroker(msg_ctx *MessageContext, out *_outBrokerConfig, name string, dial brokerDialer) {
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	message := out.Message
+	if message == "" {
+		message = "{{$}}"
+	}
+	msg := &brokerMessage{
+		topic:    replaceJSONPathTags(msg_ctx, out.Topic, &out.tags.Topic),
+		key:      replaceJSONPathTags(msg_ctx, out.Key, &out.tags.Key),
+		exchange: replaceJSONPathTags(msg_ctx, out.Exchange, &out.tags.Exchange),
+		payload:  []byte(replaceJSONPathTags(msg_ctx, message, &out.tags.Message)),
+	}
+
+	timeout := time.Duration(out.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.OutputTimeout
+	}
+	retries := uint32(3)
+	if out.Retries != nil {
+		retries = *out.Retries
+	}
+
+	for attempt := uint32(0); ; attempt++ {
+		err := brokerPublish(out, dial, msg, timeout)
+		if err == nil {
+			return
+		}
+		if attempt >= retries {
+			log.Printf("OUTPUT-%s: failed to publish to %s topic %s : %s", name, out.Url, msg.topic, err)
+			return
+		}
+		wait := time.Duration(1<<attempt) * 500 * time.Millisecond
+		if wait > 30*time.Second {
+			wait = 30 * time.Second
+		}
+		log.Printf("OUTPUT-%s: failed to publish to %s, retry in %s : %s", name, out.Url, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+func brokerPublish(out *_outBrokerConfig, dial brokerDialer, msg *brokerMessage, timeout time.Duration) error {
+	out.client.Lock()
+	if out.client.closed { // config was reloaded, publish with its own connection
+		out.client.Unlock()
+		client, err := dial(out, timeout)
+		if err != nil {
+			return err
+		}
+		defer client.close()
+		return client.publish(msg, timeout)
+	}
+	client := out.client.c
+	if client == nil {
+		var err error
+		if client, err = dial(out, timeout); err != nil {
+			out.client.Unlock()
+			return err
+		}
+		out.client.c = client
+	}
+	out.client.Unlock()
+
+	err := client.publish(msg, timeout)
+	if err != nil {
+		// drop the connection, the next attempt reconnects
+		out.client.Lock()
+		if out.client.c == client {
+			out.client.c = nil
+			client.close()
+		}
+		out.client.Unlock()
+	}
+	return err
+}
+
+/*
+ * Closes the broker connections of the methods on config reload
+ */
+func closeBrokerOutputs(Context *_context) {
+	for _, method := range Context.Config.Methods {
+		for _, outs := range [][]_outBrokerConfig{
+			method.Mqtt, method.Nats, method.Redis, method.Amqp, method.Kafka} {
+
+			for i := range outs {
+				out := &outs[i]
+				out.client.Lock()
+				if out.client.c != nil {
+					out.client.c.close()
+					out.client.c = nil
+				}
+				out.client.closed = true
+				out.client.Unlock()
+			}
+		}
+	}
+}
+
+/*
+ * TLS config when tls, ca-file, cert-file or insecure-skip-verify is set, otherwise nil
+ */
+func brokerTlsConfig(out *_brokerConnConfig) (*tls.Config, error) {
+	if !out.Tls && out.CaFile == "" && out.CertFile == "" && !out.InsecureSkipVerify {
+		return nil, nil
+	}
+	return loadTlsConfig(out.CaFile, out.CertFile, out.KeyFile, out.InsecureSkipVerify)
+}
+
+// ========================================================
+// MQTT
+// ========================================================
+type mqttClient struct {
+	c      mqtt.Client
+	qos    byte
+	retain bool
+}
+
+func dialMqtt(out *_outBrokerConfig, timeout time.Duration) (brokerClient, error) {
+	if out.Qos > 2 {
+		return nil, fmt.Errorf("invalid qos %d", out.Qos)
+	}
+	tls_config, err := brokerTlsConfig(&out._brokerConnConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(out.Url).
+		SetClientID(mqttClientId(out.ClientId)).
+		SetUsername(out.User).
+		SetPassword(out.Password).
+		SetConnectTimeout(timeout).
+		SetAutoReconnect(false). // reconnected by the next publish
+		SetConnectRetry(false)
+	if tls_config != nil {
+		opts.SetTLSConfig(tls_config)
+	}
+
+	c := mqtt.NewClient(opts)
+	token := c.Connect()
+	if !token.WaitTimeout(timeout) {
+		c.Disconnect(0)
+		return nil, fmt.Errorf("connect timeout")
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return &mqttClient{c: c, qos: out.Qos, retain: out.Retain}, nil
+}
+
+func mqttClientId(client_id string) string {
+	if client_id == "" {
+		random := make([]byte, 4)
+		rand.Read(random)
+		client_id = "notifier-" + hex.EncodeToString(random)
+	}
+	return client_id
+}
+
+func (c *mqttClient) publish(msg *brokerMessage, timeout time.Duration) error {
+	if !c.c.IsConnectionOpen() {
+		return fmt.Errorf("connection lost")
+	}
+	token := c.c.Publish(msg.topic, c.qos, c.retain, msg.payload)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("publish timeout")
+	}
+	return token.Error()
+}
+
+func (c *mqttClient) close() {
+	c.c.Disconnect(250)
+}
+
+// ========================================================
+// NATS
+// ========================================================
+type natsClient struct {
+	c *nats.Conn
+}
+
+func dialNats(out *_outBrokerConfig, timeout time.Duration) (brokerClient, error) {
+	tls_config, err := brokerTlsConfig(&out._brokerConnConfig)
+	if err != nil {
+		return nil, err
+	}
+	opts := []nats.Option{
+		nats.Name("notifier"),
+		nats.Timeout(timeout),
+		nats.NoReconnect(), // reconnected by the next publish
+	}
+	if out.User != "" {
+		opts = append(opts, nats.UserInfo(out.User, out.Password))
+	}
+	if out.Token != "" {
+		opts = append(opts, nats.Token(out.Token))
+	}
+	if tls_config != nil {
+		opts = append(opts, nats.Secure(tls_config))
+	}
+
+	c, err := nats.Connect(out.Url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &natsClient{c: c}, nil
+}
+
+/*
+ * Core NATS has no acknowledgements, the flush round trip confirms the server got it
+ */
+func (c *natsClient) publish(msg *brokerMessage, timeout time.Duration) error {
+	if err := c.c.Publish(msg.topic, msg.payload); err != nil {
+		return err
+	}
+	return c.c.FlushTimeout(timeout)
+}
+
+func (c *natsClient) close() {
+	c.c.Close()
+}
+
+// ========================================================
+// Redis
+// ========================================================
+type redisClient struct {
+	c       *redis.Client
+	command string
+	maxLen  int64
+	field   string
+}
+
+func dialRedis(out *_outBrokerConfig, timeout time.Duration) (brokerClient, error) {
+	command := strings.ToLower(out.Command)
+	switch command {
+	case "":
+		command = "xadd"
+	case "xadd", "publish":
+	default:
+		return nil, fmt.Errorf("unsupported command %s, use xadd or publish", out.Command)
+	}
+
+	opts, err := redis.ParseURL(out.Url)
+	if err != nil {
+		return nil, err
+	}
+	if out.User != "" {
+		opts.Username = out.User
+	}
+	if out.Password != "" {
+		opts.Password = out.Password
+	}
+	tls_config, err := brokerTlsConfig(&out._brokerConnConfig)
+	if err != nil {
+		return nil, err
+	}
+	if tls_config != nil {
+		opts.TLSConfig = tls_config
+	}
+	opts.DialTimeout = timeout
+	opts.MaxRetries = -1 // retried by the output
+
+	c := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := c.Ping(ctx).Err(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	field := out.Field
+	if field == "" {
+		field = "message"
+	}
+	return &redisClient{c: c, command: command, maxLen: out.MaxLen, field: field}, nil
+}
+
+/*
+ * XADD <stream> [MAXLEN ~ <max-len>] * <field> <message> or PUBLISH <channel> <message>
+ */
+func (c *redisClient) publish(msg *brokerMessage, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if c.command == "publish" {
+		return c.c.Publish(ctx, msg.topic, msg.payload).Err()
+	}
+	return c.c.XAdd(ctx, &redis.XAddArgs{
+		Stream: msg.topic,
+		MaxLen: c.maxLen,
+		Approx: c.maxLen > 0,
+		Values: []interface{}{c.field, msg.payload},
+	}).Err()
+}
+
+func (c *redisClient) close() {
+	c.c.Close()
+}
+
+// ========================================================
+// AMQP 0.9.1
+// ========================================================
+type amqpClient struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+func dialAmqp(out *_outBrokerConfig, timeout time.Duration) (brokerClient, error) {
+	tls_config, err := brokerTlsConfig(&out._brokerConnConfig)
+	if err != nil {
+		return nil, err
+	}
+	config := amqp.Config{
+		Dial:            amqp.DefaultDial(timeout),
+		TLSClientConfig: tls_config,
+		Properties:      amqp.Table{"connection_name": "notifier"},
+	}
+	if out.User != "" {
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: out.User, Password: out.Password}}
+	}
+
+	conn, err := amqp.DialConfig(out.Url, config)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.Confirm(false) // publisher confirms
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &amqpClient{conn: conn, ch: ch}, nil
+}
+
+func (c *amqpClient) publish(msg *brokerMessage, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	confirm, err := c.ch.PublishWithDeferredConfirmWithContext(ctx, msg.exchange, msg.topic, false, false,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+			Body:         msg.payload,
+		})
+	if err != nil {
+		return err
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("message was not acknowledged by the broker")
+	}
+	return nil
+}
+
+func (c *amqpClient) close() {
+	c.conn.Close()
+}
+
+// ========================================================
+// Kafka
+// ========================================================
+type kafkaClient struct {
+	w *kafka.Writer
+}
+
+func dialKafka(out *_outBrokerConfig, timeout time.Duration) (brokerClient, error) {
+	tls_config, err := brokerTlsConfig(&out._brokerConnConfig)
+	if err != nil {
+		return nil, err
+	}
+	transport := &kafka.Transport{
+		ClientID:    "notifier",
+		DialTimeout: timeout,
+		TLS:         tls_config,
+	}
+	if out.User != "" {
+		transport.SASL = plain.Mechanism{Username: out.User, Password: out.Password}
+	}
+
+	brokers := kafkaBrokers(out.Url)
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("no brokers in url")
+	}
+
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{}, // same key, same partition
+		RequiredAcks: kafka.RequireAll,
+		MaxAttempts:  1, // retried by the output
+		BatchTimeout: 5 * time.Millisecond,
+		WriteTimeout: timeout,
+		ReadTimeout:  timeout,
+		Transport:    transport,
+	}
+	return &kafkaClient{w: w}, nil
+}
+
+/*
+ * url is a comma separated list of bootstrap brokers
+ */
+func kafkaBrokers(url string) []string {
+	var brokers []string
+	for _, broker := range strings.Split(strings.TrimPrefix(url, "kafka://"), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	return brokers
+}
+
+func (c *kafkaClient) publish(msg *brokerMessage, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	message := kafka.Message{Topic: msg.topic, Value: msg.payload}
+	if msg.key != "" {
+		message.Key = []byte(msg.key)
+	}
+	return c.w.WriteMessages(ctx, message)
+}
+
+func (c *kafkaClient) close() {
+	c.w.Close()
+}
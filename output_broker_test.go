@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * Stand-in for a broker connection, fails the first failures publishes
+ */
+type fakeBrokerClient struct {
+	broker *fakeBroker
+	closed bool
+}
+
+type fakeBroker struct {
+	sync.Mutex
+	failures  int
+	dials     int
+	published []brokerMessage
+	clients   []*fakeBrokerClient
+}
+
+func (broker *fakeBroker) dial(out *_outBrokerConfig, timeout time.Duration) (brokerClient, error) {
+	broker.Lock()
+	defer broker.Unlock()
+	broker.dials++
+	client := &fakeBrokerClient{broker: broker}
+	broker.clients = append(broker.clients, client)
+	return client, nil
+}
+
+func (client *fakeBrokerClient) publish(msg *brokerMessage, timeout time.Duration) error {
+	broker := client.broker
+	broker.Lock()
+	defer broker.Unlock()
+	if broker.failures > 0 {
+		broker.failures--
+		return errors.New("connection reset")
+	}
+	broker.published = append(broker.published, *msg)
+	return nil
+}
+
+func (client *fakeBrokerClient) close() {
+	client.broker.Lock()
+	client.closed = true
+	client.broker.Unlock()
+}
+
+func TestBrokerOutputPublish(t *testing.T) {
+	Context := testContext()
+	broker := &fakeBroker{}
+	out := &_outBrokerConfig{Topic: "alerts/{{$.host}}", Key: "{{$.host}}"}
+
+	outputBroker(testMessage(t, Context, "alert", `{"host":"web1","level":"error"}`), out, "TEST", broker.dial)
+	outputBroker(testMessage(t, Context, "alert", `{"host":"web2","level":"info"}`), out, "TEST", broker.dial)
+
+	if broker.dials != 1 {
+		t.Errorf("%d dials, want the connection reused", broker.dials)
+	}
+	if len(broker.published) != 2 {
+		t.Fatalf("%d messages published, want 2", len(broker.published))
+	}
+	msg := broker.published[0]
+	if msg.topic != "alerts/web1" || msg.key != "web1" {
+		t.Errorf("topic %q key %q, want alerts/web1 web1", msg.topic, msg.key)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(msg.payload, &payload); err != nil || payload["level"] != "error" {
+		t.Errorf("payload %s, want the params", msg.payload)
+	}
+}
+
+func TestBrokerOutputReconnect(t *testing.T) {
+	Context := testContext()
+	broker := &fakeBroker{failures: 1}
+	Context.Config.Methods = map[string]_methodConfig{
+		"alert": {Mqtt: []_outBrokerConfig{{Topic: "alerts", Message: "{{$.text}}"}}},
+	}
+	out := &Context.Config.Methods["alert"].Mqtt[0]
+
+	outputBroker(testMessage(t, Context, "alert", `{"text":"disk full"}`), out, "TEST", broker.dial)
+
+	if broker.dials != 2 {
+		t.Errorf("%d dials, want a reconnect after the failed publish", broker.dials)
+	}
+	if !broker.clients[0].closed {
+		t.Error("failed connection not closed")
+	}
+	if len(broker.published) != 1 || string(broker.published[0].payload) != "disk full" {
+		t.Errorf("published %v, want disk full", broker.published)
+	}
+
+	// after reload the shared connection is closed, each message publishes with its own
+	closeBrokerOutputs(Context)
+	if !broker.clients[1].closed {
+		t.Error("connection not closed on reload")
+	}
+	outputBroker(testMessage(t, Context, "alert", `{"text":"cpu"}`), out, "TEST", broker.dial)
+	if broker.dials != 3 || !broker.clients[2].closed {
+		t.Errorf("%d dials, want a closed connection per message after reload", broker.dials)
+	}
+}
+
+func TestBrokerOutputRetriesExhausted(t *testing.T) {
+	Context := testContext()
+	broker := &fakeBroker{failures: 5}
+	retries := uint32(0)
+	out := &_outBrokerConfig{Topic: "alerts", Retries: &retries}
+
+	outputBroker(testMessage(t, Context, "alert", `{}`), out, "TEST", broker.dial)
+	if broker.dials != 1 || len(broker.published) != 0 {
+		t.Errorf("%d dials %d published, want one failed attempt", broker.dials, len(broker.published))
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default colors by severity, can be changed with "colors" of each output
+var chatSeverityColors = map[string]string{
+	"critical": "#E01E5A",
+	"fatal":    "#E01E5A",
+	"error":    "#E01E5A",
+	"high":     "#E01E5A",
+	"warning":  "#ECB22E",
+	"warn":     "#ECB22E",
+	"medium":   "#ECB22E",
+	"info":     "#36C5F0",
+	"notice":   "#36C5F0",
+	"low":      "#36C5F0",
+	"ok":       "#2EB67D",
+	"resolved": "#2EB67D",
+	"success":  "#2EB67D",
+}
+
+// threads kept per output, the ones closest to expire are forgotten first
+const chatThreadsMax = 10000
+
+/*
+ * Id of the first message by thread-key, forgotten thread-ttl after the last message
+ */
+type chatThreads struct {
+	sync.Mutex
+	ids map[string]*chatThread
+}
+
+type chatThread struct {
+	id      string
+	expires time.Time
+}
+
+func (threads *chatThreads) load(key string, ttl time.Duration) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	threads.Lock()
+	defer threads.Unlock()
+	thread, ok := threads.ids[key]
+	if !ok || time.Now().After(thread.expires) {
+		return "", false
+	}
+	thread.expires = time.Now().Add(ttl)
+	return thread.id, true
+}
+
+/*
+ * Keeps the id of the first message, a later message with the same key is in its thread
+ */
+func (threads *chatThreads) store(key string, id string, ttl time.Duration) {
+	threads.Lock()
+	defer threads.Unlock()
+	now := time.Now()
+	if thread, ok := threads.ids[key]; ok && now.Before(thread.expires) {
+		return
+	}
+	if threads.ids == nil {
+		threads.ids = make(map[string]*chatThread)
+	}
+	if len(threads.ids) >= chatThreadsMax {
+		for k, thread := range threads.ids {
+			if now.After(thread.expires) {
+				delete(threads.ids, k)
+			}
+		}
+	}
+	for len(threads.ids) >= chatThreadsMax {
+		oldest := ""
+		for k, thread := range threads.ids {
+			if oldest == "" || thread.expires.Before(threads.ids[oldest].expires) {
+				oldest = k
+			}
+		}
+		delete(threads.ids, oldest)
+	}
+	threads.ids[key] = &chatThread{id: id, expires: now.Add(ttl)}
+}
+
+func chatThreadTtl(out *_outChatConfig) time.Duration {
+	if out.ThreadTtl == 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(out.ThreadTtl) * time.Millisecond
+}
+
+type chatField struct {
+	title string
+	value string
+	short bool
+}
+
+type chatMessage struct {
+	url       string
+	token     string
+	channel   string
+	username  string
+	icon      string
+	title     string
+	text      string
+	severity  string
+	color     string // #RRGGBB
+	threadKey string
+	mentions  string
+	fields    []chatField
+}
+
+/*
+ * Resolves all templated fields of chat output
+ */
+func resolveChatMessage(msg_ctx *MessageContext, out *_outChatConfig) *chatMessage {
+	if out.tags.Mentions == nil { // initialize tags cache for lists
+		out.tags.Mentions = make([]*[]string, len(out.Mentions))
+		out.tags.FieldsTitles = make([]*[]string, len(out.Fields))
+		out.tags.FieldsValues = make([]*[]string, len(out.Fields))
+	}
+
+	msg := &chatMessage{
+		url:       replaceJSONPathTags(msg_ctx, out.Url, &out.tags.Url),
+		token:     replaceJSONPathTags(msg_ctx, out.Token, &out.tags.Token),
+		channel:   replaceJSONPathTags(msg_ctx, out.Channel, &out.tags.Channel),
+		username:  replaceJSONPathTags(msg_ctx, out.Username, &out.tags.Username),
+		icon:      replaceJSONPathTags(msg_ctx, out.Icon, &out.tags.Icon),
+		title:     replaceJSONPathTags(msg_ctx, out.Title, &out.tags.Title),
+		text:      replaceJSONPathTags(msg_ctx, out.Text, &out.tags.Text),
+		severity:  replaceJSONPathTags(msg_ctx, out.Severity, &out.tags.Severity),
+		threadKey: replaceJSONPathTags(msg_ctx, out.ThreadKey, &out.tags.ThreadKey),
+	}
+
+	mentions := make([]string, 0, len(out.Mentions))
+	for ii := range out.Mentions {
+		mention := replaceJSONPathTags(msg_ctx, out.Mentions[ii], &out.tags.Mentions[ii])
+		if mention != "" {
+			mentions = append(mentions, mention)
+		}
+	}
+	msg.mentions = strings.Join(mentions, " ")
+
+	for ii := range out.Fields {
+		msg.fields = append(msg.fields, chatField{
+			title: replaceJSONPathTags(msg_ctx, out.Fields[ii].Title, &out.tags.FieldsTitles[ii]),
+			value: replaceJSONPathTags(msg_ctx, out.Fields[ii].Value, &out.tags.FieldsValues[ii]),
+			short: out.Fields[ii].Short,
+		})
+	}
+
+	severity := strings.ToLower(msg.severity)
+	if color, ok := out.Colors[severity]; ok {
+		msg.color = color
+	} else if color, ok := chatSeverityColors[severity]; ok {
+		msg.color = color
+	}
+	return msg
+}
+
+func chatTimeout(msg_ctx *MessageContext, out *_outChatConfig) time.Duration {
+	timeout := time.Duration(out.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.OutputTimeout
+	}
+	return timeout
+}
+
+func chatRetries(out *_outChatConfig) uint32 {
+	if out.Retries == nil {
+		return 3
+	}
+	return *out.Retries
+}
+
+/*
+ * Slack incoming webhook, or chat.postMessage if token is set.
+ * Threads need the token: the "ts" of the first message is kept per thread-key.
+ */
+func outputSlack(msg_ctx *MessageContext, out *_outChatConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	msg := resolveChatMessage(msg_ctx, out)
+
+	blocks := []interface{}{}
+	if msg.title != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "header",
+			"text": map[string]interface{}{"type": "plain_text", "text": msg.title},
+		})
+	}
+	if text := strings.TrimSpace(msg.mentions + " " + msg.text); text != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "section",
+			"text": map[string]interface{}{"type": "mrkdwn", "text": text},
+		})
+	}
+	fields := []interface{}{}
+	for _, field := range msg.fields {
+		fields = append(fields, map[string]interface{}{
+			"type": "mrkdwn",
+			"text": "*" + field.title + "*\n" + field.value,
+		})
+		if len(fields) == 10 { // Slack limit per section
+			blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields})
+			fields = []interface{}{}
+		}
+	}
+	if len(fields) > 0 {
+		blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields})
+	}
+
+	payload := map[string]interface{}{
+		"text": chatFallback(msg),
+		"attachments": []interface{}{
+			map[string]interface{}{"color": msg.color, "blocks": blocks},
+		},
+	}
+	if msg.channel != "" {
+		payload["channel"] = msg.channel
+	}
+	if msg.username != "" {
+		payload["username"] = msg.username
+	}
+	if strings.HasPrefix(msg.icon, ":") {
+		payload["icon_emoji"] = msg.icon
+	} else if msg.icon != "" {
+		payload["icon_url"] = msg.icon
+	}
+
+	url := msg.url
+	headers := map[string]string{}
+	if msg.token != "" {
+		if url == "" {
+			url = "https://slack.com/api/chat.postMessage"
+		}
+		headers["Authorization"] = "Bearer " + msg.token
+		if ts, ok := out.threads.load(msg.threadKey, chatThreadTtl(out)); ok {
+			payload["thread_ts"] = ts
+		}
+	}
+
+	_, body, err := postJSON(url, headers, payload, chatTimeout(msg_ctx, out), chatRetries(out))
+	if err != nil {
+		log.Printf("OUTPUT-SLACK: failed to send message to %s : %s", urlHost(url), urlError(err))
+		return
+	}
+	if msg.token == "" {
+		return // webhook replies with plain "ok"
+	}
+
+	var resp struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error"`
+		Ts    string `json:"ts"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || !resp.Ok {
+		log.Printf("OUTPUT-SLACK: failed to send message to %s : %s %s", urlHost(url), resp.Error, err)
+		return
+	}
+	if msg.threadKey != "" {
+		out.threads.store(msg.threadKey, resp.Ts, chatThreadTtl(out))
+	}
+}
+
+/*
+ * Mattermost incoming webhook, or REST API v4 if token is set.
+ * With the API the channel is channel id, threads use the "id" of the first post.
+ */
+func outputMattermost(msg_ctx *MessageContext, out *_outChatConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	msg := resolveChatMessage(msg_ctx, out)
+
+	fields := []interface{}{}
+	for _, field := range msg.fields {
+		fields = append(fields, map[string]interface{}{
+			"title": field.title,
+			"value": field.value,
+			"short": field.short,
+		})
+	}
+	attachments := []interface{}{
+		map[string]interface{}{
+			"fallback": chatFallback(msg),
+			"color":    msg.color,
+			"title":    msg.title,
+			"text":     msg.text,
+			"fields":   fields,
+		},
+	}
+
+	// mentions notify only in the message text, not in attachments
+	url := msg.url
+	headers := map[string]string{}
+	var payload map[string]interface{}
+	if msg.token != "" {
+		url = strings.TrimSuffix(url, "/") + "/api/v4/posts"
+		headers["Authorization"] = "Bearer " + msg.token
+		payload = map[string]interface{}{
+			"channel_id": msg.channel,
+			"message":    msg.mentions,
+			"props":      map[string]interface{}{"attachments": attachments},
+		}
+		if root_id, ok := out.threads.load(msg.threadKey, chatThreadTtl(out)); ok {
+			payload["root_id"] = root_id
+		}
+	} else {
+		payload = map[string]interface{}{
+			"text":        msg.mentions,
+			"attachments": attachments,
+		}
+		if msg.channel != "" {
+			payload["channel"] = msg.channel
+		}
+		if msg.username != "" {
+			payload["username"] = msg.username
+		}
+		if msg.icon != "" {
+			payload["icon_url"] = msg.icon
+		}
+	}
+
+	_, body, err := postJSON(url, headers, payload, chatTimeout(msg_ctx, out), chatRetries(out))
+	if err != nil {
+		log.Printf("OUTPUT-MATTERMOST: failed to send message to %s : %s", urlHost(url), urlError(err))
+		return
+	}
+	if msg.token == "" || msg.threadKey == "" {
+		return
+	}
+
+	var resp struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Id != "" {
+		out.threads.store(msg.threadKey, resp.Id, chatThreadTtl(out))
+	}
+}
+
+/*
+ * Microsoft Teams workflow webhook with Adaptive Card
+ */
+func outputTeams(msg_ctx *MessageContext, out *_outChatConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	msg := resolveChatMessage(msg_ctx, out)
+
+	body := []interface{}{}
+	if msg.title != "" {
+		body = append(body, map[string]interface{}{
+			"type":   "TextBlock",
+			"text":   msg.title,
+			"weight": "Bolder",
+			"size":   "Medium",
+			"color":  teamsColor(msg.color),
+			"wrap":   true,
+		})
+	}
+	if text := strings.TrimSpace(msg.mentions + " " + msg.text); text != "" {
+		body = append(body, map[string]interface{}{
+			"type": "TextBlock",
+			"text": text,
+			"wrap": true,
+		})
+	}
+	if len(msg.fields) > 0 {
+		facts := []interface{}{}
+		for _, field := range msg.fields {
+			facts = append(facts, map[string]interface{}{"title": field.title, "value": field.value})
+		}
+		body = append(body, map[string]interface{}{"type": "FactSet", "facts": facts})
+	}
+
+	payload := map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]interface{}{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body":    body,
+				},
+			},
+		},
+	}
+
+	_, _, err := postJSON(msg.url, nil, payload, chatTimeout(msg_ctx, out), chatRetries(out))
+	if err != nil {
+		log.Printf("OUTPUT-TEAMS: failed to send message to %s : %s", urlHost(msg.url), urlError(err))
+	}
+}
+
+/*
+ * Adaptive Cards have only named colors
+ */
+func teamsColor(color string) string {
+	switch strings.ToUpper(color) {
+	case "":
+		return "Default"
+	case "#E01E5A":
+		return "Attention"
+	case "#ECB22E":
+		return "Warning"
+	case "#2EB67D":
+		return "Good"
+	}
+	return "Accent"
+}
+
+/*
+ * Discord webhook with embed. For forum channels the thread-key
+ * creates a post and the next messages with the same key go to it.
+ */
+func outputDiscord(msg_ctx *MessageContext, out *_outChatConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	msg := resolveChatMessage(msg_ctx, out)
+
+	fields := []interface{}{}
+	for _, field := range msg.fields {
+		fields = append(fields, map[string]interface{}{
+			"name":   field.title,
+			"value":  field.value,
+			"inline": field.short,
+		})
+	}
+	embed := map[string]interface{}{
+		"title":       msg.title,
+		"description": msg.text,
+		"fields":      fields,
+	}
+	if color, err := strconv.ParseInt(strings.TrimPrefix(msg.color, "#"), 16, 32); err == nil {
+		embed["color"] = color
+	}
+
+	payload := map[string]interface{}{
+		"content": msg.mentions,
+		"embeds":  []interface{}{embed},
+	}
+	if msg.username != "" {
+		payload["username"] = msg.username
+	}
+	if msg.icon != "" {
+		payload["avatar_url"] = msg.icon
+	}
+
+	// wait=true returns the created message with the thread id
+	webhook, err := url.Parse(msg.url)
+	if err != nil {
+		log.Printf("OUTPUT-DISCORD: invalid webhook url : %s", urlError(err))
+		return
+	}
+	query := webhook.Query()
+	query.Set("wait", "true")
+	if msg.threadKey != "" {
+		if thread_id, ok := out.threads.load(msg.threadKey, chatThreadTtl(out)); ok {
+			query.Set("thread_id", thread_id)
+		} else {
+			payload["thread_name"] = msg.threadKey
+		}
+	}
+	webhook.RawQuery = query.Encode()
+
+	_, body, err := postJSON(webhook.String(), nil, payload, chatTimeout(msg_ctx, out), chatRetries(out))
+	if err != nil {
+		log.Printf("OUTPUT-DISCORD: failed to send message to %s : %s", urlHost(msg.url), urlError(err))
+		return
+	}
+	if msg.threadKey == "" {
+		return
+	}
+
+	var resp struct {
+		ChannelId string `json:"channel_id"`
+	}
+	if err := json.Unmarshal(body, &resp); err == nil && resp.ChannelId != "" {
+		out.threads.store(msg.threadKey, resp.ChannelId, chatThreadTtl(out))
+	}
+}
+
+func chatFallback(msg *chatMessage) string {
+	if msg.title != "" && msg.text != "" {
+		return msg.title + ": " + msg.text
+	}
+	return msg.title + msg.text
+}
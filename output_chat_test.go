@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+type chatRequest struct {
+	path    string
+	query   url.Values
+	headers http.Header
+	body    map[string]interface{}
+}
+
+/*
+ * Stand-in for the chat services, answers with the status and body of respond
+ */
+func newChatServer(t *testing.T, respond func(n int, req *chatRequest) (int, string)) (*httptest.Server, func() []chatRequest) {
+	var lock sync.Mutex
+	var requests []chatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := chatRequest{path: r.URL.Path, query: r.URL.Query(), headers: r.Header}
+		if err := json.NewDecoder(r.Body).Decode(&req.body); err != nil {
+			t.Errorf("invalid JSON to %s : %s", r.URL.Path, err)
+		}
+		lock.Lock()
+		requests = append(requests, req)
+		n := len(requests)
+		lock.Unlock()
+		status, body := respond(n, &req)
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []chatRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+}
+
+func chatOk(int, *chatRequest) (int, string) {
+	return http.StatusOK, "ok"
+}
+
+/*
+ * Value at the path of maps and arrays in the decoded JSON, like "attachments.0.color"
+ */
+func jsonAt(value interface{}, path ...interface{}) interface{} {
+	for _, key := range path {
+		switch key := key.(type) {
+		case string:
+			m, _ := value.(map[string]interface{})
+			value = m[key]
+		case int:
+			a, _ := value.([]interface{})
+			if key >= len(a) {
+				return nil
+			}
+			value = a[key]
+		}
+	}
+	return value
+}
+
+const chatTestParams = `{"host":"web1","level":"Critical","text":"disk \"/var\" full\nat 97%","user":"@ops","oncall":""}`
+
+func chatTestConfig(url string) *_outChatConfig {
+	return &_outChatConfig{
+		Url:      url,
+		Title:    "{{$.host}} alert",
+		Text:     "{{$.text}}",
+		Severity: "{{$.level}}",
+		Mentions: []string{"{{$.user}}", "{{$.oncall}}"},
+		Fields:   []_chatFieldConfig{{Title: "Host", Value: "{{$.host}}", Short: true}},
+	}
+}
+
+func TestSlackWebhook(t *testing.T) {
+	server, requests := newChatServer(t, chatOk)
+	out := chatTestConfig(server.URL + "/services/T/B/X")
+	out.Channel = "#alerts"
+	out.Icon = ":fire:"
+	outputSlack(testMessage(t, testContext(), "alert", chatTestParams), out)
+
+	sent := requests()
+	if len(sent) != 1 || sent[0].path != "/services/T/B/X" {
+		t.Fatalf("requests %v, want one to the webhook", sent)
+	}
+	body := sent[0].body
+	if body["text"] != "web1 alert: disk \"/var\" full\nat 97%" || body["channel"] != "#alerts" || body["icon_emoji"] != ":fire:" {
+		t.Errorf("payload %v", body)
+	}
+	attachment := jsonAt(body, "attachments", 0)
+	if jsonAt(attachment, "color") != "#E01E5A" {
+		t.Errorf("color %v, want the critical one", jsonAt(attachment, "color"))
+	}
+	if got := jsonAt(attachment, "blocks", 0, "text", "text"); got != "web1 alert" {
+		t.Errorf("header %v", got)
+	}
+	if got := jsonAt(attachment, "blocks", 1, "text", "text"); got != "@ops disk \"/var\" full\nat 97%" {
+		t.Errorf("section %q, want the mentions and the text", got)
+	}
+	if got := jsonAt(attachment, "blocks", 2, "fields", 0, "text"); got != "*Host*\nweb1" {
+		t.Errorf("field %q", got)
+	}
+}
+
+func TestSlackThreads(t *testing.T) {
+	server, requests := newChatServer(t, func(n int, req *chatRequest) (int, string) {
+		if n == 1 {
+			return http.StatusOK, `{"ok":true,"ts":"1700000000.000100"}`
+		}
+		return http.StatusOK, `{"ok":true,"ts":"1700000001.000200"}`
+	})
+	out := chatTestConfig(server.URL + "/api/chat.postMessage")
+	out.Token = "xoxb-1"
+	out.ThreadKey = "{{$.host}}"
+	Context := testContext()
+
+	outputSlack(testMessage(t, Context, "alert", chatTestParams), out)
+	outputSlack(testMessage(t, Context, "alert", chatTestParams), out)
+	outputSlack(testMessage(t, Context, "alert", `{"host":"web2"}`), out)
+
+	sent := requests()
+	if len(sent) != 3 || sent[0].headers.Get("Authorization") != "Bearer xoxb-1" {
+		t.Fatalf("requests %v, want 3 with the token", sent)
+	}
+	for ii, want := range []interface{}{nil, "1700000000.000100", nil} {
+		if got := sent[ii].body["thread_ts"]; got != want {
+			t.Errorf("message %d thread_ts %v, want %v", ii, got, want)
+		}
+	}
+}
+
+func TestMattermostApi(t *testing.T) {
+	server, requests := newChatServer(t, func(n int, req *chatRequest) (int, string) {
+		return http.StatusCreated, `{"id":"post1"}`
+	})
+	out := chatTestConfig(server.URL + "/")
+	out.Token = "mm-token"
+	out.Channel = "channel-id"
+	out.ThreadKey = "{{$.host}}"
+	Context := testContext()
+
+	outputMattermost(testMessage(t, Context, "alert", chatTestParams), out)
+	outputMattermost(testMessage(t, Context, "alert", chatTestParams), out)
+
+	sent := requests()
+	if len(sent) != 2 || sent[0].path != "/api/v4/posts" || sent[0].headers.Get("Authorization") != "Bearer mm-token" {
+		t.Fatalf("requests %v, want 2 posts to the API", sent)
+	}
+	body := sent[0].body
+	if body["channel_id"] != "channel-id" || body["message"] != "@ops" || body["root_id"] != nil {
+		t.Errorf("first post %v", body)
+	}
+	if got := jsonAt(body, "props", "attachments", 0, "fields", 0, "short"); got != true {
+		t.Errorf("short field %v", got)
+	}
+	if sent[1].body["root_id"] != "post1" {
+		t.Errorf("second post root_id %v, want the first post", sent[1].body["root_id"])
+	}
+}
+
+func TestTeams(t *testing.T) {
+	server, requests := newChatServer(t, chatOk)
+	out := chatTestConfig(server.URL)
+	out.Colors = map[string]string{"critical": "#123456"}
+	outputTeams(testMessage(t, testContext(), "alert", chatTestParams), out)
+
+	card := jsonAt(chatOne(t, requests()).body, "attachments", 0)
+	if jsonAt(card, "contentType") != "application/vnd.microsoft.card.adaptive" ||
+		jsonAt(card, "content", "type") != "AdaptiveCard" {
+		t.Fatalf("attachment %v, want an adaptive card", card)
+	}
+	body := jsonAt(card, "content", "body")
+	if jsonAt(body, 0, "text") != "web1 alert" || jsonAt(body, 0, "color") != "Accent" {
+		t.Errorf("title %v, want the accent color of a custom one", jsonAt(body, 0))
+	}
+	if jsonAt(body, 2, "facts", 0, "value") != "web1" {
+		t.Errorf("facts %v", jsonAt(body, 2))
+	}
+	for color, want := range map[string]string{"#e01e5a": "Attention", "#ECB22E": "Warning", "": "Default"} {
+		if got := teamsColor(color); got != want {
+			t.Errorf("teams color of %q %s, want %s", color, got, want)
+		}
+	}
+}
+
+func chatOne(t *testing.T, requests []chatRequest) chatRequest {
+	t.Helper()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	return requests[0]
+}
+
+func TestDiscordThreads(t *testing.T) {
+	server, requests := newChatServer(t, func(n int, req *chatRequest) (int, string) {
+		if n == 1 {
+			// rate limited, the retry is after retry_after
+			return http.StatusTooManyRequests, `{"retry_after":0.01}`
+		}
+		return http.StatusOK, `{"id":"m1","channel_id":"thread1"}`
+	})
+	out := chatTestConfig(server.URL + "/api/webhooks/1/abc")
+	out.ThreadKey = "{{$.host}} alerts"
+	Context := testContext()
+
+	outputDiscord(testMessage(t, Context, "alert", chatTestParams), out)
+	outputDiscord(testMessage(t, Context, "alert", chatTestParams), out)
+
+	sent := requests()
+	if len(sent) != 3 {
+		t.Fatalf("%d requests, want the retry and 2 messages", len(sent))
+	}
+	first, second := sent[1], sent[2]
+	if first.query.Get("wait") != "true" || first.body["thread_name"] != "web1 alerts" || first.query.Get("thread_id") != "" {
+		t.Errorf("first message %v %v, want a new forum post", first.query, first.body)
+	}
+	if second.query.Get("thread_id") != "thread1" || second.body["thread_name"] != nil {
+		t.Errorf("second message %v %v, want the post of the first", second.query, second.body)
+	}
+	embed := jsonAt(first.body, "embeds", 0)
+	if jsonAt(embed, "color") != float64(0xE01E5A) || jsonAt(embed, "fields", 0, "inline") != true ||
+		jsonAt(embed, "description") != "disk \"/var\" full\nat 97%" {
+		t.Errorf("embed %v", embed)
+	}
+}
+
+func TestChatThreadsExpire(t *testing.T) {
+	var threads chatThreads
+	threads.store("a", "1", -1)
+	if _, ok := threads.load("a", 0); ok {
+		t.Error("expired thread loaded")
+	}
+	threads.store("a", "2", 60000000000)
+	threads.store("a", "3", 60000000000)
+	if id, ok := threads.load("a", 60000000000); !ok || id != "2" {
+		t.Errorf("thread %s %v, want the first message", id, ok)
+	}
+	if _, ok := threads.load("", 0); ok {
+		t.Error("thread without a key")
+	}
+}
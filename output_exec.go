@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stdout and stderr kept for the logs
+const execOutputLimit = 64 * 1024
+
+/*
+ * Keeps the first execOutputLimit bytes, the rest is discarded
+ */
+type limitedBuffer struct {
+	buf       bytes.Buffer // not embedded, its ReadFrom would skip the limit
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := execOutputLimit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "..."
+	}
+	return b.buf.String()
+}
+
+/*
+ * Single quoted for /bin/sh, so the value is one word without expansions
+ */
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func execCommand(msg_ctx *MessageContext, exec_conf *_execCommandConfig) {
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	runCommand(msg_ctx, exec_conf)
+}
+
+/*
+ * Runs the command and logs a failure. The result is returned for steps:
+ * stdout (JSON decoded if it is JSON), stderr and exit_code; false on failure.
+ */
+func runCommand(msg_ctx *MessageContext, exec_conf *_execCommandConfig) (map[string]interface{}, bool) {
+
+	if exec_conf.tags.Args == nil { // initialize tags cache for Args and Env
+		exec_conf.tags.Args = make([]*[]string, len(exec_conf.Args))
+		exec_conf.tags.Env = make([]*[]string, len(exec_conf.Env))
+	}
+
+	var cmd string
+	if exec_conf.Shell {
+		cmd = replaceJSONPathTagsEscaped(msg_ctx, exec_conf.Cmd, &exec_conf.tags.Cmd, shellQuote)
+	} else {
+		cmd = replaceJSONPathTags(msg_ctx, exec_conf.Cmd, &exec_conf.tags.Cmd)
+	}
+	args := make([]string, len(exec_conf.Args))
+	for i := range len(exec_conf.Args) {
+		args[i] = replaceJSONPathTags(msg_ctx, exec_conf.Args[i], &exec_conf.tags.Args[i])
+	}
+	name := cmd // the script with shell
+	if exec_conf.Shell {
+		// the script is not a file, $0 is sh and the args are $1...
+		args = append([]string{"-c", cmd, "sh"}, args...)
+		cmd = "/bin/sh"
+	}
+
+	timeout := time.Duration(exec_conf.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.ExecTimeout
+	}
+	if exec_conf.MaxConcurrent > 0 {
+		exec_conf.slotsOnce.Do(func() {
+			exec_conf.slots = make(chan bool, exec_conf.MaxConcurrent)
+		})
+		select {
+		case exec_conf.slots <- true:
+			defer func() { <-exec_conf.slots }()
+		case <-time.After(timeout):
+			log.Printf("EXEC: command \"%s\" is not started, %d are running for %s",
+				name, exec_conf.MaxConcurrent, timeout)
+			return nil, false
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	run := exec.CommandContext(ctx, cmd, args...)
+	run.Dir = replaceJSONPathTags(msg_ctx, exec_conf.Dir, &exec_conf.tags.Dir)
+	if exec_conf.Stdin != "" {
+		run.Stdin = strings.NewReader(replaceJSONPathTags(msg_ctx, exec_conf.Stdin, &exec_conf.tags.Stdin))
+	}
+	if len(exec_conf.Env) > 0 {
+		run.Env = os.Environ()
+		for i := range exec_conf.Env {
+			entry := replaceJSONPathTags(msg_ctx, exec_conf.Env[i], &exec_conf.tags.Env[i])
+			if env_name, _, ok := strings.Cut(entry, "="); !ok || env_name == "" {
+				log.Printf("EXEC: invalid env entry \"%s\" of command \"%s\", NAME=value expected",
+					exec_conf.Env[i], name)
+				continue
+			}
+			run.Env = append(run.Env, entry)
+		}
+	}
+	run.SysProcAttr = &syscall.SysProcAttr{}
+	if exec_conf.User != "" || exec_conf.Group != "" {
+		credential, err := execCredential(exec_conf.User, exec_conf.Group)
+		if err != nil {
+			log.Printf("EXEC: cannot run command \"%s\" as %s:%s : %s",
+				name, exec_conf.User, exec_conf.Group, err)
+			return nil, false
+		}
+		run.SysProcAttr.Credential = credential
+	}
+	sandbox, err := setupExecSandbox(run.SysProcAttr, exec_conf)
+	if err != nil {
+		log.Printf("EXEC: cannot isolate command \"%s\" : %s", name, err)
+		return nil, false
+	}
+	if sandbox != nil {
+		// notifier applies the sandbox in the new process, then it execs the command
+		sandbox_json, _ := json.Marshal(sandbox)
+		if run.Env == nil {
+			run.Env = os.Environ()
+		}
+		run.Env = append(run.Env, execSandboxEnv+"="+string(sandbox_json))
+		run.Args = append([]string{run.Args[0], execSandboxArg, run.Path}, run.Args...)
+		run.Path = "/proc/self/exe"
+	}
+
+	// the whole process group is killed on timeout, not only the command
+	run.Cancel = func() error {
+		return syscall.Kill(-run.Process.Pid, syscall.SIGKILL)
+	}
+	// stdout and stderr may be kept open by the processes left in the background
+	run.WaitDelay = time.Second
+
+	var stdout, stderr limitedBuffer
+	run.Stdout = &stdout
+	run.Stderr = &stderr
+
+	err = run.Run()
+	var exit_err *exec.ExitError
+	if errors.As(err, &exit_err) && ctx.Err() == nil &&
+		slices.Contains(exec_conf.SuccessCodes, exit_err.ExitCode()) {
+		err = nil
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timeout after %s", timeout)
+		}
+		log.Printf("EXEC: Failed to execute command \"%s\" : %s : stdout: %s : stderr: %s\n",
+			name, err, stdout.String(), stderr.String())
+	} else if exec_conf.LogOutput {
+		log.Printf("EXEC: command \"%s\" exited with %d : stdout: %s : stderr: %s\n",
+			name, run.ProcessState.ExitCode(), stdout.String(), stderr.String())
+	}
+
+	exit_code := -1
+	if run.ProcessState != nil {
+		exit_code = run.ProcessState.ExitCode()
+	}
+	return map[string]interface{}{
+		"stdout":    jsonOrString(stdout.Bytes()),
+		"stderr":    stderr.String(),
+		"exit_code": exit_code,
+	}, err == nil
+}
+
+/*
+ * Uid and gid of the user and group names or ids, without supplementary groups.
+ * Without group it is the primary group of the user.
+ */
+func execCredential(owner, group string) (*syscall.Credential, error) {
+	uid, gid, err := lookupOwner(owner, group)
+	if err != nil {
+		return nil, err
+	}
+	if uid == -1 {
+		uid = os.Getuid()
+	}
+	if gid == -1 {
+		gid = os.Getgid()
+		if owner != "" {
+			u, err := user.LookupId(strconv.Itoa(uid))
+			if err != nil {
+				return nil, fmt.Errorf("no primary group of user %s : %w", owner, err)
+			}
+			gid, _ = strconv.Atoi(u.Gid)
+		}
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+}
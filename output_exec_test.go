@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExecInput(t *testing.T) {
+	dir := t.TempDir()
+	exec_conf := &_execCommandConfig{
+		Cmd:   `printf '%s|%s|%s|' "$1" "$ALERT_HOST" "$(pwd)"; cat`,
+		Shell: true,
+		Args:  []string{"{{$.host}}"},
+		Stdin: "{{$}}",
+		Env:   []string{"ALERT_HOST={{$.host}}", "=nameless", "novalue"},
+		Dir:   "{{$.dir}}",
+	}
+	msg := testMessage(t, testContext(), "alert", fmt.Sprintf(`{"host":"web1","dir":%q}`, dir))
+	result, ok := runCommand(msg, exec_conf)
+	if !ok {
+		t.Fatalf("result %v", result)
+	}
+	// the invalid env entries are skipped
+	want := fmt.Sprintf(`web1|web1|%s|{"dir":%q,"host":"web1"}`, dir, dir)
+	if stdout := strings.TrimSpace(fmt.Sprint(result["stdout"])); stdout != want {
+		t.Errorf("stdout %s, want %s", stdout, want)
+	}
+}
+
+/*
+ * Params are one word of the script, without expansions
+ */
+func TestExecShellQuote(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker")
+	exec_conf := &_execCommandConfig{Cmd: "echo {{$.text}}", Shell: true}
+	text := fmt.Sprintf(`it's $HOME; touch %s`, marker)
+	result, ok := runCommand(testMessage(t, testContext(), "alert", fmt.Sprintf(`{"text":%q}`, text)), exec_conf)
+	if !ok || result["stdout"] != text+"\n" {
+		t.Errorf("stdout %q, want the text unchanged", result["stdout"])
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the param ran as a command")
+	}
+}
+
+func TestExecResult(t *testing.T) {
+	Context := testContext()
+	msg := testMessage(t, Context, "alert", `{}`)
+
+	// JSON output is decoded for steps
+	result, ok := runCommand(msg, &_execCommandConfig{Cmd: `echo '{"id":42}'; echo warn >&2`, Shell: true})
+	if body, _ := result["stdout"].(map[string]interface{}); !ok || body["id"] != float64(42) ||
+		result["stderr"] != "warn\n" || result["exit_code"] != 0 {
+		t.Errorf("result %v", result)
+	}
+
+	result, ok = runCommand(msg, &_execCommandConfig{Cmd: "exit 3", Shell: true})
+	if ok || result["exit_code"] != 3 {
+		t.Errorf("result %v %v, want the failed exit code", result, ok)
+	}
+	result, ok = runCommand(msg, &_execCommandConfig{Cmd: "exit 3", Shell: true, SuccessCodes: []int{1, 3}})
+	if !ok || result["exit_code"] != 3 {
+		t.Errorf("result %v %v, want success-codes to accept 3", result, ok)
+	}
+
+	result, ok = runCommand(msg, &_execCommandConfig{Cmd: "/nonexistent/command"})
+	if ok || result["exit_code"] != -1 {
+		t.Errorf("result %v %v, want not started", result, ok)
+	}
+
+	// the output kept is limited
+	result, _ = runCommand(msg, &_execCommandConfig{Cmd: "head -c 100000 /dev/zero | tr '\\0' x", Shell: true})
+	if stdout := fmt.Sprint(result["stdout"]); len(stdout) != execOutputLimit {
+		t.Errorf("stdout of %d bytes, want %d", len(stdout), execOutputLimit)
+	}
+}
+
+/*
+ * On timeout the processes left in the background are killed too
+ */
+func TestExecTimeout(t *testing.T) {
+	pid_file := filepath.Join(t.TempDir(), "pid")
+	exec_conf := &_execCommandConfig{Cmd: "sleep 30 & echo $! > " + pid_file + "; wait", Shell: true, Timeout: 200}
+	start := time.Now()
+	result, ok := runCommand(testMessage(t, testContext(), "alert", `{}`), exec_conf)
+	if ok || time.Since(start) > 5*time.Second {
+		t.Fatalf("result %v %v after %s, want the timeout", result, ok, time.Since(start))
+	}
+	data, err := os.ReadFile(pid_file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := strings.TrimSpace(string(data))
+	deadline := time.Now().Add(time.Second)
+	for {
+		// a killed child not reaped by sh is a zombie
+		stat, err := os.ReadFile("/proc/" + pid + "/stat")
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background sleep %s is still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExecMaxConcurrent(t *testing.T) {
+	Context := testContext()
+	exec_conf := &_execCommandConfig{Cmd: "sleep 0.3", Shell: true, MaxConcurrent: 1, Timeout: 100}
+	// the tag lists are parsed by the first run
+	runCommand(testMessage(t, Context, "alert", `{}`), exec_conf)
+
+	var wg sync.WaitGroup
+	results := make([]bool, 2)
+	for ii := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, results[ii] = runCommand(testMessage(t, Context, "alert", `{}`), exec_conf)
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+	// the first one times out, the second one waits for the slot and does not finish in time
+	if results[0] || results[1] {
+		t.Errorf("results %v", results)
+	}
+
+	exec_conf = &_execCommandConfig{Cmd: "sleep 0.05", Shell: true, MaxConcurrent: 1, Timeout: 1000}
+	runCommand(testMessage(t, Context, "alert", `{}`), exec_conf)
+	for ii := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, results[ii] = runCommand(testMessage(t, Context, "alert", `{}`), exec_conf)
+		}()
+	}
+	wg.Wait()
+	if !results[0] || !results[1] {
+		t.Errorf("results %v, want both run one after the other", results)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// response body read by default, also the largest body kept as step result
+const httpBodyLimit = 1024 * 1024
+
+type statusRange struct {
+	from, to int
+}
+
+func outputHttp(msg_ctx *MessageContext, out *_outHttpConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	if _, err := httpRequest(msg_ctx, out, false); err != nil {
+		log.Printf("OUTPUT-HTTP: %s", err)
+	}
+}
+
+/*
+ * Sends the request, retried on retry-status and connection errors.
+ * Error when the status is not in expect-status or the body does not match expect-body.
+ * The response is returned for steps, also with the error if there is a response:
+ * status, headers and body, JSON decoded if it is JSON.
+ */
+func httpRequest(msg_ctx *MessageContext, out *_outHttpConfig, read_body bool) (map[string]interface{}, error) {
+	url := replaceJSONPathTags(msg_ctx, out.Url, &out.tags.Url)
+	method := replaceJSONPathTags(msg_ctx, out.Method, &out.tags.Method)
+	body := replaceJSONPathTags(msg_ctx, out.Body, &out.tags.Body)
+
+	out.client.Do(func() { setupHttpClient(msg_ctx, out) })
+	if out.client.err != nil {
+		return nil, fmt.Errorf("invalid config of HTTP output to %s : %w", out.Url, out.client.err)
+	}
+
+	if out.tags.HeadersKeys == nil { // initialize tags cache for Headers
+		out.tags.HeadersKeys = make([]*[]string, len(out.Headers))
+		out.tags.HeadersVals = make([]*[]string, len(out.Headers))
+	}
+	headers := http.Header{}
+	for ii := range len(out.Headers) {
+		for h_k, h_v := range out.Headers[ii] {
+			h_k = replaceJSONPathTags(msg_ctx, h_k, &out.tags.HeadersKeys[ii])
+			h_v = replaceJSONPathTags(msg_ctx, h_v, &out.tags.HeadersVals[ii])
+			headers.Set(h_k, h_v)
+		}
+	}
+
+	limit := int64(out.BodyLimit)
+	if limit == 0 {
+		limit = httpBodyLimit
+	}
+	delay := time.Duration(out.RetryDelay) * time.Millisecond
+	if out.RetryDelay == 0 {
+		delay = time.Second
+	}
+
+	for attempt := uint32(0); ; attempt++ {
+		req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create http request to %s : %w", url, err)
+		}
+		req.Header = headers.Clone()
+
+		resp, err := out.client.c.Do(req)
+		if err != nil {
+			if attempt < out.Retries {
+				log.Printf("OUTPUT-HTTP: failed to send HTTP request to %s, retry in %s : %s", url, delay, err)
+				time.Sleep(delay)
+				delay *= 2
+				continue
+			}
+			return nil, fmt.Errorf("failed to send HTTP request to %s err: %w", url, err)
+		}
+		resp_body, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+		io.Copy(io.Discard, io.LimitReader(resp.Body, limit)) // the connection is reused after the rest
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read HTTP response of %s : %w", url, err)
+		}
+
+		if attempt < out.Retries && inStatusRanges(out.client.retryStatus, resp.StatusCode) {
+			wait := delay
+			if resp.StatusCode == http.StatusTooManyRequests {
+				wait = retryAfter(resp, resp_body)
+			}
+			log.Printf("OUTPUT-HTTP: %s returned %s, retry in %s", url, resp.Status, wait)
+			time.Sleep(wait)
+			delay *= 2
+			continue
+		}
+
+		result := map[string]interface{}{
+			"status": resp.StatusCode,
+		}
+		if read_body {
+			resp_headers := map[string]interface{}{}
+			for name := range resp.Header {
+				resp_headers[name] = resp.Header.Get(name)
+			}
+			result["headers"] = resp_headers
+			result["body"] = jsonOrString(resp_body)
+		}
+
+		if !inStatusRanges(out.client.expectStatus, resp.StatusCode) {
+			return result, fmt.Errorf("unexpected status %s of %s : %s", resp.Status, url, excerpt(resp_body, 256))
+		}
+		if out.client.expectBody != nil && !out.client.expectBody.Match(resp_body) {
+			return result, fmt.Errorf("response of %s does not match %s : %s", url, out.ExpectBody, excerpt(resp_body, 256))
+		}
+		return result, nil
+	}
+}
+
+/*
+ * Client with own transport, so the connections are kept alive for the next messages of the output
+ */
+func setupHttpClient(msg_ctx *MessageContext, out *_outHttpConfig) {
+	var err error
+	if out.client.expectStatus, err = parseStatusRanges(out.ExpectStatus, "200-299"); err != nil {
+		out.client.err = err
+		return
+	}
+	if out.client.retryStatus, err = parseStatusRanges(out.RetryStatus, "429", "500-599"); err != nil {
+		out.client.err = err
+		return
+	}
+	if out.ExpectBody != "" {
+		if out.client.expectBody, err = regexp.Compile(out.ExpectBody); err != nil {
+			out.client.err = fmt.Errorf("expect-body : %w", err)
+			return
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch out.Proxy {
+	case "":
+		// HTTP_PROXY, HTTPS_PROXY and NO_PROXY of the environment
+	case "none":
+		transport.Proxy = nil
+	default:
+		proxy, err := url.Parse(out.Proxy)
+		if err != nil {
+			out.client.err = fmt.Errorf("proxy : %w", err)
+			return
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if transport.TLSClientConfig, err = httpTlsConfig(out); err != nil {
+		out.client.err = err
+		return
+	}
+
+	timeout := time.Duration(out.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.OutputTimeout
+	}
+	out.client.c = &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
+/*
+ * TLS config when ca-file, cert-file or insecure-skip-verify is set, otherwise nil
+ */
+func httpTlsConfig(out *_outHttpConfig) (*tls.Config, error) {
+	if out.CaFile == "" && out.CertFile == "" && !out.InsecureSkipVerify {
+		return nil, nil
+	}
+	return loadTlsConfig(out.CaFile, out.CertFile, out.KeyFile, out.InsecureSkipVerify)
+}
+
+/*
+ * Status codes like 200 or ranges like 200-299, the defaults without values
+ */
+func parseStatusRanges(values []string, defaults ...string) ([]statusRange, error) {
+	if len(values) == 0 {
+		values = defaults
+	}
+	ranges := make([]statusRange, 0, len(values))
+	for _, value := range values {
+		from, to, found := strings.Cut(strings.TrimSpace(value), "-")
+		if !found {
+			to = from
+		}
+		from_code, err_from := strconv.Atoi(strings.TrimSpace(from))
+		to_code, err_to := strconv.Atoi(strings.TrimSpace(to))
+		if err_from != nil || err_to != nil || from_code > to_code {
+			return nil, fmt.Errorf("invalid status range %s", value)
+		}
+		ranges = append(ranges, statusRange{from_code, to_code})
+	}
+	return ranges, nil
+}
+
+func inStatusRanges(ranges []statusRange, status int) bool {
+	for _, r := range ranges {
+		if status >= r.from && status <= r.to {
+			return true
+		}
+	}
+	return false
+}
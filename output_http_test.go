@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type httpReceived struct {
+	method, path, header, body string
+}
+
+/*
+ * Answers with the statuses in order, the last one repeated
+ */
+func newHttpServer(t *testing.T, statuses ...int) (*httptest.Server, func() ([]httpReceived, int)) {
+	var lock sync.Mutex
+	var received []httpReceived
+	conns := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		received = append(received, httpReceived{r.Method, r.URL.Path, r.Header.Get("X-Alert"), string(data)})
+		status := statuses[min(len(received), len(statuses))-1]
+		lock.Unlock()
+		w.Header().Set("X-Ticket", "T-1")
+		w.WriteHeader(status)
+		if status == http.StatusTooManyRequests {
+			w.Write([]byte(`{"retry_after":0.05}`))
+			return
+		}
+		w.Write([]byte(`{"id":42,"state":"open"}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			lock.Lock()
+			conns++
+			lock.Unlock()
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, func() ([]httpReceived, int) {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]httpReceived{}, received...), conns
+	}
+}
+
+func TestHttpRequest(t *testing.T) {
+	server, received := newHttpServer(t, http.StatusCreated)
+	Context := testContext()
+	out := &_outHttpConfig{
+		Url:     server.URL + "/{{$.queue}}",
+		Method:  "PUT",
+		Headers: []map[string]string{{"X-Alert": "{{$.host}}"}},
+		Body:    `{"host":"{{$.host}}"}`,
+	}
+	for _, host := range []string{"web1", "web2", "web3"} {
+		result, err := httpRequest(testMessage(t, Context, "alert", `{"queue":"ops","host":"`+host+`"}`), out, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := result["body"].(map[string]interface{})
+		headers, _ := result["headers"].(map[string]interface{})
+		if result["status"] != http.StatusCreated || body["id"] != float64(42) || headers["X-Ticket"] != "T-1" {
+			t.Errorf("result %v", result)
+		}
+	}
+	got, conns := received()
+	if len(got) != 3 || got[2] != (httpReceived{"PUT", "/ops", "web3", `{"host":"web3"}`}) {
+		t.Errorf("received %+v", got)
+	}
+	// the client of the output keeps the connection alive
+	if conns != 1 {
+		t.Errorf("%d connections, want 1", conns)
+	}
+
+	// the body is only kept for steps
+	if result, _ := httpRequest(testMessage(t, Context, "alert", `{"queue":"ops","host":"web1"}`), out, false); result["body"] != nil {
+		t.Errorf("result %v, want only the status", result)
+	}
+}
+
+func TestHttpExpect(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		out    *_outHttpConfig
+		err    string
+	}{
+		{"default", http.StatusOK, &_outHttpConfig{}, ""},
+		{"default failed", http.StatusNotFound, &_outHttpConfig{}, "unexpected status 404"},
+		{"status", http.StatusNotFound, &_outHttpConfig{ExpectStatus: []string{"200", "404-409"}}, ""},
+		{"body", http.StatusOK, &_outHttpConfig{ExpectBody: `"state":"(open|acked)"`}, ""},
+		{"body failed", http.StatusOK, &_outHttpConfig{ExpectBody: `"state":"closed"`}, "does not match"},
+		{"invalid status", http.StatusOK, &_outHttpConfig{ExpectStatus: []string{"299-200"}}, "invalid status range"},
+		{"invalid body", http.StatusOK, &_outHttpConfig{ExpectBody: `(`}, "expect-body"},
+		{"body limit", http.StatusOK, &_outHttpConfig{ExpectBody: `open`, BodyLimit: 10}, "does not match"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, _ := newHttpServer(t, test.status)
+			test.out.Url = server.URL
+			result, err := httpRequest(testMessage(t, testContext(), "alert", `{}`), test.out, true)
+			if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("error %v, want %q", err, test.err)
+			}
+			if test.name == "default failed" && result["status"] != http.StatusNotFound {
+				t.Errorf("result %v, want the response with the error", result)
+			}
+			if test.name == "body limit" && result["body"] != `{"id":42,"` {
+				t.Errorf("body %q, want the first 10 bytes", result["body"])
+			}
+		})
+	}
+}
+
+func TestHttpRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		out      *_outHttpConfig
+		requests int
+		err      string
+	}{
+		{"recovered", []int{503, 429, 200}, &_outHttpConfig{Retries: 3}, 3, ""},
+		{"exhausted", []int{502}, &_outHttpConfig{Retries: 2}, 3, "unexpected status 502"},
+		{"not retried", []int{503}, &_outHttpConfig{Retries: 2, RetryStatus: []string{"409"}}, 1, "unexpected status 503"},
+		{"retry status", []int{409, 200}, &_outHttpConfig{Retries: 2, RetryStatus: []string{"409"}}, 2, ""},
+		{"no retries", []int{503, 200}, &_outHttpConfig{}, 1, "unexpected status 503"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, received := newHttpServer(t, test.statuses...)
+			test.out.Url = server.URL
+			test.out.RetryDelay = 10
+			_, err := httpRequest(testMessage(t, testContext(), "alert", `{}`), test.out, false)
+			if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("error %v, want %q", err, test.err)
+			}
+			if got, _ := received(); len(got) != test.requests {
+				t.Errorf("%d requests, want %d", len(got), test.requests)
+			}
+		})
+	}
+
+	// connection errors are retried with the delay doubled: 10 + 20 ms
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	start := time.Now()
+	out := &_outHttpConfig{Url: "http://" + address, Retries: 2, RetryDelay: 10}
+	if _, err := httpRequest(testMessage(t, testContext(), "alert", `{}`), out, false); err == nil {
+		t.Error("no error without a server")
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("failed after %s, want the retry delays", elapsed)
+	}
+}
+
+func TestParseStatusRanges(t *testing.T) {
+	ranges, err := parseStatusRanges([]string{"200", " 400 - 404 "})
+	if err != nil || len(ranges) != 2 || ranges[1] != (statusRange{400, 404}) {
+		t.Fatalf("ranges %v %v", ranges, err)
+	}
+	for status, want := range map[int]bool{200: true, 201: false, 399: false, 400: true, 404: true, 405: false} {
+		if inStatusRanges(ranges, status) != want {
+			t.Errorf("status %d in ranges %v, want %v", status, !want, want)
+		}
+	}
+	if ranges, _ := parseStatusRanges(nil, "500-599"); !inStatusRanges(ranges, 503) {
+		t.Error("defaults not used without values")
+	}
+	for _, value := range []string{"", "2xx", "500-", "404-400"} {
+		if _, err := parseStatusRanges([]string{value}); err == nil {
+			t.Errorf("no error for %q", value)
+		}
+	}
+}
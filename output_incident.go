@@ -0,0 +1,206 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+var pagerdutySeverities = map[string]string{
+	"critical": "critical", "fatal": "critical", "high": "error", "error": "error",
+	"warning": "warning", "warn": "warning", "medium": "warning",
+	"info": "info", "notice": "info", "low": "info",
+}
+
+var opsgeniePriorities = map[string]string{
+	"critical": "P1", "fatal": "P1", "high": "P2", "error": "P2",
+	"warning": "P3", "warn": "P3", "medium": "P3",
+	"info": "P4", "notice": "P4", "low": "P5",
+}
+
+type incidentMessage struct {
+	url      string
+	key      string
+	action   string // trigger, acknowledge or resolve
+	severity string
+	summary  string
+	source   string
+	dedupKey string
+	tags     []string
+}
+
+func resolveIncidentMessage(msg_ctx *MessageContext, out *_outIncidentConfig) *incidentMessage {
+	if out.tags.Tags == nil { // initialize tags cache for Tags
+		out.tags.Tags = make([]*[]string, len(out.Tags))
+	}
+
+	msg := &incidentMessage{
+		url:      replaceJSONPathTags(msg_ctx, out.Url, &out.tags.Url),
+		key:      replaceJSONPathTags(msg_ctx, out.Key, &out.tags.Key),
+		severity: replaceJSONPathTags(msg_ctx, out.Severity, &out.tags.Severity),
+		summary:  replaceJSONPathTags(msg_ctx, out.Summary, &out.tags.Summary),
+		source:   replaceJSONPathTags(msg_ctx, out.Source, &out.tags.Source),
+		dedupKey: replaceJSONPathTags(msg_ctx, out.DedupKey, &out.tags.DedupKey),
+	}
+	for ii := range out.Tags {
+		tag := replaceJSONPathTags(msg_ctx, out.Tags[ii], &out.tags.Tags[ii])
+		if tag != "" {
+			msg.tags = append(msg.tags, tag)
+		}
+	}
+	if msg.source == "" {
+		msg.source = "notifier"
+	}
+
+	// The same dedup key opens the incident and resolves it
+	status := strings.ToLower(replaceJSONPathTags(msg_ctx, out.Status, &out.tags.Status))
+	resolve_on := out.ResolveOn
+	if len(resolve_on) == 0 {
+		resolve_on = []string{"resolved", "ok"}
+	}
+	acknowledge_on := out.AcknowledgeOn
+	if len(acknowledge_on) == 0 {
+		acknowledge_on = []string{"acknowledged"}
+	}
+	switch {
+	case status != "" && slices.Contains(resolve_on, status):
+		msg.action = "resolve"
+	case status != "" && slices.Contains(acknowledge_on, status):
+		msg.action = "acknowledge"
+	default:
+		msg.action = "trigger"
+	}
+	return msg
+}
+
+func incidentTimeout(msg_ctx *MessageContext, out *_outIncidentConfig) time.Duration {
+	timeout := time.Duration(out.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.OutputTimeout
+	}
+	return timeout
+}
+
+func incidentRetries(out *_outIncidentConfig) uint32 {
+	if out.Retries == nil {
+		return 3
+	}
+	return *out.Retries
+}
+
+/*
+ * PagerDuty Events API v2
+ */
+func outputPagerDuty(msg_ctx *MessageContext, out *_outIncidentConfig) {
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	msg := resolveIncidentMessage(msg_ctx, out)
+	if msg.url == "" {
+		msg.url = "https://events.pagerduty.com/v2/enqueue"
+	}
+
+	payload := map[string]interface{}{
+		"routing_key":  msg.key,
+		"event_action": msg.action,
+	}
+	if msg.dedupKey != "" {
+		payload["dedup_key"] = msg.dedupKey
+	}
+	if msg.action == "trigger" {
+		severity, ok := pagerdutySeverities[strings.ToLower(msg.severity)]
+		if !ok {
+			severity = "error"
+		}
+		payload["payload"] = map[string]interface{}{
+			"summary":        msg.summary,
+			"source":         msg.source,
+			"severity":       severity,
+			"custom_details": msg_ctx.JsonRpc.Params,
+		}
+	} else if msg.dedupKey == "" {
+		log.Printf("OUTPUT-PAGERDUTY: cannot %s incident without dedup-key", msg.action)
+		return
+	}
+
+	_, _, err := postJSON(msg.url, nil, payload, incidentTimeout(msg_ctx, out), incidentRetries(out))
+	if err != nil {
+		log.Printf("OUTPUT-PAGERDUTY: failed to %s incident %s : %s", msg.action, msg.dedupKey, err)
+	}
+}
+
+/*
+ * Opsgenie Alert API, the dedup-key is the alert alias
+ */
+func outputOpsgenie(msg_ctx *MessageContext, out *_outIncidentConfig) {
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	msg := resolveIncidentMessage(msg_ctx, out)
+	if msg.url == "" {
+		msg.url = "https://api.opsgenie.com" // https://api.eu.opsgenie.com for EU
+	}
+	base_url := strings.TrimSuffix(msg.url, "/") + "/v2/alerts"
+	headers := map[string]string{"Authorization": "GenieKey " + msg.key}
+
+	var api_url string
+	var payload map[string]interface{}
+	switch msg.action {
+	case "trigger":
+		priority, ok := opsgeniePriorities[strings.ToLower(msg.severity)]
+		if !ok {
+			priority = "P3"
+		}
+		api_url = base_url
+		payload = map[string]interface{}{
+			"message":  msg.summary,
+			"source":   msg.source,
+			"priority": priority,
+		}
+		if msg.dedupKey != "" {
+			payload["alias"] = msg.dedupKey
+		}
+		if len(msg.tags) > 0 {
+			payload["tags"] = msg.tags
+		}
+		if details := opsgenieDetails(msg_ctx.JsonRpc.Params); details != nil {
+			payload["details"] = details
+		}
+	default:
+		if msg.dedupKey == "" {
+			log.Printf("OUTPUT-OPSGENIE: cannot %s alert without dedup-key", msg.action)
+			return
+		}
+		action := "close"
+		if msg.action == "acknowledge" {
+			action = "acknowledge"
+		}
+		api_url = base_url + "/" + url.PathEscape(msg.dedupKey) + "/" + action + "?identifierType=alias"
+		payload = map[string]interface{}{
+			"source": msg.source,
+			"note":   msg.summary,
+		}
+	}
+
+	_, _, err := postJSON(api_url, headers, payload, incidentTimeout(msg_ctx, out), incidentRetries(out))
+	if err != nil {
+		log.Printf("OUTPUT-OPSGENIE: failed to %s alert %s : %s", msg.action, msg.dedupKey, err)
+	}
+}
+
+/*
+ * Opsgenie details are string key/value pairs
+ */
+func opsgenieDetails(params interface{}) map[string]string {
+	params_map, ok := params.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	details := make(map[string]string, len(params_map))
+	for k, v := range params_map {
+		details[k] = jsonValueString(v)
+	}
+	return details
+}
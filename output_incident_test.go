@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func incidentTestConfig(url string) *_outIncidentConfig {
+	return &_outIncidentConfig{
+		Url:      url,
+		Key:      "routing-key",
+		Severity: "{{$.level}}",
+		Summary:  "{{$.host}}: {{$.text}}",
+		DedupKey: "{{$.host}} disk",
+		Status:   "{{$.status}}",
+		Tags:     []string{"{{$.host}}", "{{$.team}}"},
+	}
+}
+
+func TestPagerDuty(t *testing.T) {
+	server, requests := newChatServer(t, chatOk)
+	out := incidentTestConfig(server.URL + "/v2/enqueue")
+	Context := testContext()
+
+	for _, params := range []string{
+		`{"host":"web1","level":"High","text":"disk full","status":"firing","count":3}`,
+		`{"host":"web1","level":"bogus","text":"disk full","status":"ACKNOWLEDGED"}`,
+		`{"host":"web1","text":"disk ok","status":"ok"}`,
+	} {
+		outputPagerDuty(testMessage(t, Context, "alert", params), out)
+	}
+
+	sent := requests()
+	if len(sent) != 3 {
+		t.Fatalf("%d events, want 3", len(sent))
+	}
+	trigger := sent[0].body
+	want := map[string]interface{}{
+		"routing_key":  "routing-key",
+		"event_action": "trigger",
+		"dedup_key":    "web1 disk",
+		"payload": map[string]interface{}{
+			"summary":  "web1: disk full",
+			"source":   "notifier",
+			"severity": "error",
+			"custom_details": map[string]interface{}{"host": "web1", "level": "High", "text": "disk full",
+				"status": "firing", "count": float64(3)},
+		},
+	}
+	if !reflect.DeepEqual(trigger, want) {
+		t.Errorf("trigger %v, want %v", trigger, want)
+	}
+	// the same dedup key acknowledges and resolves it, without the payload
+	for ii, action := range []string{"acknowledge", "resolve"} {
+		body := sent[ii+1].body
+		if body["event_action"] != action || body["dedup_key"] != "web1 disk" || body["payload"] != nil {
+			t.Errorf("event %v, want %s of the incident", body, action)
+		}
+	}
+}
+
+func TestPagerDutyWithoutDedupKey(t *testing.T) {
+	server, requests := newChatServer(t, chatOk)
+	out := incidentTestConfig(server.URL)
+	out.DedupKey = ""
+	out.ResolveOn = []string{"clear"}
+	Context := testContext()
+
+	outputPagerDuty(testMessage(t, Context, "alert", `{"host":"web1","status":"clear"}`), out)
+	// not in resolve-on, so it is a trigger
+	outputPagerDuty(testMessage(t, Context, "alert", `{"host":"web1","level":"warn","status":"ok"}`), out)
+
+	sent := requests()
+	if len(sent) != 1 || sent[0].body["event_action"] != "trigger" || sent[0].body["dedup_key"] != nil {
+		t.Fatalf("events %v, want only the trigger", sent)
+	}
+	if got := jsonAt(sent[0].body, "payload", "severity"); got != "warning" {
+		t.Errorf("severity %v, want warning", got)
+	}
+}
+
+func TestOpsgenie(t *testing.T) {
+	server, requests := newChatServer(t, chatOk)
+	out := incidentTestConfig(server.URL + "/")
+	out.Source = "{{$.host}}"
+	Context := testContext()
+
+	for _, params := range []string{
+		`{"host":"web1","level":"critical","text":"disk full","team":"","nested":{"a":1}}`,
+		`{"host":"web1","text":"seen","status":"acknowledged"}`,
+		`{"host":"web1","text":"disk ok","status":"resolved"}`,
+	} {
+		outputOpsgenie(testMessage(t, Context, "alert", params), out)
+	}
+
+	sent := requests()
+	if len(sent) != 3 {
+		t.Fatalf("%d requests, want 3", len(sent))
+	}
+	create := sent[0]
+	if create.path != "/v2/alerts" || create.headers.Get("Authorization") != "GenieKey routing-key" {
+		t.Errorf("create %s %s", create.path, create.headers.Get("Authorization"))
+	}
+	want := map[string]interface{}{
+		"message":  "web1: disk full",
+		"source":   "web1",
+		"priority": "P1",
+		"alias":    "web1 disk",
+		"tags":     []interface{}{"web1"},
+		"details": map[string]interface{}{"host": "web1", "level": "critical", "text": "disk full", "team": "",
+			"nested": `{"a":1}`},
+	}
+	if !reflect.DeepEqual(create.body, want) {
+		t.Errorf("alert %v, want %v", create.body, want)
+	}
+
+	for ii, action := range []string{"acknowledge", "close"} {
+		req := sent[ii+1]
+		if req.path != "/v2/alerts/web1 disk/"+action || req.query.Get("identifierType") != "alias" {
+			t.Errorf("request %s?%s, want %s by alias", req.path, req.query.Encode(), action)
+		}
+		if req.body["source"] != "web1" || req.body["message"] != nil {
+			t.Errorf("%s payload %v", action, req.body)
+		}
+	}
+	if sent[2].body["note"] != "web1: disk ok" {
+		t.Errorf("close note %v", sent[2].body["note"])
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var statsdTypes = map[string]string{
+	"counter": "c", "gauge": "g", "timer": "ms", "histogram": "h", "set": "s",
+}
+
+// StatsD and Graphite separators in names and tags, new lines would start another metric
+var statsdEscape = strings.NewReplacer(":", "_", "|", "_", ",", "_", "\n", "_", "\r", "_")
+var graphiteEscape = strings.NewReplacer(" ", "_", ";", "_", "=", "_", "\n", "_", "\r", "_")
+
+// Influx line protocol escaping
+var influxMeasurementEscape = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+var influxTagEscape = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `, "\r", `\ `)
+var influxStringEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// keep UDP datagrams below the usual MTU
+const metricMaxDatagram = 1400
+
+type metricPoint struct {
+	name   string
+	value  string
+	tags   [][2]string
+	fields [][2]string
+	time   time.Time
+}
+
+func resolveMetricPoint(msg_ctx *MessageContext, out *_outMetricConfig) *metricPoint {
+	if out.tags.TagsNames == nil { // initialize tags cache for maps, in sorted order
+		out.tags.TagsNames = sortedKeys(out.Tags)
+		out.tags.TagsKeys = make([]*[]string, len(out.Tags))
+		out.tags.TagsVals = make([]*[]string, len(out.Tags))
+		out.tags.FieldsNames = sortedKeys(out.Fields)
+		out.tags.FieldsVals = make([]*[]string, len(out.Fields))
+	}
+
+	point := &metricPoint{
+		name:  out.Prefix + replaceJSONPathTags(msg_ctx, out.Name, &out.tags.Name),
+		value: strings.TrimSpace(replaceJSONPathTags(msg_ctx, out.Value, &out.tags.Value)),
+		time:  time.Now(),
+	}
+
+	for ii, k := range out.tags.TagsNames {
+		tag_k := replaceJSONPathTags(msg_ctx, k, &out.tags.TagsKeys[ii])
+		tag_v := replaceJSONPathTags(msg_ctx, out.Tags[k], &out.tags.TagsVals[ii])
+		if tag_k != "" && tag_v != "" {
+			point.tags = append(point.tags, [2]string{tag_k, tag_v})
+		}
+	}
+	for ii, k := range out.tags.FieldsNames {
+		field_v := replaceJSONPathTags(msg_ctx, out.Fields[k], &out.tags.FieldsVals[ii])
+		point.fields = append(point.fields, [2]string{k, strings.TrimSpace(field_v)})
+	}
+
+	if ts := replaceJSONPathTags(msg_ctx, out.Timestamp, &out.tags.Timestamp); ts != "" {
+		if sec, err := strconv.ParseFloat(ts, 64); err == nil {
+			point.time = time.Unix(0, int64(sec*1e9))
+		} else {
+			log.Printf("OUTPUT-METRIC: invalid timestamp %s for %s", ts, point.name)
+		}
+	}
+	return point
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isNumeric(value string) bool {
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil
+}
+
+/*
+ * <name>:<value>|<type>[|@<rate>][|#tag:value,...]
+ */
+func statsdLine(out *_outMetricConfig, point *metricPoint) (string, error) {
+	metric_type, ok := statsdTypes[out.Type]
+	if out.Type == "" {
+		metric_type, ok = "c", true
+	}
+	if !ok {
+		return "", fmt.Errorf("unknown statsd type %s", out.Type)
+	}
+	if point.value == "" && metric_type == "c" {
+		point.value = "1"
+	}
+	if metric_type != "s" && !isNumeric(point.value) {
+		return "", fmt.Errorf("value \"%s\" of %s is not a number", point.value, point.name)
+	}
+
+	line := statsdEscape.Replace(point.name) + ":" + statsdEscape.Replace(point.value) + "|" + metric_type
+	if out.SampleRate > 0 && out.SampleRate < 1 {
+		line += "|@" + strconv.FormatFloat(out.SampleRate, 'f', -1, 64)
+	}
+	if len(point.tags) > 0 { // DogStatsD tags
+		tags := make([]string, len(point.tags))
+		for ii, tag := range point.tags {
+			tags[ii] = statsdEscape.Replace(tag[0]) + ":" + statsdEscape.Replace(tag[1])
+		}
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line, nil
+}
+
+/*
+ * <name>[;tag=value...] <value> <timestamp>
+ */
+func graphiteLine(point *metricPoint) (string, error) {
+	if !isNumeric(point.value) {
+		return "", fmt.Errorf("value \"%s\" of %s is not a number", point.value, point.name)
+	}
+	name := graphiteEscape.Replace(point.name)
+	for _, tag := range point.tags {
+		name += ";" + graphiteEscape.Replace(tag[0]) + "=" + graphiteEscape.Replace(tag[1])
+	}
+	return name + " " + point.value + " " + strconv.FormatInt(point.time.Unix(), 10), nil
+}
+
+/*
+ * <measurement>[,tag=value...] field=value[,field=value...] <timestamp ns>
+ */
+func influxLine(point *metricPoint) (string, error) {
+	fields := point.fields
+	if len(fields) == 0 {
+		fields = [][2]string{{"value", point.value}}
+	}
+
+	var line strings.Builder
+	line.WriteString(influxMeasurementEscape.Replace(point.name))
+	for _, tag := range point.tags {
+		line.WriteString("," + influxTagEscape.Replace(tag[0]) + "=" + influxTagEscape.Replace(tag[1]))
+	}
+	for ii, field := range fields {
+		value, err := influxFieldValue(field[1])
+		if err != nil {
+			return "", fmt.Errorf("field %s of %s: %w", field[0], point.name, err)
+		}
+		if ii == 0 {
+			line.WriteString(" ")
+		} else {
+			line.WriteString(",")
+		}
+		line.WriteString(influxTagEscape.Replace(field[0]) + "=" + value)
+	}
+	line.WriteString(" " + strconv.FormatInt(point.time.UnixNano(), 10))
+	return line.String(), nil
+}
+
+/*
+ * 12i is integer, numbers are float, true/false boolean, "quoted" is string
+ */
+func influxFieldValue(value string) (string, error) {
+	switch {
+	case value == "":
+		return "", fmt.Errorf("empty value")
+	case strings.HasSuffix(value, "i"):
+		if _, err := strconv.ParseInt(value[:len(value)-1], 10, 64); err == nil {
+			return value, nil
+		}
+	case value == "true" || value == "false":
+		return value, nil
+	case isNumeric(value):
+		return value, nil
+	}
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return `"` + influxStringEscape.Replace(value[1:len(value)-1]) + `"`, nil
+	}
+	return "", fmt.Errorf("value \"%s\" is not a number, boolean or \"string\"", value)
+}
+
+func outputStatsd(msg_ctx *MessageContext, out *_outMetricConfig) {
+	outputMetric(msg_ctx, out, "STATSD", func(point *metricPoint) (string, error) {
+		return statsdLine(out, point)
+	})
+}
+
+func outputGraphite(msg_ctx *MessageContext, out *_outMetricConfig) {
+	outputMetric(msg_ctx, out, "GRAPHITE", graphiteLine)
+}
+
+func outputInflux(msg_ctx *MessageContext, out *_outMetricConfig) {
+	outputMetric(msg_ctx, out, "INFLUX", influxLine)
+}
+
+/*
+ * Formats the point and sends the lines collected in batch-time together
+ */
+func outputMetric(msg_ctx *MessageContext, out *_outMetricConfig, name string,
+	format func(*metricPoint) (string, error)) {
+
+	point := resolveMetricPoint(msg_ctx, out)
+	line, err := format(point)
+	if err != nil {
+		log.Printf("OUTPUT-%s: %s", name, err)
+		return
+	}
+
+	batch_t := time.Duration(out.BatchTime) * time.Millisecond
+	if out.BatchTime == 0 {
+		batch_t = 100 * time.Millisecond
+	}
+	batch_size := int(out.BatchSize)
+	if batch_size == 0 {
+		batch_size = 100
+	}
+	// the batch window does not hold a worker
+	PendingMessages.Increment()
+	lines, ok := out.batch.add(line, batch_size, batch_t)
+	PendingMessages.Decrement()
+	if !ok {
+		return // sent by the first message of the batch
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	timeout := time.Duration(out.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.OutputTimeout
+	}
+
+	if out.Url != "" {
+		err = metricSendHttp(out, lines, timeout)
+	} else {
+		err = metricSendSocket(out, lines, timeout)
+	}
+	if err != nil {
+		log.Printf("OUTPUT-%s: failed to send %d points : %s", name, len(lines), err)
+	}
+}
+
+func metricSendSocket(out *_outMetricConfig, lines []string, timeout time.Duration) error {
+	network := out.Network
+	if network == "" {
+		network = "udp"
+	}
+	conn, err := net.DialTimeout(network, out.Address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+
+	if network != "udp" && network != "unixgram" {
+		_, err := conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+		return err
+	}
+
+	// several lines per datagram, each datagram below the MTU
+	var datagram bytes.Buffer
+	for _, line := range lines {
+		if datagram.Len() > 0 && datagram.Len()+1+len(line) > metricMaxDatagram {
+			if _, err := conn.Write(datagram.Bytes()); err != nil {
+				return err
+			}
+			datagram.Reset()
+		}
+		if datagram.Len() > 0 {
+			datagram.WriteByte('\n')
+		}
+		datagram.WriteString(line)
+	}
+	if datagram.Len() > 0 {
+		_, err = conn.Write(datagram.Bytes())
+	}
+	return err
+}
+
+/*
+ * InfluxDB write API, url with org/bucket or db and precision=ns
+ */
+func metricSendHttp(out *_outMetricConfig, lines []string, timeout time.Duration) error {
+	req, err := http.NewRequest("POST", out.Url, strings.NewReader(strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if out.Token != "" {
+		req.Header.Set("Authorization", "Token "+out.Token)
+	}
+
+	http_client := &http.Client{
+		Timeout: timeout,
+	}
+	resp, err := http_client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body := make([]byte, 512)
+		n, _ := resp.Body.Read(body)
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, excerpt(body[:n], 256))
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsdLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		out   *_outMetricConfig
+		point metricPoint
+		want  string
+	}{
+		{"counter default", &_outMetricConfig{}, metricPoint{name: "alerts"}, "alerts:1|c"},
+		{"gauge sampled", &_outMetricConfig{Type: "gauge", SampleRate: 0.5},
+			metricPoint{name: "disk.used", value: "97.5"}, "disk.used:97.5|g|@0.5"},
+		{"tags", &_outMetricConfig{Type: "timer"},
+			metricPoint{name: "latency", value: "12", tags: [][2]string{{"host", "web1"}, {"env", "prod"}}},
+			"latency:12|ms|#host:web1,env:prod"},
+		{"set", &_outMetricConfig{Type: "set"}, metricPoint{name: "users", value: "john"}, "users:john|s"},
+		// separators from the templates do not start another field or metric
+		{"sanitized", &_outMetricConfig{Type: "set"},
+			metricPoint{name: "a:b|c", value: "x|g\nother:1", tags: [][2]string{{"k:1", "v,w|#x"}}},
+			"a_b_c:x_g_other_1|s|#k_1:v_w_#x"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line, err := statsdLine(test.out, &test.point)
+			if err != nil || line != test.want {
+				t.Errorf("line %q %v, want %q", line, err, test.want)
+			}
+		})
+	}
+
+	if _, err := statsdLine(&_outMetricConfig{Type: "gauge"}, &metricPoint{name: "a", value: "1|c"}); err == nil {
+		t.Error("no error for a value that is not a number")
+	}
+	if _, err := statsdLine(&_outMetricConfig{Type: "meter"}, &metricPoint{name: "a", value: "1"}); err == nil {
+		t.Error("no error for an unknown type")
+	}
+}
+
+func TestGraphiteLine(t *testing.T) {
+	point := &metricPoint{name: "disk used\nfake 1", value: "97", time: time.Unix(1700000000, 0),
+		tags: [][2]string{{"host", "web 1;x=y"}}}
+	line, err := graphiteLine(point)
+	if want := "disk_used_fake_1;host=web_1_x_y 97 1700000000"; err != nil || line != want {
+		t.Errorf("line %q %v, want %q", line, err, want)
+	}
+	if _, err := graphiteLine(&metricPoint{name: "a", value: "full"}); err == nil {
+		t.Error("no error for a value that is not a number")
+	}
+}
+
+func TestInfluxLine(t *testing.T) {
+	point := &metricPoint{name: "disk usage,x", time: time.Unix(1700000000, 5),
+		tags: [][2]string{{"host", "web 1"}, {"path", "a=b,c\nd"}},
+		fields: [][2]string{{"used", "97.5"}, {"files", "12i"}, {"full", "true"},
+			{"note", `"say "hi" \o/"`}}}
+	line, err := influxLine(point)
+	want := `disk\ usage\,x,host=web\ 1,path=a\=b\,c\ d used=97.5,files=12i,full=true,note="say \"hi\" \\o/" 1700000000000000005`
+	if err != nil || line != want {
+		t.Errorf("line\n%s %v, want\n%s", line, err, want)
+	}
+
+	line, err = influxLine(&metricPoint{name: "alerts", value: "1", time: time.Unix(1, 0)})
+	if err != nil || line != "alerts value=1 1000000000" {
+		t.Errorf("line %q %v, want the default value field", line, err)
+	}
+	for _, value := range []string{"", "12x", "full", `"open`} {
+		if _, err := influxFieldValue(value); err == nil {
+			t.Errorf("no error for field value %q", value)
+		}
+	}
+}
+
+func TestMetricPoint(t *testing.T) {
+	Context := testContext()
+	out := &_outMetricConfig{
+		Prefix:    "notifier.",
+		Name:      "{{$.name}}",
+		Value:     " {{$.value}} ",
+		Tags:      map[string]string{"host": "{{$.host}}", "{{$.tag}}": "x", "empty": "{{$.blank}}"},
+		Fields:    map[string]string{"b": "{{$.value}}i", "a": "1"},
+		Timestamp: "{{$.time}}",
+	}
+	point := resolveMetricPoint(testMessage(t, Context, "alert",
+		`{"name":"disk","value":3,"host":"web1","tag":"zone","blank":"","time":1700000000.5}`), out)
+
+	if point.name != "notifier.disk" || point.value != "3" || point.time.UnixNano() != 1700000000500000000 {
+		t.Errorf("point %+v, want the resolved name, value and time", point)
+	}
+	// sorted by the configured names, empty ones skipped
+	if fmt.Sprint(point.tags) != "[[host web1] [zone x]]" || fmt.Sprint(point.fields) != "[[a 1] [b 3i]]" {
+		t.Errorf("tags %v fields %v", point.tags, point.fields)
+	}
+}
+
+func TestMetricUdpBatch(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	Context := testContext()
+	out := &_outMetricConfig{
+		Address:   conn.LocalAddr().String(),
+		Name:      "{{$.name}}",
+		Type:      "gauge",
+		Value:     "{{$.value}}",
+		BatchTime: 50,
+	}
+	// the tag lists are parsed by the first message
+	resolveMetricPoint(testMessage(t, Context, "alert", `{}`), out)
+
+	// long names, the lines of the batch need two datagrams
+	name := strings.Repeat("m", 600)
+	var wg sync.WaitGroup
+	for ii := 0; ii < 3; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputStatsd(testMessage(t, Context, "alert", fmt.Sprintf(`{"name":"%s%d","value":%d}`, name, ii, ii)), out)
+		}()
+		time.Sleep(2 * time.Millisecond) // the first one starts the batch
+	}
+	time.Sleep(20 * time.Millisecond)
+	if PendingMessages.Get() != 1 || ActiveWorkers.Get() != 0 {
+		t.Errorf("pending %d workers %d in the batch window, want 1 0", PendingMessages.Get(), ActiveWorkers.Get())
+	}
+	wg.Wait()
+
+	var lines []string
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, want := range []int{2, 1} {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > metricMaxDatagram {
+			t.Errorf("datagram of %d bytes", n)
+		}
+		datagram := strings.Split(string(buf[:n]), "\n")
+		if len(datagram) != want {
+			t.Errorf("datagram of %d lines, want %d", len(datagram), want)
+		}
+		lines = append(lines, datagram...)
+	}
+	for ii, line := range lines {
+		if want := fmt.Sprintf("%s%d:%d|g", name, ii, ii); line != want {
+			t.Errorf("line %d %.20q, want %.20q", ii, line, want)
+		}
+	}
+}
+
+func TestMetricTcp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	out := &_outMetricConfig{Network: "tcp", Address: listener.Addr().String()}
+	if err := metricSendSocket(out, []string{"a 1 1700000000", "b 2 1700000000"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case lines := <-received:
+		if strings.Join(lines, "|") != "a 1 1700000000|b 2 1700000000" {
+			t.Errorf("lines %q, want one per line", lines)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nothing received")
+	}
+}
+
+func TestMetricInfluxHttp(t *testing.T) {
+	var lock sync.Mutex
+	var auth, body string
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		auth, body = r.Header.Get("Authorization"), string(data)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"code":"invalid","message":"unable to parse"}`))
+	}))
+	defer server.Close()
+
+	out := &_outMetricConfig{Url: server.URL + "/api/v2/write?bucket=alerts&precision=ns", Token: "secret"}
+	if err := metricSendHttp(out, []string{"a value=1 1", "b value=2 2"}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Token secret" || body != "a value=1 1\nb value=2 2\n" {
+		t.Errorf("authorization %q body %q", auth, body)
+	}
+
+	lock.Lock()
+	status = http.StatusBadRequest
+	lock.Unlock()
+	if err := metricSendHttp(out, []string{"a"}, time.Second); err == nil || !strings.Contains(err.Error(), "unable to parse") {
+		t.Errorf("error %v, want the status and the response", err)
+	}
+}
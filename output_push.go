@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default priorities by severity of each service, can be changed with "priorities"
+var ntfyPriorities = map[string]int{
+	"critical": 5, "fatal": 5, "error": 4, "high": 4, "warning": 3, "warn": 3,
+	"medium": 3, "info": 2, "notice": 2, "low": 1, "ok": 2, "resolved": 2,
+}
+var gotifyPriorities = map[string]int{
+	"critical": 10, "fatal": 10, "error": 8, "high": 8, "warning": 5, "warn": 5,
+	"medium": 5, "info": 2, "notice": 2, "low": 1, "ok": 2, "resolved": 2,
+}
+var pushoverPriorities = map[string]int{
+	"critical": 2, "fatal": 2, "error": 1, "high": 1, "warning": 0, "warn": 0,
+	"medium": 0, "info": -1, "notice": -1, "low": -2, "ok": -1, "resolved": -1,
+}
+
+type pushMessage struct {
+	url      string
+	topic    string
+	token    string
+	user     string
+	password string
+	title    string
+	message  string
+	priority string
+	tags     []string
+	click    string
+	attach   string
+}
+
+func resolvePushMessage(msg_ctx *MessageContext, out *_outPushConfig) *pushMessage {
+	if out.tags.Tags == nil { // initialize tags cache for Tags
+		out.tags.Tags = make([]*[]string, len(out.Tags))
+	}
+
+	msg := &pushMessage{
+		url:      replaceJSONPathTags(msg_ctx, out.Url, &out.tags.Url),
+		topic:    replaceJSONPathTags(msg_ctx, out.Topic, &out.tags.Topic),
+		token:    replaceJSONPathTags(msg_ctx, out.Token, &out.tags.Token),
+		user:     replaceJSONPathTags(msg_ctx, out.User, &out.tags.User),
+		password: replaceJSONPathTags(msg_ctx, out.Password, &out.tags.Password),
+		title:    replaceJSONPathTags(msg_ctx, out.Title, &out.tags.Title),
+		message:  replaceJSONPathTags(msg_ctx, out.Message, &out.tags.Message),
+		priority: replaceJSONPathTags(msg_ctx, out.Priority, &out.tags.Priority),
+		click:    replaceJSONPathTags(msg_ctx, out.Click, &out.tags.Click),
+		attach:   replaceJSONPathTags(msg_ctx, out.Attach, &out.tags.Attach),
+	}
+	for ii := range out.Tags {
+		tag := replaceJSONPathTags(msg_ctx, out.Tags[ii], &out.tags.Tags[ii])
+		if tag != "" {
+			msg.tags = append(msg.tags, tag)
+		}
+	}
+	return msg
+}
+
+/*
+ * Priority is a number or severity name, mapped by "priorities" of the output
+ * or by the defaults of the service
+ */
+func pushPriority(priority string, out *_outPushConfig, defaults map[string]int) (int, bool) {
+	priority = strings.ToLower(strings.TrimSpace(priority))
+	if priority == "" {
+		return 0, false
+	}
+	if value, err := strconv.Atoi(priority); err == nil {
+		return value, true
+	}
+	if value, ok := out.Priorities[priority]; ok {
+		return value, true
+	}
+	value, ok := defaults[priority]
+	return value, ok
+}
+
+func pushTimeout(msg_ctx *MessageContext, out *_outPushConfig) time.Duration {
+	timeout := time.Duration(out.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.OutputTimeout
+	}
+	return timeout
+}
+
+func pushRetries(out *_outPushConfig) uint32 {
+	if out.Retries == nil {
+		return 3
+	}
+	return *out.Retries
+}
+
+/*
+ * ntfy JSON publish, auth with access token or user and password
+ */
+func outputNtfy(msg_ctx *MessageContext, out *_outPushConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	msg := resolvePushMessage(msg_ctx, out)
+	if msg.url == "" {
+		msg.url = "https://ntfy.sh"
+	}
+
+	payload := map[string]interface{}{
+		"topic":   msg.topic,
+		"message": msg.message,
+	}
+	if msg.title != "" {
+		payload["title"] = msg.title
+	}
+	if priority, ok := pushPriority(msg.priority, out, ntfyPriorities); ok {
+		payload["priority"] = priority
+	}
+	if len(msg.tags) > 0 {
+		payload["tags"] = msg.tags // emoji short codes are shown as emoji
+	}
+	if msg.click != "" {
+		payload["click"] = msg.click
+	}
+	if msg.attach != "" {
+		payload["attach"] = msg.attach
+	}
+
+	headers := map[string]string{}
+	if msg.token != "" {
+		headers["Authorization"] = "Bearer " + msg.token
+	} else if msg.user != "" {
+		headers["Authorization"] = "Basic " +
+			base64.StdEncoding.EncodeToString([]byte(msg.user+":"+msg.password))
+	}
+
+	_, _, err := postJSON(msg.url, headers, payload, pushTimeout(msg_ctx, out), pushRetries(out))
+	if err != nil {
+		log.Printf("OUTPUT-NTFY: failed to publish to %s topic %s : %s", msg.url, msg.topic, err)
+	}
+}
+
+/*
+ * Gotify message with application token
+ */
+func outputGotify(msg_ctx *MessageContext, out *_outPushConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	msg := resolvePushMessage(msg_ctx, out)
+
+	// Gotify has no tags, show them in front of the title
+	title := strings.TrimSpace(strings.Join(msg.tags, " ") + " " + msg.title)
+	payload := map[string]interface{}{
+		"message": msg.message,
+	}
+	if title != "" {
+		payload["title"] = title
+	}
+	if priority, ok := pushPriority(msg.priority, out, gotifyPriorities); ok {
+		payload["priority"] = priority
+	}
+	notification := map[string]interface{}{}
+	if msg.click != "" {
+		notification["click"] = map[string]interface{}{"url": msg.click}
+	}
+	if msg.attach != "" {
+		notification["bigImageUrl"] = msg.attach
+	}
+	if len(notification) > 0 {
+		payload["extras"] = map[string]interface{}{"client::notification": notification}
+	}
+
+	url := strings.TrimSuffix(msg.url, "/") + "/message"
+	headers := map[string]string{"X-Gotify-Key": msg.token}
+
+	_, _, err := postJSON(url, headers, payload, pushTimeout(msg_ctx, out), pushRetries(out))
+	if err != nil {
+		log.Printf("OUTPUT-GOTIFY: failed to send message to %s : %s", msg.url, err)
+	}
+}
+
+/*
+ * Pushover message with application token and user (or group) key.
+ * The attach url is downloaded and sent as image attachment.
+ */
+func outputPushover(msg_ctx *MessageContext, out *_outPushConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	msg := resolvePushMessage(msg_ctx, out)
+	if msg.url == "" {
+		msg.url = "https://api.pushover.net"
+	}
+	timeout := pushTimeout(msg_ctx, out)
+
+	message := msg.message
+	if len(msg.tags) > 0 {
+		message = strings.Join(msg.tags, " ") + " " + message
+	}
+	payload := map[string]interface{}{
+		"token":   msg.token,
+		"user":    msg.user,
+		"message": message,
+	}
+	if msg.title != "" {
+		payload["title"] = msg.title
+	}
+	if priority, ok := pushPriority(msg.priority, out, pushoverPriorities); ok {
+		payload["priority"] = priority
+		if priority == 2 { // emergency is repeated until acknowledged
+			payload["retry"] = 60
+			payload["expire"] = 3600
+		}
+	}
+	if msg.click != "" {
+		payload["url"] = msg.click
+	}
+	if msg.attach != "" {
+		data, content_type, err := downloadAttachment(msg.attach, timeout, 2_500_000)
+		if err != nil {
+			log.Printf("OUTPUT-PUSHOVER: failed to download attachment %s : %s", msg.attach, err)
+		} else {
+			payload["attachment_base64"] = base64.StdEncoding.EncodeToString(data)
+			payload["attachment_type"] = content_type
+		}
+	}
+
+	url := strings.TrimSuffix(msg.url, "/") + "/1/messages.json"
+	_, _, err := postJSON(url, nil, payload, timeout, pushRetries(out))
+	if err != nil {
+		log.Printf("OUTPUT-PUSHOVER: failed to send message to %s : %s", msg.url, err)
+	}
+}
+
+func downloadAttachment(url string, timeout time.Duration, max_size int64) ([]byte, string, error) {
+	http_client := &http.Client{
+		Timeout: timeout,
+	}
+	resp, err := http_client.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, max_size+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > max_size {
+		return nil, "", fmt.Errorf("attachment is larger than %d bytes", max_size)
+	}
+
+	content_type := resp.Header.Get("Content-Type")
+	if content_type == "" {
+		content_type = http.DetectContentType(data)
+	}
+	return data, content_type, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type pushRequest struct {
+	path    string
+	headers http.Header
+	body    map[string]interface{}
+}
+
+/*
+ * Stand-in for the push services, records the JSON requests
+ * and serves /image.png for the Pushover attachment
+ */
+func newPushServer(t *testing.T) (*httptest.Server, func() []pushRequest) {
+	var lock sync.Mutex
+	var requests []pushRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG image"))
+			return
+		}
+		request := pushRequest{path: r.URL.Path, headers: r.Header}
+		if err := json.NewDecoder(r.Body).Decode(&request.body); err != nil {
+			t.Errorf("invalid JSON to %s : %s", r.URL.Path, err)
+		}
+		lock.Lock()
+		requests = append(requests, request)
+		lock.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []pushRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+}
+
+func pushOne(t *testing.T, requests []pushRequest) pushRequest {
+	t.Helper()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	return requests[0]
+}
+
+const pushTestParams = `{"host":"web1","level":"critical","text":"disk full"}`
+
+func TestNtfy(t *testing.T) {
+	server, requests := newPushServer(t)
+	Context := testContext()
+	out := &_outPushConfig{
+		Url:      server.URL,
+		Topic:    "alerts",
+		Token:    "tk_secret",
+		Title:    "{{$.host}}",
+		Message:  "{{$.text}}",
+		Priority: "{{$.level}}",
+		Tags:     []string{"warning", "{{$.host}}"},
+		Click:    "https://example.com/{{$.host}}",
+	}
+	outputNtfy(testMessage(t, Context, "alert", pushTestParams), out)
+
+	request := pushOne(t, requests())
+	if request.path != "/" {
+		t.Errorf("path %s, want /", request.path)
+	}
+	if got := request.headers.Get("Authorization"); got != "Bearer tk_secret" {
+		t.Errorf("Authorization %q, want the bearer token", got)
+	}
+	want := map[string]interface{}{
+		"topic":    "alerts",
+		"message":  "disk full",
+		"title":    "web1",
+		"priority": float64(5),
+		"tags":     []interface{}{"warning", "web1"},
+		"click":    "https://example.com/web1",
+	}
+	if !reflect.DeepEqual(request.body, want) {
+		t.Errorf("payload %v, want %v", request.body, want)
+	}
+}
+
+func TestNtfyBasicAuth(t *testing.T) {
+	server, requests := newPushServer(t)
+	Context := testContext()
+	out := &_outPushConfig{Url: server.URL, Topic: "alerts", User: "bob", Password: "pw", Message: "hi"}
+	outputNtfy(testMessage(t, Context, "alert", `{}`), out)
+
+	request := pushOne(t, requests())
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pw"))
+	if got := request.headers.Get("Authorization"); got != want {
+		t.Errorf("Authorization %q, want %q", got, want)
+	}
+	if _, ok := request.body["priority"]; ok {
+		t.Errorf("priority set without one configured: %v", request.body)
+	}
+}
+
+func TestGotify(t *testing.T) {
+	server, requests := newPushServer(t)
+	Context := testContext()
+	out := &_outPushConfig{
+		Url:      server.URL + "/",
+		Token:    "app_token",
+		Title:    "{{$.host}}",
+		Message:  "{{$.text}}",
+		Priority: "{{$.level}}",
+		Tags:     []string{"[prod]"},
+		Click:    "https://example.com",
+		Attach:   "https://example.com/graph.png",
+	}
+	outputGotify(testMessage(t, Context, "alert", pushTestParams), out)
+
+	request := pushOne(t, requests())
+	if request.path != "/message" {
+		t.Errorf("path %s, want /message", request.path)
+	}
+	if got := request.headers.Get("X-Gotify-Key"); got != "app_token" {
+		t.Errorf("X-Gotify-Key %q, want app_token", got)
+	}
+	want := map[string]interface{}{
+		"title":    "[prod] web1",
+		"message":  "disk full",
+		"priority": float64(10),
+		"extras": map[string]interface{}{
+			"client::notification": map[string]interface{}{
+				"click":       map[string]interface{}{"url": "https://example.com"},
+				"bigImageUrl": "https://example.com/graph.png",
+			},
+		},
+	}
+	if !reflect.DeepEqual(request.body, want) {
+		t.Errorf("payload %v, want %v", request.body, want)
+	}
+}
+
+func TestPushover(t *testing.T) {
+	server, requests := newPushServer(t)
+	Context := testContext()
+	out := &_outPushConfig{
+		Url:      server.URL,
+		Token:    "app_token",
+		User:     "user_key",
+		Title:    "{{$.host}}",
+		Message:  "{{$.text}}",
+		Priority: "{{$.level}}",
+		Tags:     []string{"[prod]"},
+		Click:    "https://example.com",
+		Attach:   server.URL + "/image.png",
+	}
+	outputPushover(testMessage(t, Context, "alert", pushTestParams), out)
+
+	request := pushOne(t, requests())
+	if request.path != "/1/messages.json" {
+		t.Errorf("path %s, want /1/messages.json", request.path)
+	}
+	want := map[string]interface{}{
+		"token":             "app_token",
+		"user":              "user_key",
+		"title":             "web1",
+		"message":           "[prod] disk full",
+		"priority":          float64(2),
+		"retry":             float64(60),
+		"expire":            float64(3600),
+		"url":               "https://example.com",
+		"attachment_base64": base64.StdEncoding.EncodeToString([]byte("\x89PNG image")),
+		"attachment_type":   "image/png",
+	}
+	if !reflect.DeepEqual(request.body, want) {
+		t.Errorf("payload %v, want %v", request.body, want)
+	}
+}
+
+func TestPushPriority(t *testing.T) {
+	out := &_outPushConfig{Priorities: map[string]int{"page": 5, "info": 3}}
+	tests := []struct {
+		priority string
+		defaults map[string]int
+		want     int
+		ok       bool
+	}{
+		{"", ntfyPriorities, 0, false},
+		{"4", ntfyPriorities, 4, true},
+		{" Warning ", ntfyPriorities, 3, true},
+		{"page", ntfyPriorities, 5, true},
+		{"info", gotifyPriorities, 3, true}, // output priorities before the defaults
+		{"low", pushoverPriorities, -2, true},
+		{"error", gotifyPriorities, 8, true},
+		{"unknown", ntfyPriorities, 0, false},
+	}
+	for _, test := range tests {
+		got, ok := pushPriority(test.priority, out, test.defaults)
+		if got != test.want || ok != test.ok {
+			t.Errorf("pushPriority(%q) = %d %v, want %d %v", test.priority, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "emergency": 0, "alert": 1, "crit": 2, "critical": 2, "fatal": 2,
+	"err": 3, "error": 3, "high": 3, "warning": 4, "warn": 4, "medium": 4,
+	"notice": 5, "ok": 5, "resolved": 5, "low": 5, "info": 6, "debug": 7,
+}
+
+// RFC 5424 SD-PARAM value escaping
+var syslogSdEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+var syslogHostname, _ = os.Hostname()
+
+func outputSyslog(msg_ctx *MessageContext, out *_outSyslogConfig) {
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	severity_str := replaceJSONPathTags(msg_ctx, out.Severity, &out.tags.Severity)
+	msgid := replaceJSONPathTags(msg_ctx, out.MsgId, &out.tags.MsgId)
+	message := replaceJSONPathTags(msg_ctx, out.Message, &out.tags.Message)
+
+	facility, ok := syslogLevel(out.Facility, syslogFacilities, 23)
+	if !ok {
+		facility = 1 // user
+	}
+	severity, ok := syslogLevel(severity_str, syslogSeverities, 7)
+	if !ok {
+		severity = 6 // info
+	}
+	priority := facility*8 + severity
+
+	hostname := out.Hostname
+	if hostname == "" {
+		hostname = syslogHostname
+	}
+	app_name := out.AppName
+	if app_name == "" {
+		app_name = "notifier"
+	}
+
+	var frame string
+	now := time.Now()
+	if out.Format == "rfc3164" {
+		frame = fmt.Sprintf("<%d>%s %s %s[%d]: %s", priority, now.Format(time.Stamp),
+			hostname, app_name, os.Getpid(), message)
+	} else {
+		frame = fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s", priority,
+			now.Format("2006-01-02T15:04:05.000000Z07:00"),
+			syslogHeaderField(hostname, 255), syslogHeaderField(app_name, 48), os.Getpid(),
+			syslogHeaderField(msgid, 32), syslogStructuredData(out.SdId, msg_ctx.JsonRpc.Params),
+			message)
+	}
+
+	network := out.Network
+	if network == "" {
+		network = "udp"
+	}
+	switch {
+	case network == "udp" || network == "unixgram":
+		// datagram per message
+	case out.Framing == "non-transparent" || (out.Framing == "" && network == "unix"):
+		frame = strings.ReplaceAll(frame, "\n", " ") + "\n"
+	default:
+		frame = strconv.Itoa(len(frame)) + " " + frame // octet counting, RFC 6587
+	}
+
+	timeout := time.Duration(out.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.OutputTimeout
+	}
+
+	// One connection per output, reconnect once if the server closed it
+	out.conn.Lock()
+	defer out.conn.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if out.conn.c == nil {
+			conn, err := syslogDial(out, network, timeout)
+			if err != nil {
+				log.Printf("OUTPUT-SYSLOG: failed to connect to %s:%s : %s", network, out.Address, err)
+				return
+			}
+			out.conn.c = conn
+		}
+
+		out.conn.c.SetWriteDeadline(time.Now().Add(timeout))
+		_, err := out.conn.c.Write([]byte(frame))
+		if err == nil {
+			if out.conn.closed {
+				out.conn.c.Close()
+				out.conn.c = nil
+			}
+			return
+		}
+		out.conn.c.Close()
+		out.conn.c = nil
+		if attempt > 0 {
+			log.Printf("OUTPUT-SYSLOG: failed to write to %s:%s : %s", network, out.Address, err)
+		}
+	}
+}
+
+/*
+ * Closes the syslog connections of the methods on config reload
+ */
+func closeSyslogOutputs(Context *_context) {
+	for _, method := range Context.Config.Methods {
+		for i := range method.Syslog {
+			out := &method.Syslog[i]
+			out.conn.Lock()
+			if out.conn.c != nil {
+				out.conn.c.Close()
+				out.conn.c = nil
+			}
+			out.conn.closed = true
+			out.conn.Unlock()
+		}
+	}
+}
+
+func syslogDial(out *_outSyslogConfig, network string, timeout time.Duration) (net.Conn, error) {
+	if network != "tls" {
+		return net.DialTimeout(network, out.Address, timeout)
+	}
+
+	config, err := loadTlsConfig(out.CaFile, "", "", out.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", out.Address, config)
+}
+
+/*
+ * Facility or severity as name or number
+ */
+func syslogLevel(value string, names map[string]int, max int) (int, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if level, err := strconv.Atoi(value); err == nil {
+		return level, level >= 0 && level <= max
+	}
+	level, ok := names[value]
+	return level, ok
+}
+
+/*
+ * Header fields are printable ASCII without spaces, "-" when empty
+ */
+func syslogHeaderField(value string, max_len int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, value)
+	if len(field) > max_len {
+		field = field[:max_len]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+/*
+ * Top level params as SD-PARAMs of one SD-ELEMENT, e.g. [params@32473 name="web" code="1"]
+ */
+func syslogStructuredData(sd_id string, params interface{}) string {
+	params_map, ok := params.(map[string]interface{})
+	if sd_id == "" || !ok || len(params_map) == 0 {
+		return "-"
+	}
+
+	keys := make([]string, 0, len(params_map))
+	for k := range params_map {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sd strings.Builder
+	sd.WriteString("[" + syslogSdName(sd_id))
+	for _, k := range keys {
+		name := syslogSdName(k)
+		if name == "" {
+			continue
+		}
+		sd.WriteString(" " + name + `="` + syslogSdEscape.Replace(jsonValueString(params_map[k])) + `"`)
+	}
+	sd.WriteString("]")
+	return sd.String()
+}
+
+/*
+ * SD-NAME is up to 32 printable ASCII without '=', ' ', ']' and '"'
+ */
+func syslogSdName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
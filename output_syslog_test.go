@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// PRI VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+var rfc5424Re = regexp.MustCompile(`(?s)^<(\d+)>1 (\S+) (\S+) (\S+) (\d+) (\S+) (-|\[.*\]) (.*)$`)
+
+func syslogUdpServer(t *testing.T) (string, func() string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String(), func() string {
+		t.Helper()
+		buf := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no datagram: %s", err)
+		}
+		return string(buf[:n])
+	}
+}
+
+/*
+ * Stream server, returns the data of each connection after it is closed
+ */
+func syslogStreamServer(t *testing.T, network, address string) (net.Listener, func(n int) []string) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var lock sync.Mutex
+	var conns []string
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				data, _ := io.ReadAll(conn)
+				lock.Lock()
+				conns = append(conns, string(data))
+				lock.Unlock()
+			}()
+		}
+	}()
+	return l, func(n int) []string {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			lock.Lock()
+			got := append([]string{}, conns...)
+			lock.Unlock()
+			if len(got) >= n {
+				return got
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("less than %d connections closed", n)
+		return nil
+	}
+}
+
+func TestSyslogRfc5424(t *testing.T) {
+	address, next := syslogUdpServer(t)
+	out := &_outSyslogConfig{
+		Address:  address,
+		Facility: "local3",
+		Severity: "{{$.level}}",
+		Hostname: "web 1",
+		AppName:  "disk-check",
+		MsgId:    "{{$.id}}",
+		SdId:     "params@32473",
+		Message:  "{{$.text}}",
+	}
+	start := time.Now()
+	outputSyslog(testMessage(t, testContext(), "alert",
+		`{"level":"CRIT","id":"DISK FULL","text":"disk full\non /var","path":"a\"b]c\\","bad key=":1}`), out)
+
+	frame := next()
+	match := rfc5424Re.FindStringSubmatch(frame)
+	if match == nil {
+		t.Fatalf("frame %q is not RFC 5424", frame)
+	}
+	if match[1] != strconv.Itoa(19*8+2) {
+		t.Errorf("priority %s, want local3.crit", match[1])
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, match[2]); err != nil || ts.Before(start.Truncate(time.Microsecond)) {
+		t.Errorf("timestamp %s %v", match[2], err)
+	}
+	want := []string{"web1", "disk-check", strconv.Itoa(os.Getpid()), "DISKFULL",
+		`[params@32473 badkey="1" id="DISK FULL" level="CRIT" path="a\"b\]c\\" text="disk full` + "\n" + `on /var"]`,
+		"disk full\non /var"}
+	for ii, value := range want {
+		if match[ii+3] != value {
+			t.Errorf("field %d %q, want %q", ii+3, match[ii+3], value)
+		}
+	}
+}
+
+func TestSyslogRfc3164(t *testing.T) {
+	address, next := syslogUdpServer(t)
+	out := &_outSyslogConfig{Address: address, Format: "rfc3164", Facility: "4", Severity: "{{$.level}}",
+		Hostname: "web1", Message: "{{$.text}}"}
+	Context := testContext()
+
+	outputSyslog(testMessage(t, Context, "alert", `{"level":"9","text":"disk full"}`), out)
+	frame := next()
+	// invalid severity is info, the default app-name is notifier
+	re := regexp.MustCompile(`^<38>[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2} web1 notifier\[` +
+		strconv.Itoa(os.Getpid()) + `\]: disk full$`)
+	if !re.MatchString(frame) {
+		t.Errorf("frame %q is not RFC 3164 auth.info", frame)
+	}
+
+	out = &_outSyslogConfig{Address: address, Format: "rfc3164", Facility: "bogus", Severity: "debug"}
+	outputSyslog(testMessage(t, Context, "alert", `{}`), out)
+	if frame := next(); !strings.HasPrefix(frame, "<15>") {
+		t.Errorf("frame %q, want user.debug", frame)
+	}
+}
+
+/*
+ * RFC 6587 octet counting: "<length> <frame>" per message
+ */
+func splitOctetCounted(t *testing.T, data string) []string {
+	t.Helper()
+	var messages []string
+	reader := bufio.NewReader(strings.NewReader(data))
+	for {
+		length, err := reader.ReadString(' ')
+		if err == io.EOF && length == "" {
+			return messages
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			t.Fatalf("invalid length %q in %q", length, data)
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			t.Fatalf("frame shorter than %d : %q", n, data)
+		}
+		match := rfc5424Re.FindStringSubmatch(string(frame))
+		if match == nil {
+			t.Fatalf("frame %q is not RFC 5424", frame)
+		}
+		messages = append(messages, match[8])
+	}
+}
+
+func TestSyslogOctetCounting(t *testing.T) {
+	l, conns := syslogStreamServer(t, "tcp", "127.0.0.1:0")
+	Context := testContext()
+	Context.Config.Methods = map[string]_methodConfig{
+		"alert": {Syslog: []_outSyslogConfig{{Network: "tcp", Address: l.Addr().String(), Message: "{{$.text}}"}}},
+	}
+	out := &Context.Config.Methods["alert"].Syslog[0]
+
+	outputSyslog(testMessage(t, Context, "alert", `{"text":"first\nline"}`), out)
+	outputSyslog(testMessage(t, Context, "alert", `{"text":"второ"}`), out)
+	// the connection is reused until the reload
+	closeSyslogOutputs(Context)
+	messages := splitOctetCounted(t, conns(1)[0])
+	if len(messages) != 2 || messages[0] != "first\nline" || messages[1] != "второ" {
+		t.Errorf("messages %q, want both on one connection", messages)
+	}
+
+	// a message in flight on reload does not keep the connection
+	outputSyslog(testMessage(t, Context, "alert", `{"text":"third"}`), out)
+	if messages := splitOctetCounted(t, conns(2)[1]); len(messages) != 1 || messages[0] != "third" {
+		t.Errorf("messages %q after the reload", messages)
+	}
+}
+
+func TestSyslogNonTransparent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	_, conns := syslogStreamServer(t, "unix", path)
+	Context := testContext()
+	Context.Config.Methods = map[string]_methodConfig{
+		"alert": {Syslog: []_outSyslogConfig{{Network: "unix", Address: path, Format: "rfc3164", Message: "{{$.text}}"}}},
+	}
+	out := &Context.Config.Methods["alert"].Syslog[0]
+
+	outputSyslog(testMessage(t, Context, "alert", `{"text":"first\nline"}`), out)
+	outputSyslog(testMessage(t, Context, "alert", `{"text":"second"}`), out)
+	closeSyslogOutputs(Context)
+
+	lines := strings.Split(conns(1)[0], "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], ": first line") || !strings.HasSuffix(lines[1], ": second") ||
+		lines[2] != "" {
+		t.Errorf("lines %q, want one per message", lines)
+	}
+}
+
+func TestSyslogLevel(t *testing.T) {
+	tests := []struct {
+		value string
+		level int
+		ok    bool
+	}{
+		{"Warning", 4, true}, {" 3 ", 3, true}, {"8", 8, false}, {"-1", -1, false}, {"loud", 0, false},
+	}
+	for _, test := range tests {
+		level, ok := syslogLevel(test.value, syslogSeverities, 7)
+		if level != test.level || ok != test.ok {
+			t.Errorf("severity %q: %d %v, want %d %v", test.value, level, ok, test.level, test.ok)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"html"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var telegramMarkdownV2 = strings.NewReplacer(
+	"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)",
+	"~", "\\~", "`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=",
+	"|", "\\|", "{", "\\{", "}", "\\}", ".", "\\.", "!", "\\!",
+)
+
+func outputTelegram(msg_ctx *MessageContext, out *_outTelegramConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	if out.tags.ChatIds == nil { // initialize tags cache for ChatIds
+		out.tags.ChatIds = make([]*[]string, len(out.ChatIds))
+	}
+
+	// Values from params are escaped for the parse mode, the template markup is kept
+	var escape func(string) string
+	switch out.ParseMode {
+	case "MarkdownV2":
+		escape = telegramMarkdownV2.Replace
+	case "HTML":
+		escape = html.EscapeString
+	case "":
+	default:
+		log.Printf("OUTPUT-TELEGRAM: unsupported parse-mode %s", out.ParseMode)
+		return
+	}
+
+	token := replaceJSONPathTags(msg_ctx, out.Token, &out.tags.Token)
+	text := replaceJSONPathTagsEscaped(msg_ctx, out.Text, &out.tags.Text, escape)
+	thread_id := replaceJSONPathTags(msg_ctx, out.ThreadId, &out.tags.ThreadId)
+
+	api_url := out.ApiUrl
+	if api_url == "" {
+		api_url = "https://api.telegram.org"
+	}
+	url := strings.TrimSuffix(api_url, "/") + "/bot" + token + "/sendMessage"
+
+	timeout := time.Duration(out.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.OutputTimeout
+	}
+	retries := uint32(3)
+	if out.Retries != nil {
+		retries = *out.Retries
+	}
+
+	for ii := range out.ChatIds {
+		chat_id := replaceJSONPathTags(msg_ctx, out.ChatIds[ii], &out.tags.ChatIds[ii])
+		if chat_id == "" {
+			continue
+		}
+
+		payload := map[string]interface{}{
+			"chat_id":              chat_id,
+			"text":                 text,
+			"disable_notification": out.Silent,
+		}
+		if out.ParseMode != "" {
+			payload["parse_mode"] = out.ParseMode
+		}
+		if thread_id != "" {
+			if id, err := strconv.ParseInt(thread_id, 10, 64); err == nil {
+				payload["message_thread_id"] = id
+			} else {
+				log.Printf("OUTPUT-TELEGRAM: invalid thread-id %s", thread_id)
+			}
+		}
+
+		_, _, err := postJSON(url, nil, payload, timeout, retries)
+		if err != nil {
+			// don't log the url, it contains the bot token
+			log.Printf("OUTPUT-TELEGRAM: failed to send message to chat %s : %s", chat_id, urlError(err))
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTelegram(t *testing.T) {
+	server, requests := newChatServer(t, func(n int, req *chatRequest) (int, string) {
+		if n == 1 {
+			return http.StatusTooManyRequests, `{"ok":false,"parameters":{"retry_after":0.01}}`
+		}
+		return http.StatusOK, `{"ok":true,"result":{}}`
+	})
+	out := &_outTelegramConfig{
+		ApiUrl:    server.URL + "/",
+		Token:     "123:abc",
+		ChatIds:   []string{"-100200", "{{$.chat}}", "{{$.none}}"},
+		Text:      "*{{$.host}}* {{$.text}}",
+		ParseMode: "MarkdownV2",
+		Silent:    true,
+		ThreadId:  "{{$.thread}}",
+	}
+	outputTelegram(testMessage(t, testContext(), "alert",
+		`{"host":"web-1","text":"disk_usage (97.5%) > limit!","chat":"@ops","none":"","thread":"7"}`), out)
+
+	sent := requests()
+	if len(sent) != 3 {
+		t.Fatalf("%d requests, want the retry and one per chat", len(sent))
+	}
+	for ii, chat_id := range []string{"-100200", "@ops"} {
+		req := sent[ii+1]
+		if req.path != "/bot123:abc/sendMessage" || req.body["chat_id"] != chat_id {
+			t.Errorf("request %s %v, want chat %s", req.path, req.body["chat_id"], chat_id)
+		}
+		// the values are escaped, the markup of the template is kept
+		if text := req.body["text"]; text != `*web\-1* disk\_usage \(97\.5%\) \> limit\!` {
+			t.Errorf("text %q", text)
+		}
+		if req.body["parse_mode"] != "MarkdownV2" || req.body["disable_notification"] != true ||
+			req.body["message_thread_id"] != float64(7) {
+			t.Errorf("payload %v", req.body)
+		}
+	}
+}
+
+func TestTelegramParseModes(t *testing.T) {
+	server, requests := newChatServer(t, chatOk)
+	Context := testContext()
+	params := `{"text":"<b>a & b</b>"}`
+
+	out := &_outTelegramConfig{ApiUrl: server.URL, Token: "1", ChatIds: []string{"1"}, Text: "<i>{{$.text}}</i>",
+		ParseMode: "HTML", ThreadId: "general"}
+	outputTelegram(testMessage(t, Context, "alert", params), out)
+	out = &_outTelegramConfig{ApiUrl: server.URL, Token: "1", ChatIds: []string{"1"}, Text: "{{$.text}}"}
+	outputTelegram(testMessage(t, Context, "alert", params), out)
+	out = &_outTelegramConfig{ApiUrl: server.URL, Token: "1", ChatIds: []string{"1"}, Text: "x", ParseMode: "Markdown"}
+	outputTelegram(testMessage(t, Context, "alert", params), out)
+
+	sent := requests()
+	if len(sent) != 2 {
+		t.Fatalf("%d requests, want none for the unsupported parse mode", len(sent))
+	}
+	if body := sent[0].body; body["text"] != "<i>&lt;b&gt;a &amp; b&lt;/b&gt;</i>" || body["parse_mode"] != "HTML" ||
+		body["message_thread_id"] != nil {
+		t.Errorf("HTML payload %v", body)
+	}
+	if body := sent[1].body; body["text"] != "<b>a & b</b>" || body["parse_mode"] != nil {
+		t.Errorf("plain payload %v", body)
+	}
+}
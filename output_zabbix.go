@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+type zabbixValue struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	Ns    int64  `json:"ns"`
+}
+
+// processed: 1; failed: 0; total: 1; seconds spent: 0.000055
+var zabbixInfoRegex = regexp.MustCompile(`processed: (\d+); failed: (\d+); total: (\d+)`)
+
+/*
+ * Values are collected for batch-time, the first message of the batch sends them all
+ */
+func outputZabbix(msg_ctx *MessageContext, out *_outZabbixConfig) {
+	now := time.Now()
+	value := zabbixValue{
+		Host:  replaceJSONPathTags(msg_ctx, out.Host, &out.tags.Host),
+		Key:   replaceJSONPathTags(msg_ctx, out.Key, &out.tags.Key),
+		Value: replaceJSONPathTags(msg_ctx, out.Value, &out.tags.Value),
+		Clock: now.Unix(),
+		Ns:    int64(now.Nanosecond()),
+	}
+	if clock := replaceJSONPathTags(msg_ctx, out.Clock, &out.tags.Clock); clock != "" {
+		if sec, err := strconv.ParseFloat(clock, 64); err == nil {
+			value.Clock = int64(sec)
+			value.Ns = int64((sec - float64(int64(sec))) * 1e9)
+		} else {
+			log.Printf("OUTPUT-ZABBIX: invalid clock %s for %s:%s", clock, value.Host, value.Key)
+		}
+	}
+
+	batch_t := time.Duration(out.BatchTime) * time.Millisecond
+	if out.BatchTime == 0 {
+		batch_t = 200 * time.Millisecond
+	}
+	batch_size := int(out.BatchSize)
+	if batch_size == 0 {
+		batch_size = 250
+	}
+
+	// the batch window does not hold a worker
+	PendingMessages.Increment()
+	values, ok := out.batch.add(value, batch_size, batch_t)
+	PendingMessages.Decrement()
+	if !ok {
+		return // sent by the first message of the batch
+	}
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	timeout := time.Duration(out.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = msg_ctx.Context.OutputTimeout
+	}
+
+	processed, failed, err := zabbixSend(out, values, timeout)
+	if err != nil {
+		log.Printf("OUTPUT-ZABBIX: failed to send %d values to %s : %s", len(values), out.Address, err)
+		return
+	}
+	if failed > 0 {
+		log.Printf("OUTPUT-ZABBIX: %s processed %d and failed %d of %d values",
+			out.Address, processed, failed, len(values))
+	}
+}
+
+/*
+ * Zabbix sender protocol: "ZBXD" 0x01 <data length: uint32 LE> <reserved: uint32> <JSON>
+ */
+func zabbixSend(out *_outZabbixConfig, values []zabbixValue, timeout time.Duration) (int, int, error) {
+	now := time.Now()
+	data, err := json.Marshal(map[string]interface{}{
+		"request": "sender data",
+		"data":    values,
+		"clock":   now.Unix(),
+		"ns":      now.Nanosecond(),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	conn, err := zabbixDial(out, timeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	packet := make([]byte, 13, 13+len(data))
+	copy(packet, "ZBXD\x01")
+	binary.LittleEndian.PutUint32(packet[5:9], uint32(len(data)))
+	packet = append(packet, data...)
+	if _, err := conn.Write(packet); err != nil {
+		return 0, 0, err
+	}
+
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, 0, fmt.Errorf("reading response: %w", err)
+	}
+	if string(header[:4]) != "ZBXD" {
+		return 0, 0, fmt.Errorf("invalid response header %q", header[:5])
+	}
+	size := binary.LittleEndian.Uint32(header[5:9])
+	if size > 1024*1024 {
+		return 0, 0, fmt.Errorf("response too long: %d bytes", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return 0, 0, fmt.Errorf("reading response: %w", err)
+	}
+
+	var resp struct {
+		Response string `json:"response"`
+		Info     string `json:"info"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return 0, 0, fmt.Errorf("invalid response %s : %w", excerpt(body, 256), err)
+	}
+	if resp.Response != "success" {
+		return 0, 0, fmt.Errorf("server responded %s: %s", resp.Response, resp.Info)
+	}
+
+	match := zabbixInfoRegex.FindStringSubmatch(resp.Info)
+	if match == nil {
+		return len(values), 0, nil
+	}
+	processed, _ := strconv.Atoi(match[1])
+	failed, _ := strconv.Atoi(match[2])
+	return processed, failed, nil
+}
+
+/*
+ * Plain TCP or certificate TLS
+ */
+func zabbixDial(out *_outZabbixConfig, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	switch out.TlsConnect {
+	case "", "unencrypted":
+		return dialer.Dial("tcp", out.Address)
+	case "cert":
+	default:
+		return nil, fmt.Errorf("unsupported tls-connect %s", out.TlsConnect)
+	}
+
+	config, err := loadTlsConfig(out.TlsCaFile, out.TlsCertFile, out.TlsKeyFile, false)
+	if err != nil {
+		return nil, err
+	}
+	config.ServerName = out.TlsServerName
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(out.Address)
+	}
+	return tls.DialWithDialer(dialer, "tcp", out.Address, config)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type zabbixRequest struct {
+	header  []byte
+	Request string        `json:"request"`
+	Data    []zabbixValue `json:"data"`
+}
+
+/*
+ * Stand-in for a Zabbix server: decodes the ZBXD requests and answers
+ * with the info of the response
+ */
+func newFakeZabbix(t *testing.T, response func(req *zabbixRequest) string) (string, func() []zabbixRequest) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var lock sync.Mutex
+	var requests []zabbixRequest
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			header := make([]byte, 13)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				conn.Close()
+				continue
+			}
+			body := make([]byte, binary.LittleEndian.Uint32(header[5:9]))
+			io.ReadFull(conn, body)
+			req := zabbixRequest{header: header}
+			if err := json.Unmarshal(body, &req); err != nil {
+				t.Errorf("invalid request %q : %s", body, err)
+			}
+			lock.Lock()
+			requests = append(requests, req)
+			lock.Unlock()
+
+			resp := []byte(response(&req))
+			packet := make([]byte, 13)
+			copy(packet, "ZBXD\x01")
+			binary.LittleEndian.PutUint32(packet[5:9], uint32(len(resp)))
+			conn.Write(append(packet, resp...))
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), func() []zabbixRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return requests
+	}
+}
+
+func zabbixSuccess(req *zabbixRequest) string {
+	return fmt.Sprintf(`{"response":"success","info":"processed: %d; failed: 0; total: %d; seconds spent: 0.000055"}`,
+		len(req.Data), len(req.Data))
+}
+
+func TestZabbixSend(t *testing.T) {
+	address, requests := newFakeZabbix(t, func(req *zabbixRequest) string {
+		return `{"response":"success","info":"processed: 1; failed: 1; total: 2; seconds spent: 0.000055"}`
+	})
+	out := &_outZabbixConfig{Address: address}
+	values := []zabbixValue{
+		{Host: "web1", Key: "disk.free", Value: "12", Clock: 1700000000, Ns: 5},
+		{Host: "web2", Key: "disk.free", Value: "a \"quoted\" value", Clock: 1700000001},
+	}
+
+	processed, failed, err := zabbixSend(out, values, time.Second)
+	if err != nil || processed != 1 || failed != 1 {
+		t.Fatalf("processed %d failed %d err %v, want 1 1", processed, failed, err)
+	}
+	req := requests()[0]
+	if string(req.header[:5]) != "ZBXD\x01" || binary.LittleEndian.Uint32(req.header[9:13]) != 0 {
+		t.Errorf("header %q, want ZBXD 0x01 and reserved 0", req.header)
+	}
+	if req.Request != "sender data" || len(req.Data) != 2 || req.Data[1] != values[1] || req.Data[0] != values[0] {
+		t.Errorf("request %+v, want the values", req)
+	}
+}
+
+func TestZabbixSendErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{"failed", `{"response":"failed","info":"host not found"}`},
+		{"invalid json", `not json`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address, _ := newFakeZabbix(t, func(*zabbixRequest) string { return test.response })
+			out := &_outZabbixConfig{Address: address}
+			if _, _, err := zabbixSend(out, []zabbixValue{{Host: "h", Key: "k"}}, time.Second); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+
+	// not a zabbix server
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+	out := &_outZabbixConfig{Address: listener.Addr().String()}
+	if _, _, err := zabbixSend(out, []zabbixValue{{Host: "h", Key: "k"}}, time.Second); err == nil {
+		t.Error("no error for an invalid response header")
+	}
+
+	out.TlsConnect = "psk"
+	if _, _, err := zabbixSend(out, []zabbixValue{{Host: "h", Key: "k"}}, time.Second); err == nil {
+		t.Error("no error for tls-connect psk")
+	}
+}
+
+/*
+ * The tag lists of an output are parsed by its first message,
+ * in the notifier the concurrent ones come after it
+ */
+func parseZabbixTags(out *_outZabbixConfig) {
+	for _, field := range []struct {
+		template string
+		tags     **[]string
+	}{{out.Host, &out.tags.Host}, {out.Key, &out.tags.Key}, {out.Value, &out.tags.Value}, {out.Clock, &out.tags.Clock}} {
+		tags := findTags(field.template)
+		*field.tags = &tags
+	}
+}
+
+func TestZabbixBatch(t *testing.T) {
+	address, requests := newFakeZabbix(t, zabbixSuccess)
+	Context := testContext()
+	out := &_outZabbixConfig{
+		Address:   address,
+		Host:      "{{$.host}}",
+		Key:       "alert[{{$.level}}]",
+		Value:     "{{$.value}}",
+		Clock:     "{{$.time}}",
+		BatchTime: 50,
+		BatchSize: 3,
+	}
+	parseZabbixTags(out)
+
+	var wg sync.WaitGroup
+	for ii := 0; ii < 4; ii++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outputZabbix(testMessage(t, Context, "alert",
+				fmt.Sprintf(`{"host":"web%d","level":"error","value":%d,"time":1700000000.25}`, ii, ii)), out)
+		}()
+		time.Sleep(2 * time.Millisecond) // the first one starts the batch
+	}
+	wg.Wait()
+
+	// 3 values in the full batch, the fourth in the next one after the batch time
+	sent := requests()
+	if len(sent) != 2 || len(sent[0].Data) != 3 || len(sent[1].Data) != 1 {
+		t.Fatalf("requests %+v, want batches of 3 and 1", sent)
+	}
+	value := sent[1].Data[0]
+	if value.Host != "web3" || value.Key != "alert[error]" || value.Value != "3" ||
+		value.Clock != 1700000000 || value.Ns != 250000000 {
+		t.Errorf("value %+v, want the resolved templates", value)
+	}
+	if PendingMessages.Get() != 0 || ActiveWorkers.Get() != 0 {
+		t.Errorf("pending %d workers %d after the batch", PendingMessages.Get(), ActiveWorkers.Get())
+	}
+}
+
+/*
+ * Messages waiting in the batch window are pending, they do not take a worker
+ */
+func TestZabbixBatchWorkers(t *testing.T) {
+	address, requests := newFakeZabbix(t, zabbixSuccess)
+	Context := testContext()
+	out := &_outZabbixConfig{Address: address, Host: "h", Key: "k", Value: "{{$.v}}", BatchTime: 100}
+	parseZabbixTags(out)
+
+	for ii := 0; ii < 3; ii++ {
+		go outputZabbix(testMessage(t, Context, "alert", fmt.Sprintf(`{"v":%d}`, ii)), out)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if PendingMessages.Get() != 1 || ActiveWorkers.Get() != 0 {
+		t.Errorf("pending %d workers %d in the batch window, want 1 0", PendingMessages.Get(), ActiveWorkers.Get())
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(requests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if sent := requests(); len(sent) != 1 || len(sent[0].Data) != 3 {
+		t.Errorf("requests %+v, want one batch of 3", sent)
+	}
+}
@@ -2,46 +2,174 @@ package main
 
 import (
 	"bytes"
-	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log"
 	"net"
 	"net/http"
-	"os/exec"
+	"net/mail"
+	"net/textproto"
+	neturl "net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 func outputEmail(msg_ctx *MessageContext, out *_outEmailConfig) {
+	if msg_ctx = collectDigest(msg_ctx, &out.Digest); msg_ctx == nil {
+		return // sent with the digest
+	}
 	ActiveWorkers.Increment()
 	defer ActiveWorkers.Decrement()
 
+	if out.tags.To == nil { // initialize tags cache for lists and Headers
+		out.tags.To = make([]*[]string, len(out.To))
+		out.tags.Cc = make([]*[]string, len(out.Cc))
+		out.tags.Bcc = make([]*[]string, len(out.Bcc))
+		out.tags.HeadersNames = sortedKeys(out.Headers)
+		out.tags.HeadersVals = make([]*[]string, len(out.Headers))
+	}
+
 	smtpHost := replaceJSONPathTags(msg_ctx, out.SmtpHost, &out.tags.SmtpHost)
 	smtpPort := replaceJSONPathTags(msg_ctx, out.SmtpPort, &out.tags.SmtpPort)
 	smtpUser := replaceJSONPathTags(msg_ctx, out.SmtpUser, &out.tags.SmtpUser)
 	smtpPass := replaceJSONPathTags(msg_ctx, out.SmtpPass, &out.tags.SmtpPass)
 
-	from := replaceJSONPathTags(msg_ctx, out.From, &out.tags.From)
-	to := replaceJSONPathTags(msg_ctx, out.To, &out.tags.To)
-
-	subject := replaceJSONPathTags(msg_ctx, out.Subject, &out.tags.Subject)
-	body := replaceJSONPathTags(msg_ctx, out.Body, &out.tags.Body)
-
-	emailBody := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
-		from, to, subject, body)
+	msg, err := resolveEmailMessage(msg_ctx, out)
+	if err != nil {
+		log.Printf("OUTPUT-EMAIL: %s", err)
+		return
+	}
+	message, err := msg.bytes()
+	if err != nil {
+		log.Printf("OUTPUT-EMAIL: failed to build message : %s", err)
+		return
+	}
 
 	timeout := time.Duration(out.Timeout) * time.Millisecond
 	if timeout == 0 {
 		timeout = msg_ctx.Context.OutputTimeout
 	}
 
-	err := sendEmail(smtpHost, smtpPort, smtpUser, smtpPass,
-		from, []string{to}, []byte(emailBody), timeout)
+	server := &smtpServer{
+		host:     smtpHost,
+		port:     smtpPort,
+		user:     smtpUser,
+		pass:     smtpPass,
+		helo:     out.Helo,
+		tls:      out.Tls || smtpPort == "465",
+		starttls: strings.ToLower(out.StartTls),
+		auth:     out.SmtpAuth,
+		caFile:   out.CaFile,
+		insecure: out.InsecureSkipVerify,
+	}
+	pool_size := 2
+	if out.PoolSize != nil {
+		pool_size = int(*out.PoolSize)
+	}
+	pool_idle := time.Duration(out.PoolIdle) * time.Millisecond
+	if pool_idle == 0 {
+		pool_idle = 10 * time.Second
+	}
+
+	err = sendEmail(&out.pool, pool_size, pool_idle, server,
+		msg.from.Address, msg.recipients(), message, timeout)
 	if err != nil {
 		log.Printf("OUTPUT-EMAIL: error sending email to %s:%s : %s",
 			smtpHost, smtpPort, err)
 	}
 }
 
+func resolveEmailMessage(msg_ctx *MessageContext, out *_outEmailConfig) (*emailMessage, error) {
+	from, err := mail.ParseAddress(replaceJSONPathTags(msg_ctx, out.From, &out.tags.From))
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %s : %w", out.From, err)
+	}
+	msg := &emailMessage{
+		from:    from,
+		subject: replaceJSONPathTags(msg_ctx, out.Subject, &out.tags.Subject),
+		text:    replaceJSONPathTags(msg_ctx, out.Body, &out.tags.Body),
+		html:    replaceJSONPathTagsEscaped(msg_ctx, out.Html, &out.tags.Html, html.EscapeString),
+	}
+
+	if msg.to, err = resolveEmailAddresses(msg_ctx, out.To, out.tags.To); err != nil {
+		return nil, err
+	}
+	if msg.cc, err = resolveEmailAddresses(msg_ctx, out.Cc, out.tags.Cc); err != nil {
+		return nil, err
+	}
+	if msg.bcc, err = resolveEmailAddresses(msg_ctx, out.Bcc, out.tags.Bcc); err != nil {
+		return nil, err
+	}
+	reply_to := replaceJSONPathTags(msg_ctx, out.ReplyTo, &out.tags.ReplyTo)
+	if msg.replyTo, err = parseEmailAddresses([]string{reply_to}); err != nil {
+		return nil, err
+	}
+	if len(msg.recipients()) == 0 {
+		return nil, fmt.Errorf("no recipients")
+	}
+
+	for ii, name := range out.tags.HeadersNames {
+		if !isHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		value := replaceJSONPathTags(msg_ctx, out.Headers[name], &out.tags.HeadersVals[ii])
+		msg.headers = append(msg.headers, [2]string{textproto.CanonicalMIMEHeaderKey(name), value})
+	}
+
+	for ii := range out.Attachments {
+		attach := &out.Attachments[ii]
+		content := replaceJSONPathTags(msg_ctx, attach.Content, &attach.tags.Content)
+		if content == "" {
+			continue // nothing to attach, e.g. no logs
+		}
+		data := []byte(content)
+		if attach.Base64 {
+			if data, err = base64.StdEncoding.DecodeString(content); err != nil {
+				return nil, fmt.Errorf("attachment %s is not base64 : %w", attach.Name, err)
+			}
+		}
+		content_type := attach.ContentType
+		if content_type == "" {
+			content_type = "text/plain; charset=utf-8"
+		}
+		name := replaceJSONPathTags(msg_ctx, attach.Name, &attach.tags.Name)
+		if name == "" {
+			name = fmt.Sprintf("attachment-%d.txt", ii+1)
+		}
+		msg.attachments = append(msg.attachments, emailAttachment{
+			name:        name,
+			contentType: content_type,
+			data:        data,
+		})
+	}
+	return msg, nil
+}
+
+func resolveEmailAddresses(msg_ctx *MessageContext, values []string, tags []*[]string) ([]*mail.Address, error) {
+	resolved := make([]string, len(values))
+	for ii := range values {
+		resolved[ii] = replaceJSONPathTags(msg_ctx, values[ii], &tags[ii])
+	}
+	return parseEmailAddresses(resolved)
+}
+
+/*
+ * RFC 5322 field name: printable ASCII without colon
+ */
+func isHeaderName(name string) bool {
+	for _, r := range name {
+		if r < 33 || r > 126 || r == ':' {
+			return false
+		}
+	}
+	return name != ""
+}
+
 func outputSocket(msg_ctx *MessageContext, out *_outSocketConfig) {
 	ActiveWorkers.Increment()
 	defer ActiveWorkers.Decrement()
@@ -75,75 +203,119 @@ func outputSocket(msg_ctx *MessageContext, out *_outSocketConfig) {
 	}
 }
 
-func outputHttp(msg_ctx *MessageContext, out *_outHttpPostConfig) {
-	ActiveWorkers.Increment()
-	defer ActiveWorkers.Decrement()
-
-	url := replaceJSONPathTags(msg_ctx, out.Url, &out.tags.Url)
-	method := replaceJSONPathTags(msg_ctx, out.Method, &out.tags.Method)
-	body := replaceJSONPathTags(msg_ctx, out.Body, &out.tags.Body)
+/*
+ * Sends JSON payload, on 429 waits as the server asks and tries again.
+ * Returns status and body of the last response, error for non-2xx status.
+ */
+func postJSON(url string, headers map[string]string, payload interface{},
+	timeout time.Duration, retries uint32) (int, []byte, error) {
 
-	req, err := http.NewRequest(method, url, bytes.NewBuffer([]byte(body)))
+	body, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("OUTPUT-HTTP: failed to create http request to %s : %s", url, err)
-		return
+		return 0, nil, err
 	}
 
-	if out.tags.HeadersKeys == nil { // initialize tags cache for Headers
-		out.tags.HeadersKeys = make([]*[]string, len(out.Headers))
-		out.tags.HeadersVals = make([]*[]string, len(out.Headers))
+	http_client := &http.Client{
+		Timeout: timeout,
 	}
-
-	for ii := range len(out.Headers) {
-		for h_k, h_v := range out.Headers[ii] {
-			h_k = replaceJSONPathTags(msg_ctx, h_k, &out.tags.HeadersKeys[ii])
-			h_v = replaceJSONPathTags(msg_ctx, h_v, &out.tags.HeadersVals[ii])
+	for attempt := uint32(0); ; attempt++ {
+		req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for h_k, h_v := range headers {
 			req.Header.Set(h_k, h_v)
 		}
-	}
 
-	timeout := time.Duration(out.Timeout) * time.Millisecond
-	if timeout == 0 {
-		timeout = msg_ctx.Context.OutputTimeout
-	}
-	http_client := &http.Client{
-		Timeout: timeout,
-	}
-	resp, err := http_client.Do(req)
-	if err != nil {
-		log.Printf("OUTPUT-HTTP: failed to send HTTP request to %s err: %s", url, err)
-		return
-	}
+		resp, err := http_client.Do(req)
+		if err != nil {
+			return 0, nil, err
+		}
+		resp_body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		if err != nil {
+			return resp.StatusCode, nil, err
+		}
 
-	// ignore reponse
-	resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < retries {
+			wait := retryAfter(resp, resp_body)
+			log.Printf("OUTPUT-HTTP: rate limited by %s, retry in %s", req.URL.Host, wait)
+			time.Sleep(wait)
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return resp.StatusCode, resp_body, fmt.Errorf("unexpected status %s: %s",
+				resp.Status, excerpt(resp_body, 256))
+		}
+		return resp.StatusCode, resp_body, nil
+	}
 }
 
-func execCommand(msg_ctx *MessageContext, exec_conf *_execCommandConfig) {
-	ActiveWorkers.Increment()
-	defer ActiveWorkers.Decrement()
+/*
+ * Delay requested by 429 response:
+ *   {"retry_after": 1.5} (Discord), {"parameters": {"retry_after": 3}} (Telegram),
+ *   Retry-After header in seconds or HTTP date
+ */
+func retryAfter(resp *http.Response, body []byte) time.Duration {
+	const max_wait = 60 * time.Second
+	wait := time.Second
 
-	if exec_conf.tags.Args == nil { // initialize tags cache for Args
-		exec_conf.tags.Args = make([]*[]string, len(exec_conf.Args))
+	var rate_limit struct {
+		RetryAfter float64 `json:"retry_after"`
+		Parameters struct {
+			RetryAfter float64 `json:"retry_after"`
+		} `json:"parameters"`
 	}
+	json.Unmarshal(body, &rate_limit)
 
-	cmd := replaceJSONPathTags(msg_ctx, exec_conf.Cmd, &exec_conf.tags.Cmd)
-	args := make([]string, len(exec_conf.Args))
-	for i := range len(exec_conf.Args) {
-		args[i] = replaceJSONPathTags(msg_ctx, exec_conf.Args[i], &exec_conf.tags.Args[i])
+	if rate_limit.RetryAfter > 0 {
+		wait = time.Duration(rate_limit.RetryAfter * float64(time.Second))
+	} else if rate_limit.Parameters.RetryAfter > 0 {
+		wait = time.Duration(rate_limit.Parameters.RetryAfter * float64(time.Second))
+	} else if header := resp.Header.Get("Retry-After"); header != "" {
+		if seconds, err := strconv.ParseFloat(header, 64); err == nil {
+			wait = time.Duration(seconds * float64(time.Second))
+		} else if date, err := http.ParseTime(header); err == nil {
+			wait = time.Until(date)
+		}
 	}
 
-	timeout := time.Duration(exec_conf.Timeout) * time.Millisecond
-	if timeout == 0 {
-		timeout = msg_ctx.Context.OutputTimeout
+	if wait <= 0 {
+		wait = time.Second
+	}
+	if wait > max_wait {
+		wait = max_wait
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return wait
+}
 
-	run := exec.CommandContext(ctx, cmd, args...)
-	output, err := run.CombinedOutput()
-	if err != nil {
-		log.Printf("EXEC: Failed to execute command \"%s\" : %s : %s\n",
-			cmd, err, string(output))
+/*
+ * Scheme and host of the url for the logs, the path and query of webhooks contain tokens
+ */
+func urlHost(raw string) string {
+	parsed, err := neturl.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		return "(invalid url)"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+/*
+ * The error without the url of the request, for the same reason
+ */
+func urlError(err error) error {
+	var url_err *neturl.Error
+	if errors.As(err, &url_err) {
+		return url_err.Err
+	}
+	return err
+}
+
+func excerpt(body []byte, size int) string {
+	text := strings.TrimSpace(string(body))
+	if len(text) > size {
+		text = text[:size] + "..."
 	}
-	cancel()
+	return text
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// docker-<id>.scope, /docker/<id>, cri-containerd-<id>.scope, libpod-<id>.scope
+var containerIdRegex = regexp.MustCompile(`[0-9a-f]{64}`)
+
+/*
+ * Reads SO_PEERCRED of unix socket connection
+ */
+func getPeerCred(conn net.Conn) (*unix.Ucred, error) {
+	unix_conn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket")
+	}
+	raw, err := unix_conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+func isPeerAllowed(in *_inSocketConfig, cred *unix.Ucred) bool {
+	uid, gid := int(cred.Uid), int(cred.Gid)
+	if slices.Contains(in.DenyUids, uid) || slices.Contains(in.DenyGids, gid) {
+		return false
+	}
+	if len(in.AllowUids) == 0 && len(in.AllowGids) == 0 {
+		return true
+	}
+	return slices.Contains(in.AllowUids, uid) || slices.Contains(in.AllowGids, gid)
+}
+
+/*
+ * Peer info available in templates as {{peer.pid}}, {{peer.uid}}, {{peer.gid}},
+ * {{peer.cgroup}} and {{peer.container}}
+ */
+func peerInfo(cred *unix.Ucred) map[string]interface{} {
+	cgroup := peerCgroup(cred.Pid)
+	return map[string]interface{}{
+		"pid":       cred.Pid,
+		"uid":       cred.Uid,
+		"gid":       cred.Gid,
+		"cgroup":    cgroup,
+		"container": containerIdRegex.FindString(cgroup),
+	}
+}
+
+/*
+ * Returns the cgroup path of a process, the unified (v2) hierarchy is preferred
+ */
+func peerCgroup(pid int32) string {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	cgroup := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			return parts[2]
+		}
+		if cgroup == "" || containerIdRegex.MatchString(parts[2]) {
+			cgroup = parts[2]
+		}
+	}
+	return cgroup
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Throttled messages of all rate limits, reported in the systemd status
+var ThrottledMessages AtomicCounter
+
+// how often the throttled count of a limit is logged
+const rateLimitLogInterval = 10 * time.Second
+
+// buckets are removed when full, so idle keys do not stay forever
+const rateLimitMaxBuckets = 10000
+
+// clock of the token buckets, replaced by the tests
+var rateNow = time.Now
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateBuckets struct {
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	throttled int64 // since the last log
+	logged    time.Time
+}
+
+/*
+ * Takes a token of the key bucket. Without a free token returns the wait
+ * for the next one and takes it in advance if the wait is up to max_wait.
+ */
+func (b *rateBuckets) reserve(key string, limit *_rateLimitConfig, max_wait time.Duration) (time.Duration, bool) {
+	interval := time.Duration(limit.Interval) * time.Millisecond
+	if limit.Interval == 0 {
+		interval = time.Second
+	}
+	rate := limit.Rate / interval.Seconds() // tokens per second
+	burst := float64(limit.Burst)
+	if limit.Burst == 0 {
+		burst = math.Max(1, math.Ceil(limit.Rate))
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	now := rateNow()
+	if b.buckets == nil {
+		b.buckets = make(map[string]*tokenBucket)
+	}
+	if len(b.buckets) >= rateLimitMaxBuckets {
+		for k, bucket := range b.buckets {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*rate >= burst {
+				delete(b.buckets, k)
+			}
+		}
+	}
+
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		b.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens -= 1
+		return 0, true
+	}
+	wait := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	if wait > max_wait {
+		return wait, false
+	}
+	bucket.tokens -= 1 // negative until the reserved token is refilled
+	return wait, true
+}
+
+/*
+ * Counts a throttled message, logged at most once per rateLimitLogInterval
+ */
+func (b *rateBuckets) throttle(level string, action string) {
+	ThrottledMessages.Increment()
+
+	b.Lock()
+	b.throttled += 1
+	if time.Since(b.logged) < rateLimitLogInterval {
+		b.Unlock()
+		return
+	}
+	throttled := b.throttled
+	b.throttled = 0
+	b.logged = time.Now()
+	b.Unlock()
+
+	log.Printf("RATE-LIMIT: %s: %d messages throttled (%s)", level, throttled, action)
+}
+
+/*
+ * Applies the limit to the message: next is called now, after the delay
+ * or not at all when the message is dropped or diverted to another method
+ */
+func rateLimit(msg_ctx *MessageContext, limit *_rateLimitConfig, level string, default_key string,
+	next func()) {
+
+	if limit == nil || limit.Rate <= 0 {
+		next()
+		return
+	}
+
+	key := default_key
+	if limit.Key != "" {
+		key = replaceJSONPathTags(msg_ctx, limit.Key, &limit.tags.Key)
+	}
+
+	max_wait := time.Duration(0)
+	if limit.Action == "delay" {
+		max_wait = time.Duration(limit.MaxDelay) * time.Millisecond
+		if limit.MaxDelay == 0 {
+			max_wait = 10 * time.Second
+		}
+	}
+	wait, ok := limit.buckets.reserve(key, limit, max_wait)
+	if ok && wait == 0 {
+		next()
+		return
+	}
+
+	switch {
+	case ok: // delay
+		limit.buckets.throttle(level, "delay")
+		PendingMessages.Increment()
+		go func() {
+			defer PendingMessages.Decrement()
+			time.Sleep(wait)
+			next()
+		}()
+	case limit.Action == "divert" && !msg_ctx.diverted:
+		limit.buckets.throttle(level, "divert to "+limit.Method)
+		divertMessage(msg_ctx, limit.Method)
+	default:
+		limit.buckets.throttle(level, "drop")
+	}
+}
+
+/*
+ * Runs the outputs of the method with a copy of the message.
+ * Diverted messages are not diverted again, they are dropped.
+ */
+func divertMessage(msg_ctx *MessageContext, method_name string) {
+	method, ok := msg_ctx.Context.Config.Methods[method_name]
+	if !ok {
+		log.Printf("RATE-LIMIT: cannot divert to method %s", method_name)
+		return
+	}
+	diverted := &MessageContext{
+		JsonRpc:        msg_ctx.JsonRpc,
+		JSONPath_Cache: make(map[string]string),
+		Peer:           msg_ctx.Peer,
+		Context:        msg_ctx.Context,
+		diverted:       true,
+	}
+	diverted.JsonRpc.Method = method_name
+	dispatchMessage(diverted, &method)
+}
+
+/*
+ * Rate limit key of the input source: address of TCP and HTTP clients,
+ * uid of unix socket peers
+ */
+func sourceKey(peer map[string]interface{}) string {
+	if address, ok := peer["address"]; ok {
+		return fmt.Sprint(address)
+	}
+	if uid, ok := peer["uid"]; ok {
+		return fmt.Sprintf("uid=%v", uid)
+	}
+	return ""
+}
+
+/*
+ * Starts the output, after its rate limit
+ */
+func runOutput[T any](msg_ctx *MessageContext, name string, limit *_rateLimitConfig, out *T,
+	output func(*MessageContext, *T)) {
+
+	rateLimit(msg_ctx, limit, "output "+name, "", func() {
+		go output(msg_ctx, out)
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * Clock of the token buckets moved only by the test
+ */
+type rateTestClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func setRateClock(t *testing.T) *rateTestClock {
+	clock := &rateTestClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rateNow = func() time.Time {
+		clock.Lock()
+		defer clock.Unlock()
+		return clock.now
+	}
+	t.Cleanup(func() { rateNow = time.Now })
+	return clock
+}
+
+func (clock *rateTestClock) advance(d time.Duration) {
+	clock.Lock()
+	clock.now = clock.now.Add(d)
+	clock.Unlock()
+}
+
+func takeTokens(b *rateBuckets, key string, limit *_rateLimitConfig, n int) int {
+	taken := 0
+	for ii := 0; ii < n; ii++ {
+		if _, ok := b.reserve(key, limit, 0); ok {
+			taken++
+		}
+	}
+	return taken
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	clock := setRateClock(t)
+	limit := &_rateLimitConfig{Rate: 2, Burst: 3}
+	b := &limit.buckets
+
+	if taken := takeTokens(b, "", limit, 5); taken != 3 {
+		t.Fatalf("%d tokens taken, want the burst of 3", taken)
+	}
+	if wait, ok := b.reserve("", limit, 0); ok || wait != 500*time.Millisecond {
+		t.Errorf("empty bucket: wait %s ok %v, want 500ms for the next token", wait, ok)
+	}
+
+	clock.advance(250 * time.Millisecond)
+	if wait, ok := b.reserve("", limit, 0); ok || wait != 250*time.Millisecond {
+		t.Errorf("half token: wait %s ok %v, want 250ms", wait, ok)
+	}
+	clock.advance(250 * time.Millisecond)
+	if taken := takeTokens(b, "", limit, 2); taken != 1 {
+		t.Errorf("%d tokens taken after 500ms, want 1", taken)
+	}
+
+	// refilled up to the burst only
+	clock.advance(time.Hour)
+	if taken := takeTokens(b, "", limit, 5); taken != 3 {
+		t.Errorf("%d tokens taken after an hour, want the burst of 3", taken)
+	}
+}
+
+func TestTokenBucketDefaults(t *testing.T) {
+	clock := setRateClock(t)
+
+	// burst is the rate, at least 1
+	limit := &_rateLimitConfig{Rate: 2.5}
+	if taken := takeTokens(&limit.buckets, "", limit, 10); taken != 3 {
+		t.Errorf("%d tokens taken, want the default burst of 3", taken)
+	}
+	limit = &_rateLimitConfig{Rate: 1, Interval: 60000}
+	if taken := takeTokens(&limit.buckets, "", limit, 10); taken != 1 {
+		t.Errorf("%d tokens taken, want the default burst of 1", taken)
+	}
+	clock.advance(30 * time.Second)
+	if wait, ok := limit.buckets.reserve("", limit, 0); ok || wait != 30*time.Second {
+		t.Errorf("wait %s ok %v, want 30s of the 60s interval", wait, ok)
+	}
+}
+
+func TestTokenBucketKeys(t *testing.T) {
+	setRateClock(t)
+	limit := &_rateLimitConfig{Rate: 1}
+
+	for _, key := range []string{"web1", "web2", "web1"} {
+		takeTokens(&limit.buckets, key, limit, 1)
+	}
+	if _, ok := limit.buckets.reserve("web3", limit, 0); !ok {
+		t.Error("new key without a token")
+	}
+	if _, ok := limit.buckets.reserve("web2", limit, 0); ok {
+		t.Error("token of web2 taken twice")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	clock := setRateClock(t)
+	limit := &_rateLimitConfig{Rate: 2, Burst: 1}
+	b := &limit.buckets
+
+	takeTokens(b, "", limit, 1)
+	// the next tokens are reserved in advance up to the max wait
+	for _, want := range []time.Duration{500 * time.Millisecond, time.Second} {
+		if wait, ok := b.reserve("", limit, time.Second); !ok || wait != want {
+			t.Errorf("reserve: wait %s ok %v, want %s", wait, ok, want)
+		}
+	}
+	if wait, ok := b.reserve("", limit, time.Second); ok || wait != 1500*time.Millisecond {
+		t.Errorf("over max wait: wait %s ok %v, want 1.5s refused", wait, ok)
+	}
+
+	clock.advance(time.Second)
+	if wait, ok := b.reserve("", limit, 0); ok || wait != 500*time.Millisecond {
+		t.Errorf("after the reserved tokens: wait %s ok %v, want 500ms", wait, ok)
+	}
+}
+
+func TestTokenBucketEviction(t *testing.T) {
+	clock := setRateClock(t)
+	limit := &_rateLimitConfig{Rate: 1}
+	b := &limit.buckets
+
+	for ii := 0; ii < rateLimitMaxBuckets; ii++ {
+		b.reserve(fmt.Sprint(ii), limit, 0)
+	}
+	clock.advance(500 * time.Millisecond)
+	b.reserve("half", limit, 0)
+	if len(b.buckets) != rateLimitMaxBuckets+1 {
+		t.Fatalf("%d buckets, want none removed before they are full", len(b.buckets))
+	}
+
+	clock.advance(600 * time.Millisecond)
+	b.reserve("full", limit, 0)
+	if len(b.buckets) != 2 {
+		t.Errorf("%d buckets, want the full ones removed", len(b.buckets))
+	}
+	if _, ok := b.buckets["half"]; !ok {
+		t.Error("not full bucket removed")
+	}
+}
+
+func TestRateLimitDrop(t *testing.T) {
+	setRateClock(t)
+	Context := testContext()
+	limit := &_rateLimitConfig{Rate: 1, Key: "{{$.host}}"}
+
+	called := 0
+	throttled := ThrottledMessages.Get()
+	for _, host := range []string{"web1", "web1", "web2"} {
+		msg_ctx := testMessage(t, Context, "alert", `{"host":"`+host+`"}`)
+		rateLimit(msg_ctx, limit, "test", "", func() { called++ })
+	}
+	if called != 2 {
+		t.Errorf("%d messages passed, want one per host", called)
+	}
+	if ThrottledMessages.Get()-throttled != 1 {
+		t.Errorf("%d throttled, want 1", ThrottledMessages.Get()-throttled)
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	setRateClock(t)
+	Context := testContext()
+	limit := &_rateLimitConfig{Rate: 100, Burst: 1, Action: "delay", MaxDelay: 15}
+
+	done := make(chan int, 3)
+	for ii := 0; ii < 3; ii++ {
+		ii := ii
+		rateLimit(testMessage(t, Context, "alert", `{}`), limit, "test", "", func() { done <- ii })
+	}
+
+	// first passes now, second waits 10ms, third would wait 20ms and is dropped
+	if got := <-done; got != 0 {
+		t.Fatalf("message %d passed first", got)
+	}
+	select {
+	case got := <-done:
+		t.Fatalf("message %d passed without the delay", got)
+	default:
+	}
+	if PendingMessages.Get() != 1 {
+		t.Errorf("%d pending messages, want the delayed one", PendingMessages.Get())
+	}
+	select {
+	case got := <-done:
+		if got != 1 {
+			t.Errorf("message %d delayed, want 1", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("delayed message not passed")
+	}
+	select {
+	case got := <-done:
+		t.Errorf("message %d passed over the max delay", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRateLimitDivert(t *testing.T) {
+	setRateClock(t)
+	server, requests := newPushServer(t)
+	Context := testContext()
+	Context.Config.Methods = map[string]_methodConfig{
+		"alert.digest": {Ntfy: []_outPushConfig{{Url: server.URL, Topic: "digest", Message: "{{$.text}}"}}},
+	}
+	limit := &_rateLimitConfig{Rate: 1, Action: "divert", Method: "alert.digest"}
+
+	called := 0
+	rateLimit(testMessage(t, Context, "alert", `{"text":"first"}`), limit, "test", "", func() { called++ })
+	rateLimit(testMessage(t, Context, "alert", `{"text":"second"}`), limit, "test", "", func() { called++ })
+
+	// diverted messages are not diverted again
+	diverted := testMessage(t, Context, "alert.digest", `{"text":"third"}`)
+	diverted.diverted = true
+	rateLimit(diverted, limit, "test", "", func() { called++ })
+
+	if called != 1 {
+		t.Errorf("%d messages passed, want 1", called)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(requests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	sent := requests()
+	if len(sent) != 1 || sent[0].body["message"] != "second" || sent[0].body["topic"] != "digest" {
+		t.Errorf("diverted %v, want the second message to the digest topic", sent)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var notifySocket string
+
+/*
+ * Takes NOTIFY_SOCKET and WATCHDOG_USEC from the environment.
+ * Returns the interval of watchdog pings, 0 if the watchdog is disabled.
+ */
+func initSdNotify() time.Duration {
+	notifySocket = os.Getenv("NOTIFY_SOCKET")
+
+	var watchdog time.Duration
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid, pid_err := strconv.Atoi(os.Getenv("WATCHDOG_PID"))
+	if err == nil && usec > 0 && (pid_err != nil || pid == os.Getpid()) {
+		watchdog = time.Duration(usec) * time.Microsecond / 2 // ping twice per interval
+	}
+
+	// don't pass them to the executed commands
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+
+	return watchdog
+}
+
+/*
+ * Sends sd_notify state like "READY=1", does nothing if not started by systemd
+ */
+func sdNotify(state string) {
+	if notifySocket == "" {
+		return
+	}
+
+	// "@" is an abstract socket, net package handles it
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: notifySocket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("SD-NOTIFY: error connecting to %s : %s", notifySocket, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("SD-NOTIFY: error sending %s : %s", state, err)
+	}
+}
+
+func sdNotifyStatus(Context *_context) {
+	sdNotify("STATUS=queue " + strconv.Itoa(len(Context.Messages)) + "/" +
+		strconv.Itoa(cap(Context.Messages)) + ", active workers " +
+		strconv.FormatInt(ActiveWorkers.Get(), 10) + ", throttled " +
+		strconv.FormatInt(ThrottledMessages.Get(), 10))
+}
+
+func sdNotifyReloading() {
+	// MONOTONIC_USEC is required by Type=notify-reload
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	sdNotify("RELOADING=1\nMONOTONIC_USEC=" + strconv.FormatInt(ts.Sec*1_000_000+ts.Nsec/1000, 10))
+}
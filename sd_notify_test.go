@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * Stand-in for the systemd notify socket, returns the next datagram
+ */
+func newNotifySocket(t *testing.T, address string) func() string {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: address, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	notifySocket = address
+	t.Cleanup(func() { notifySocket = "" })
+
+	return func() string {
+		t.Helper()
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no notification: %s", err)
+		}
+		return string(buf[:n])
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	next := newNotifySocket(t, filepath.Join(t.TempDir(), "notify"))
+
+	sdNotify("READY=1")
+	if state := next(); state != "READY=1" {
+		t.Errorf("state %q", state)
+	}
+
+	Context := testContext()
+	Context.Messages <- InputMessage{}
+	sdNotifyStatus(Context)
+	want := "STATUS=queue 1/100, active workers " + strconv.FormatInt(ActiveWorkers.Get(), 10) + ", throttled " +
+		strconv.FormatInt(ThrottledMessages.Get(), 10)
+	if state := next(); state != want {
+		t.Errorf("status %q, want %q", state, want)
+	}
+
+	sdNotifyReloading()
+	lines := strings.Split(next(), "\n")
+	if len(lines) != 2 || lines[0] != "RELOADING=1" || !strings.HasPrefix(lines[1], "MONOTONIC_USEC=") {
+		t.Fatalf("reloading %q", lines)
+	}
+	if usec, err := strconv.ParseInt(strings.TrimPrefix(lines[1], "MONOTONIC_USEC="), 10, 64); err != nil || usec <= 0 {
+		t.Errorf("MONOTONIC_USEC %q", lines[1])
+	}
+}
+
+func TestSdNotifyAbstract(t *testing.T) {
+	next := newNotifySocket(t, "@notifier-test-"+strconv.Itoa(os.Getpid()))
+	sdNotify("WATCHDOG=1")
+	if state := next(); state != "WATCHDOG=1" {
+		t.Errorf("state %q", state)
+	}
+}
+
+func TestInitSdNotify(t *testing.T) {
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"10000000", "", 5 * time.Second},
+		{"10000000", strconv.Itoa(os.Getpid()), 5 * time.Second},
+		{"10000000", strconv.Itoa(os.Getpid() + 1), 0},
+		{"0", "", 0},
+	}
+	for _, test := range tests {
+		t.Setenv("NOTIFY_SOCKET", "/run/systemd/notify")
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		if watchdog := initSdNotify(); watchdog != test.want {
+			t.Errorf("WATCHDOG_USEC=%s WATCHDOG_PID=%s: watchdog %s, want %s", test.usec, test.pid, watchdog, test.want)
+		}
+		if notifySocket != "/run/systemd/notify" || os.Getenv("NOTIFY_SOCKET") != "" || os.Getenv("WATCHDOG_USEC") != "" {
+			t.Error("environment passed to the commands")
+		}
+	}
+	notifySocket = ""
+
+	// not started by systemd
+	sdNotify("READY=1")
+}
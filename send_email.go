@@ -2,81 +2,369 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
+type smtpServer struct {
+	host     string
+	port     string
+	user     string
+	pass     string
+	helo     string
+	tls      bool   // implicit TLS, SMTPS
+	starttls string // required, opportunistic or off
+	auth     string // plain, login, cram-md5 or xoauth2, default by the server extensions
+	caFile   string
+	insecure bool
+}
+
+func (server *smtpServer) key() string {
+	return server.host + ":" + server.port + "/" + server.user
+}
+
+type smtpSession struct {
+	c     *smtp.Client
+	conn  net.Conn
+	timer *time.Timer // closes the session when idle
+}
+
 /*
- * Timeout version of net/smtp SendMail()
+ * Idle sessions of an output by server, so bursts are sent over the same session
  */
-func sendEmail(smtpHost, smtpPort, smtpUser, smtpPass,
+type smtpPool struct {
+	sync.Mutex
+	idle   map[string][]*smtpSession
+	closed bool // by config reload, the sessions of the messages in flight are not kept
+}
+
+/*
+ * Timeout version of net/smtp SendMail() with pooled sessions
+ */
+func sendEmail(pool *smtpPool, pool_size int, pool_idle time.Duration, server *smtpServer,
 	from string, to []string, message []byte, timeout time.Duration) error {
 
+	// A pooled session may be closed by the server, then a new one is dialed
+	session := pool.get(server.key())
+	if session != nil {
+		session.conn.SetDeadline(time.Now().Add(timeout))
+		if err := session.c.Reset(); err != nil {
+			session.conn.Close()
+			session = nil
+		}
+	}
+	if session == nil {
+		var err error
+		if session, err = dialSmtp(server, timeout); err != nil {
+			return err
+		}
+	}
+
+	session.conn.SetDeadline(time.Now().Add(timeout))
+	if err := smtpTransaction(session.c, from, to, message); err != nil {
+		session.conn.Close()
+		return err
+	}
+	pool.put(server.key(), session, pool_size, pool_idle)
+	return nil
+}
+
+func smtpTransaction(c *smtp.Client, from string, to []string, message []byte) error {
+	// MAIL FROM
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	// MAIL TO
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+
+	// Send the email body.
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(message); err != nil {
+		return err
+	}
+	return wc.Close()
+}
+
+/*
+ * Connects, says EHLO, upgrades with STARTTLS by the policy and authenticates
+ */
+func dialSmtp(server *smtpServer, timeout time.Duration) (*smtpSession, error) {
+	tls_config, err := loadTlsConfig(server.caFile, "", "", server.insecure)
+	if err != nil {
+		return nil, err
+	}
+	tls_config.ServerName = server.host
+
 	// Setup a dialer with a timeout.
 	dialer := &net.Dialer{
 		Timeout:   timeout,
-		Deadline:  time.Now().Add(timeout),
 		KeepAlive: timeout,
 	}
+	address := net.JoinHostPort(server.host, server.port)
+	var conn net.Conn
+	if server.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tls_config)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
 
-	conn, err := dialer.Dial("tcp", smtpHost+":"+smtpPort)
+	session, err := smtpHandshake(conn, server, tls_config)
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
 	}
-	defer conn.Close()
+	return session, nil
+}
 
-	c, err := smtp.NewClient(conn, smtpHost)
+func smtpHandshake(conn net.Conn, server *smtpServer, tls_config *tls.Config) (*smtpSession, error) {
+	c, err := smtp.NewClient(conn, server.host)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer c.Close()
 
 	// EHLO/HELO
-	if err = c.Hello("localhost"); err != nil {
-		return err
+	helo := server.helo
+	if helo == "" {
+		helo = smtpHelo
+	}
+	if err = c.Hello(helo); err != nil {
+		return nil, err
 	}
 
 	// STARTTLS
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := &tls.Config{ServerName: smtpHost}
-		if err = c.StartTLS(config); err != nil {
-			return err
+	if !server.tls {
+		ok, _ := c.Extension("STARTTLS")
+		switch server.starttls {
+		case "off":
+		case "required":
+			if !ok {
+				return nil, errors.New("server does not offer STARTTLS")
+			}
+			fallthrough
+		case "", "opportunistic":
+			if ok {
+				if err = c.StartTLS(tls_config); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown starttls policy %s", server.starttls)
 		}
 	}
 
 	// AUTH
-	if smtpUser != "" && smtpPass != "" {
-		if ok, _ := c.Extension("AUTH"); ok {
-			auth := smtp.PlainAuth("", smtpUser, smtpPass, smtpHost)
-			if err := c.Auth(auth); err != nil {
-				return err
+	if server.user != "" || server.pass != "" {
+		ok, mechanisms := c.Extension("AUTH")
+		if !ok {
+			return nil, errors.New("server does not support AUTH")
+		}
+		auth, err := smtpAuth(server, mechanisms)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.Auth(auth); err != nil {
+			return nil, err
+		}
+	}
+
+	return &smtpSession{c: c, conn: conn}, nil
+}
+
+var smtpHelo = func() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "localhost"
+	}
+	return hostname
+}()
+
+/*
+ * The configured mechanism or the first of PLAIN, LOGIN and CRAM-MD5 the server supports
+ */
+func smtpAuth(server *smtpServer, mechanisms string) (smtp.Auth, error) {
+	auth := strings.ToLower(server.auth)
+	if auth == "" {
+		supported := strings.Fields(strings.ToLower(mechanisms))
+		for _, mechanism := range []string{"plain", "login", "cram-md5"} {
+			if slices.Contains(supported, mechanism) {
+				auth = mechanism
+				break
 			}
 		}
+		if auth == "" {
+			return nil, fmt.Errorf("no supported AUTH mechanism in %s", mechanisms)
+		}
 	}
 
-	// MAIL FROM
-	if err := c.Mail(from); err != nil {
-		return err
+	switch auth {
+	case "plain":
+		return smtp.PlainAuth("", server.user, server.pass, server.host), nil
+	case "login":
+		return &smtpLoginAuth{user: server.user, pass: server.pass, host: server.host}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(server.user, server.pass), nil
+	case "xoauth2":
+		return &smtpXOAuth2{user: server.user, token: server.pass, host: server.host}, nil
 	}
-	// MAIL TO
-	for _, addr := range to {
-		if err := c.Rcpt(addr); err != nil {
-			return err
+	return nil, fmt.Errorf("unknown auth mechanism %s", server.auth)
+}
+
+/*
+ * Credentials are sent only over TLS or to localhost, as smtp.PlainAuth does
+ */
+func smtpCheckServer(server *smtp.ServerInfo, host string) error {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return errors.New("unencrypted connection")
+	}
+	if server.Name != host {
+		return errors.New("wrong host name")
+	}
+	return nil
+}
+
+type smtpLoginAuth struct {
+	user, pass, host string
+}
+
+func (a *smtpLoginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := smtpCheckServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *smtpLoginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	challenge := strings.ToLower(string(fromServer))
+	switch {
+	case strings.Contains(challenge, "user"):
+		return []byte(a.user), nil
+	case strings.Contains(challenge, "pass"):
+		return []byte(a.pass), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+/*
+ * OAuth 2.0 access token as password, e.g. for Gmail and Microsoft 365
+ */
+type smtpXOAuth2 struct {
+	user, token, host string
+}
+
+func (a *smtpXOAuth2) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if err := smtpCheckServer(server, a.host); err != nil {
+		return "", nil, err
+	}
+	return "XOAUTH2", []byte("user=" + a.user + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+func (a *smtpXOAuth2) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// JSON error details, the empty response gets the final error
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+func (pool *smtpPool) get(key string) *smtpSession {
+	pool.Lock()
+	defer pool.Unlock()
+	for {
+		sessions := pool.idle[key]
+		if len(sessions) == 0 {
+			return nil
 		}
+		session := sessions[len(sessions)-1]
+		pool.idle[key] = sessions[:len(sessions)-1]
+		if session.timer.Stop() {
+			return session
+		}
+		// the idle timer is closing it
 	}
+}
 
-	// Send the email body.
-	wc, err := c.Data()
-	if err != nil {
-		return err
+func (pool *smtpPool) put(key string, session *smtpSession, size int, idle time.Duration) {
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.closed || len(pool.idle[key]) >= size {
+		go smtpQuit(session)
+		return
 	}
-	if _, err := wc.Write(message); err != nil {
-		return err
+	if pool.idle == nil {
+		pool.idle = make(map[string][]*smtpSession)
 	}
-	if err := wc.Close(); err != nil {
-		return err
+	session.timer = time.AfterFunc(idle, func() {
+		pool.Lock()
+		sessions := pool.idle[key]
+		for ii := range sessions {
+			if sessions[ii] == session {
+				pool.idle[key] = append(sessions[:ii], sessions[ii+1:]...)
+				break
+			}
+		}
+		pool.Unlock()
+		smtpQuit(session)
+	})
+	pool.idle[key] = append(pool.idle[key], session)
+}
+
+/*
+ * Quits the idle sessions, the next ones are not kept
+ */
+func (pool *smtpPool) close() {
+	pool.Lock()
+	var sessions []*smtpSession
+	for _, idle := range pool.idle {
+		for _, session := range idle {
+			if session.timer.Stop() {
+				sessions = append(sessions, session)
+			}
+		}
+	}
+	pool.idle = nil
+	pool.closed = true
+	pool.Unlock()
+
+	for _, session := range sessions {
+		go smtpQuit(session)
+	}
+}
+
+/*
+ * Closes the SMTP sessions of the methods on config reload,
+ * so the new config does not use the servers and credentials of the old one
+ */
+func closeEmailOutputs(Context *_context) {
+	for _, method := range Context.Config.Methods {
+		for i := range method.Email {
+			method.Email[i].pool.close()
+		}
 	}
+}
 
-	return c.Quit()
+func smtpQuit(session *smtpSession) {
+	session.conn.SetDeadline(time.Now().Add(time.Second))
+	session.c.Quit()
+	session.conn.Close()
 }
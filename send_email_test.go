@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * Self-signed certificate of 127.0.0.1, the PEM file is the CA of the clients
+ */
+func testCertificate(t *testing.T) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "notifier test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca_file := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, ca_file
+}
+
+type fakeSmtpSession struct {
+	tls      bool
+	auth     string // mechanism and credentials
+	commands []string
+	messages []string
+}
+
+/*
+ * Stand-in for an SMTP server with the extensions of the EHLO reply,
+ * STARTTLS and the PLAIN, LOGIN, CRAM-MD5 and XOAUTH2 mechanisms
+ */
+type fakeSmtp struct {
+	address    string
+	caFile     string
+	extensions []string
+	password   string // of CRAM-MD5
+
+	lock     sync.Mutex
+	sessions []*fakeSmtpSession
+}
+
+func newFakeSmtp(t *testing.T, implicit_tls bool, extensions ...string) *fakeSmtp {
+	cert, ca_file := testCertificate(t)
+	tls_config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	var listener net.Listener
+	var err error
+	if implicit_tls {
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", tls_config)
+	} else {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &fakeSmtp{address: listener.Addr().String(), caFile: ca_file, extensions: extensions, password: "secret"}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			session := &fakeSmtpSession{tls: implicit_tls}
+			server.lock.Lock()
+			server.sessions = append(server.sessions, session)
+			server.lock.Unlock()
+			go server.serve(conn, session, tls_config)
+		}
+	}()
+	return server
+}
+
+func (server *fakeSmtp) serve(conn net.Conn, session *fakeSmtpSession, tls_config *tls.Config) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		conn.Write([]byte(strings.Join(lines, "\r\n") + "\r\n"))
+	}
+	read := func() string {
+		line, _ := reader.ReadString('\n')
+		return strings.TrimRight(line, "\r\n")
+	}
+	decode := func(value string) string {
+		data, _ := base64.StdEncoding.DecodeString(value)
+		return string(data)
+	}
+
+	reply("220 fake ESMTP")
+	for {
+		line := read()
+		if line == "" {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+		command = strings.ToUpper(command)
+		server.lock.Lock()
+		session.commands = append(session.commands, command)
+		server.lock.Unlock()
+
+		switch command {
+		case "EHLO":
+			lines := []string{"250-fake"}
+			for _, extension := range server.extensions {
+				if extension != "STARTTLS" || !session.tls {
+					lines = append(lines, "250-"+extension)
+				}
+			}
+			reply(append(lines, "250 8BITMIME")...)
+		case "STARTTLS":
+			reply("220 ready")
+			tls_conn := tls.Server(conn, tls_config)
+			if err := tls_conn.Handshake(); err != nil {
+				return
+			}
+			conn, reader = tls_conn, bufio.NewReader(tls_conn)
+			server.lock.Lock()
+			session.tls = true
+			server.lock.Unlock()
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			auth := ""
+			switch mechanism {
+			case "PLAIN", "XOAUTH2":
+				auth = mechanism + " " + decode(initial)
+			case "LOGIN":
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user := decode(read())
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				auth = "LOGIN " + user + " " + decode(read())
+			case "CRAM-MD5":
+				challenge := "<1.1@fake>"
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte(challenge)))
+				user, digest, _ := strings.Cut(decode(read()), " ")
+				mac := hmac.New(md5.New, []byte(server.password))
+				mac.Write([]byte(challenge))
+				if digest != hex.EncodeToString(mac.Sum(nil)) {
+					reply("535 invalid credentials")
+					continue
+				}
+				auth = "CRAM-MD5 " + user
+			}
+			server.lock.Lock()
+			session.auth = auth
+			server.lock.Unlock()
+			reply("235 authenticated")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for line := read(); line != "."; line = read() {
+				data.WriteString(line + "\n")
+			}
+			server.lock.Lock()
+			session.messages = append(session.messages, data.String())
+			server.lock.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default: // MAIL, RCPT, RSET, NOOP
+			reply("250 ok")
+		}
+	}
+}
+
+func (server *fakeSmtp) getSessions() []fakeSmtpSession {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	sessions := make([]fakeSmtpSession, len(server.sessions))
+	for ii := range server.sessions {
+		sessions[ii] = *server.sessions[ii]
+	}
+	return sessions
+}
+
+func (server *fakeSmtp) config() *smtpServer {
+	host, port, _ := net.SplitHostPort(server.address)
+	return &smtpServer{host: host, port: port, caFile: server.caFile, helo: "notifier.test"}
+}
+
+func TestSmtpStartTlsPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		offered  bool
+		starttls string
+		tls      bool
+		err      string
+	}{
+		{"default", true, "", true, ""},
+		{"opportunistic without", false, "opportunistic", false, ""},
+		{"required", true, "required", true, ""},
+		{"required without", false, "required", false, "does not offer STARTTLS"},
+		{"off", true, "off", false, ""},
+		{"unknown", true, "always", false, "unknown starttls policy"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var extensions []string
+			if test.offered {
+				extensions = append(extensions, "STARTTLS")
+			}
+			fake := newFakeSmtp(t, false, extensions...)
+			server := fake.config()
+			server.starttls = test.starttls
+
+			session, err := dialSmtp(server, time.Second)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			smtpQuit(session)
+			if sessions := fake.getSessions(); len(sessions) != 1 || sessions[0].tls != test.tls {
+				t.Errorf("sessions %+v, want tls %v", sessions, test.tls)
+			}
+		})
+	}
+}
+
+func TestSmtpTlsVerify(t *testing.T) {
+	// implicit TLS with the CA of the server
+	fake := newFakeSmtp(t, true)
+	server := fake.config()
+	server.tls = true
+	session, err := dialSmtp(server, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smtpQuit(session)
+
+	// the certificate is verified on STARTTLS too
+	fake = newFakeSmtp(t, false, "STARTTLS")
+	server = fake.config()
+	server.caFile = ""
+	if _, err := dialSmtp(server, time.Second); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("error %v, want the unknown authority", err)
+	}
+	server.insecure = true
+	session, err = dialSmtp(server, time.Second)
+	if err != nil {
+		t.Fatalf("insecure-skip-verify: %s", err)
+	}
+	smtpQuit(session)
+}
+
+func TestSmtpAuth(t *testing.T) {
+	tests := []struct {
+		name      string
+		mechanism string
+		offered   string
+		want      string
+	}{
+		{"first supported", "", "AUTH GSSAPI LOGIN PLAIN", "PLAIN \x00bob\x00secret"},
+		{"login", "", "AUTH LOGIN CRAM-MD5", "LOGIN bob secret"},
+		{"configured", "cram-md5", "AUTH PLAIN CRAM-MD5", "CRAM-MD5 bob"},
+		{"xoauth2", "XOAUTH2", "AUTH XOAUTH2", "XOAUTH2 user=bob\x01auth=Bearer secret\x01\x01"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeSmtp(t, false, "STARTTLS", test.offered)
+			server := fake.config()
+			server.user, server.pass, server.auth = "bob", "secret", test.mechanism
+
+			session, err := dialSmtp(server, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			smtpQuit(session)
+			if sessions := fake.getSessions(); len(sessions) != 1 || sessions[0].auth != test.want {
+				t.Errorf("auth %q, want %q", sessions[0].auth, test.want)
+			}
+		})
+	}
+
+	for offered, want := range map[string]string{
+		"":            "does not support AUTH",
+		"AUTH GSSAPI": "no supported AUTH mechanism",
+	} {
+		fake := newFakeSmtp(t, false, "STARTTLS", offered)
+		server := fake.config()
+		server.user, server.pass = "bob", "secret"
+		if _, err := dialSmtp(server, time.Second); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("offered %q: error %v, want %q", offered, err, want)
+		}
+	}
+}
+
+/*
+ * Credentials are not sent over plain connections to other hosts
+ */
+func TestSmtpCheckServer(t *testing.T) {
+	tests := []struct {
+		info smtp.ServerInfo
+		ok   bool
+	}{
+		{smtp.ServerInfo{Name: "mail.example.com", TLS: true}, true},
+		{smtp.ServerInfo{Name: "mail.example.com"}, false},
+		{smtp.ServerInfo{Name: "localhost"}, true},
+		{smtp.ServerInfo{Name: "other.example.com", TLS: true}, false},
+	}
+	for _, test := range tests {
+		host := "mail.example.com"
+		if test.info.Name == "localhost" {
+			host = "localhost"
+		}
+		for _, auth := range []smtp.Auth{&smtpLoginAuth{host: host}, &smtpXOAuth2{host: host}} {
+			if _, _, err := auth.Start(&test.info); (err == nil) != test.ok {
+				t.Errorf("%T to %+v: error %v, want ok %v", auth, test.info, err, test.ok)
+			}
+		}
+	}
+}
+
+func TestSmtpPool(t *testing.T) {
+	fake := newFakeSmtp(t, false, "STARTTLS", "AUTH PLAIN")
+	server := fake.config()
+	server.user, server.pass = "bob", "secret"
+	var pool smtpPool
+
+	for _, subject := range []string{"first", "second"} {
+		err := sendEmail(&pool, 2, time.Minute, server, "notifier@example.com", []string{"ops@example.com"},
+			[]byte("Subject: "+subject+"\r\n\r\nbody\r\n"), time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sessions := fake.getSessions()
+	if len(sessions) != 1 || len(sessions[0].messages) != 2 || !strings.HasPrefix(sessions[0].messages[1], "Subject: second") {
+		t.Fatalf("sessions %+v, want both messages over one session", sessions)
+	}
+	if commands := strings.Join(sessions[0].commands, " "); commands !=
+		"EHLO STARTTLS EHLO AUTH MAIL RCPT DATA RSET MAIL RCPT DATA" {
+		t.Errorf("commands %s", commands)
+	}
+
+	// on reload the idle session quits, the next one is not kept
+	pool.close()
+	sendEmail(&pool, 2, time.Minute, server, "notifier@example.com", []string{"ops@example.com"},
+		[]byte("Subject: third\r\n\r\nbody\r\n"), time.Second)
+	deadline := time.Now().Add(time.Second)
+	for {
+		sessions = fake.getSessions()
+		quit := 0
+		for _, session := range sessions {
+			if len(session.commands) > 0 && session.commands[len(session.commands)-1] == "QUIT" {
+				quit++
+			}
+		}
+		if quit == 2 || time.Now().After(deadline) {
+			if len(sessions) != 2 || quit != 2 {
+				t.Errorf("%d sessions %d quit, want 2 closed after the reload", len(sessions), quit)
+			}
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSmtpPoolIdle(t *testing.T) {
+	fake := newFakeSmtp(t, false)
+	server := fake.config()
+	var pool smtpPool
+
+	send := func() {
+		t.Helper()
+		if err := sendEmail(&pool, 1, 20*time.Millisecond, server, "a@example.com", []string{"b@example.com"},
+			[]byte("\r\nbody\r\n"), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send()
+	time.Sleep(60 * time.Millisecond)
+	send()
+	if sessions := fake.getSessions(); len(sessions) != 2 || sessions[0].commands[len(sessions[0].commands)-1] != "QUIT" {
+		t.Errorf("sessions %+v, want the idle one quit", sessions)
+	}
+}
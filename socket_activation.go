@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const listenFdsStart = 3
+
+type activatedSocket struct {
+	name string
+	file *os.File
+}
+
+// Sockets passed by systemd, kept open for the whole life of the process,
+// so connections are queued by the kernel while inputs restart on reload
+var activatedSockets []activatedSocket
+
+/*
+ * Collects the sockets passed by systemd with LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+ */
+func initSocketActivation() {
+	defer func() {
+		// don't pass them to the executed commands
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	for ii := range nfds {
+		fd := listenFdsStart + ii
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if ii < len(names) && names[ii] != "" {
+			name = names[ii]
+		}
+		activatedSockets = append(activatedSockets, activatedSocket{
+			name: name,
+			file: os.NewFile(uintptr(fd), name),
+		})
+		log.Printf("Socket activation: received fd %d with name %s", fd, name)
+	}
+}
+
+/*
+ * Returns a listener on the inherited socket matching the input by name,
+ * or by address if the input has no name
+ */
+func activatedListener(name, network, address string) (net.Listener, bool) {
+	for _, sock := range activatedSockets {
+		if name != "" && sock.name != name {
+			continue
+		}
+
+		// FileListener works on a dup, closing it keeps the inherited socket
+		l, err := net.FileListener(sock.file)
+		if err != nil {
+			log.Printf("Socket activation: fd %s is not a listening socket: %s", sock.name, err)
+			continue
+		}
+		if name == "" && !sameListenAddress(l.Addr(), network, address) {
+			l.Close()
+			continue
+		}
+		return l, true
+	}
+	if name != "" {
+		log.Printf("Socket activation: no socket with name %s, listening on %s:%s", name, network, address)
+	} else if len(activatedSockets) > 0 {
+		log.Printf("Socket activation: no socket with address %s:%s, listening on it", network, address)
+	}
+	return nil, false
+}
+
+/*
+ * Compares the resolved addresses, so localhost:8080 is 127.0.0.1:8080
+ * and :8080 is [::]:8080 of a systemd socket
+ */
+func sameListenAddress(addr net.Addr, network, address string) bool {
+	if addr.Network() != network {
+		return false
+	}
+	if network == "unix" {
+		return filepath.Clean(addr.String()) == filepath.Clean(address)
+	}
+
+	tcp_addr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if port_num, err := net.LookupPort(network, port); err != nil || port_num != tcp_addr.Port {
+		return false
+	}
+	if host == "" || net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified() {
+		return tcp_addr.IP.IsUnspecified()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ip.Equal(tcp_addr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// the test binary started with a socket as systemd does answers one connection on it
+const activationProbeEnv = "NOTIFIER_TEST_ACTIVATION_PROBE"
+
+func runActivationProbe(name string) {
+	initSocketActivation()
+	l, ok := activatedListener(name, "tcp", "")
+	if !ok {
+		os.Exit(2)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		os.Exit(3)
+	}
+	fmt.Fprintf(conn, "%s fds=%q", activatedSockets[0].name, os.Getenv("LISTEN_FDS"))
+	conn.Close()
+	os.Exit(0)
+}
+
+/*
+ * Inherited sockets of the test, the listeners are closed on cleanup
+ */
+func setActivatedSockets(t *testing.T, names []string, listeners ...net.Listener) {
+	t.Helper()
+	activatedSockets = nil
+	for ii, l := range listeners {
+		file, err := l.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		activatedSockets = append(activatedSockets, activatedSocket{name: names[ii], file: file})
+		l.Close()
+	}
+	t.Cleanup(func() {
+		for _, sock := range activatedSockets {
+			sock.file.Close()
+		}
+		activatedSockets = nil
+	})
+}
+
+func TestActivatedListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(tcp.Addr().(*net.TCPAddr).Port)
+	unix_path := filepath.Join(t.TempDir(), "notifier.sock")
+	unix_l, err := net.Listen("unix", unix_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix_l.(*net.UnixListener).SetUnlinkOnClose(false)
+	setActivatedSockets(t, []string{"notifier-http", "notifier"}, tcp, unix_l)
+
+	tests := []struct {
+		name, network, address string
+		want                   string // address of the listener, "" for none
+	}{
+		{"notifier", "unix", "/other.sock", unix_path},
+		{"", "tcp", "localhost:" + port, "127.0.0.1:" + port},
+		{"", "unix", unix_path + "/../notifier.sock", unix_path},
+		{"", "tcp", "127.0.0.1:1", ""},
+		{"", "tcp", ":" + port, ""},
+		{"missing", "tcp", "127.0.0.1:" + port, ""},
+	}
+	for _, test := range tests {
+		l, ok := activatedListener(test.name, test.network, test.address)
+		got := ""
+		if ok {
+			got = l.Addr().String()
+			l.Close()
+		}
+		if got != test.want {
+			t.Errorf("%s %s:%s: listener %q, want %q", test.name, test.network, test.address, got, test.want)
+		}
+	}
+
+	// closing the listeners keeps the inherited sockets
+	l, ok := activatedListener("notifier-http", "tcp", "")
+	if !ok {
+		t.Fatal("inherited socket closed")
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if data, _ := io.ReadAll(conn); string(data) != "ok" {
+		t.Errorf("response %q from the inherited socket", data)
+	}
+}
+
+func TestSocketActivation(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	// LISTEN_PID is the pid of the shell, exec keeps it
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" -test.run=^$`, os.Args[0])
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_FDNAMES=notifier-http",
+		activationProbeEnv+"=notifier-http", "GORACE=atexit_sleep_ms=0")
+	cmd.ExtraFiles = []*os.File{file}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer cmd.Process.Kill()
+
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, _ := io.ReadAll(conn)
+	if string(data) != `notifier-http fds=""` {
+		t.Errorf("response %q, want the named socket and LISTEN_FDS unset", data)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("probe: %s", err)
+	}
+}
+
+func TestSocketActivationOtherPid(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	activatedSockets = nil
+	initSocketActivation()
+	if len(activatedSockets) != 0 || os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("%d sockets of another process", len(activatedSockets))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"strconv"
+)
+
+/*
+ * JSON decoded value, or the text if it is not JSON
+ */
+func jsonOrString(data []byte) interface{} {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err == nil {
+		return value
+	}
+	return string(data)
+}
+
+/*
+ * Runs the steps of the method in order. The result of a step is available to the next ones
+ * as {{steps.<name>.*}}: http has status, headers and body, exec has stdout, stderr and exit_code,
+ * both have ok. A failed step stops the chain, unless on-failure continues or goes to another step.
+ */
+func runSteps(msg_ctx *MessageContext, method *_methodConfig) {
+	ActiveWorkers.Increment()
+	defer ActiveWorkers.Decrement()
+
+	// own message, so the outputs of the method do not see the steps
+	steps_ctx := &MessageContext{
+		JsonRpc:        msg_ctx.JsonRpc,
+		JSONPath_Cache: make(map[string]string),
+		Peer:           msg_ctx.Peer,
+		Steps:          map[string]interface{}{},
+		Context:        msg_ctx.Context,
+	}
+
+	// a chain going back to previous steps, e.g. to retry, is limited
+	max_runs := 10 * len(method.Steps)
+	for ii, runs := 0, 0; ii < len(method.Steps); runs++ {
+		step := &method.Steps[ii]
+		if runs >= max_runs {
+			log.Printf("STEPS: %s: stopped after %d steps", msg_ctx.JsonRpc.Method, runs)
+			return
+		}
+
+		result, ok := runStep(steps_ctx, step)
+		if step.Name != "" {
+			result["ok"] = ok
+			steps_ctx.Steps[step.Name] = result
+			steps_ctx.JSONPath_Cache = make(map[string]string) // a step may run again
+		}
+
+		next := step.OnSuccess
+		if !ok {
+			next = step.OnFailure
+			if next == "" {
+				next = "stop"
+			}
+			log.Printf("STEPS: %s: step %s failed, next: %s", msg_ctx.JsonRpc.Method, stepName(step, ii), next)
+		}
+		switch next {
+		case "", "continue":
+			ii++
+		case "stop":
+			return
+		default:
+			ii = findStep(method.Steps, next)
+			if ii < 0 {
+				log.Printf("STEPS: %s: unknown step %s", msg_ctx.JsonRpc.Method, next)
+				return
+			}
+		}
+	}
+}
+
+func runStep(steps_ctx *MessageContext, step *_stepConfig) (map[string]interface{}, bool) {
+	switch {
+	case step.Http != nil:
+		// failed with expect-status and expect-body, the response is kept
+		result, err := httpRequest(steps_ctx, step.Http, true)
+		if err != nil {
+			log.Printf("STEPS: %s", err)
+			if result == nil {
+				result = map[string]interface{}{}
+			}
+			result["error"] = err.Error()
+		}
+		return result, err == nil
+
+	case step.Exec != nil:
+		result, ok := runCommand(steps_ctx, step.Exec)
+		if result == nil {
+			result = map[string]interface{}{}
+		}
+		return result, ok
+
+	case step.Method != "":
+		if _, ok := steps_ctx.Context.Config.Methods[step.Method]; !ok {
+			log.Printf("STEPS: unknown method %s", step.Method)
+			return map[string]interface{}{}, false
+		}
+		// the outputs run in the background with the results of the steps so far,
+		// after the rate limit and dedup of the method
+		method_ctx := &MessageContext{
+			JsonRpc:        steps_ctx.JsonRpc,
+			JSONPath_Cache: make(map[string]string),
+			Peer:           steps_ctx.Peer,
+			Steps:          maps.Clone(steps_ctx.Steps),
+			Context:        steps_ctx.Context,
+		}
+		method_ctx.JsonRpc.Method = step.Method
+		routeMessage(method_ctx)
+		return map[string]interface{}{}, true
+	}
+
+	log.Printf("STEPS: step %s has no http, exec or method", step.Name)
+	return map[string]interface{}{}, false
+}
+
+func findStep(steps []_stepConfig, name string) int {
+	for ii := range steps {
+		if steps[ii].Name == name {
+			return ii
+		}
+	}
+	return -1
+}
+
+func stepName(step *_stepConfig, ii int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return "#" + strconv.Itoa(ii+1)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * Ticket API: /fail answers 500, others the ticket id
+ */
+func newStepsServer(t *testing.T) (*httptest.Server, func() []string) {
+	var lock sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		paths = append(paths, r.URL.Path)
+		lock.Unlock()
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Request-Id", "req-1")
+		w.Write([]byte(`{"id":42}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, paths...)
+	}
+}
+
+func TestStepsChain(t *testing.T) {
+	api, paths := newStepsServer(t)
+	push, requests := newPushServer(t)
+	Context := testContext()
+	Context.Config.Methods = map[string]_methodConfig{
+		"ticket": {Ntfy: []_outPushConfig{{Url: push.URL, Topic: "tickets",
+			Message: "{{$.host}} ticket={{steps.fallback.body.id}} echo={{steps.echo.stdout}} " +
+				"primary={{steps.primary.ok}} request={{steps.fallback.headers[\"X-Request-Id\"]}}"}}},
+		"unreached": {Ntfy: []_outPushConfig{{Url: push.URL, Topic: "unreached", Message: "x"}}},
+	}
+	method := &_methodConfig{Steps: []_stepConfig{
+		{Name: "primary", Http: &_outHttpConfig{Url: api.URL + "/fail"}, OnFailure: "fallback"},
+		{Method: "unreached", OnSuccess: "stop"},
+		{Name: "fallback", Http: &_outHttpConfig{Url: api.URL + "/tickets", Method: "POST"}},
+		{Name: "echo", Exec: &_execCommandConfig{Cmd: "echo", Args: []string{"{{steps.fallback.body.id}}"}}},
+		{Method: "ticket"},
+	}}
+
+	runSteps(testMessage(t, Context, "alert", `{"host":"web1"}`), method)
+
+	if got := paths(); len(got) != 2 || got[0] != "/fail" || got[1] != "/tickets" {
+		t.Errorf("requests %v, want the failed one and the fallback", got)
+	}
+	sent := waitPushRequests(t, requests, 1)
+	want := `web1 ticket=42 echo=42 primary=false request=req-1`
+	if sent[0].body["topic"] != "tickets" || sent[0].body["message"] != want {
+		t.Errorf("message %v, want %q", sent[0].body, want)
+	}
+}
+
+func TestStepsStop(t *testing.T) {
+	api, paths := newStepsServer(t)
+	push, requests := newPushServer(t)
+	Context := testContext()
+	Context.Config.Methods = map[string]_methodConfig{
+		"ticket": {Ntfy: []_outPushConfig{{Url: push.URL, Topic: "tickets", Message: "x"}}},
+	}
+	// a failed step stops the chain by default
+	method := &_methodConfig{Steps: []_stepConfig{
+		{Name: "check", Exec: &_execCommandConfig{Cmd: "false"}},
+		{Method: "ticket"},
+	}}
+	runSteps(testMessage(t, Context, "alert", `{}`), method)
+	noPushRequests(t, requests)
+
+	// going back to a step is limited
+	method = &_methodConfig{Steps: []_stepConfig{
+		{Name: "retry", Http: &_outHttpConfig{Url: api.URL + "/fail"}, OnFailure: "retry"},
+	}}
+	runSteps(testMessage(t, Context, "alert", `{}`), method)
+	if got := paths(); len(got) != 10 {
+		t.Errorf("%d requests, want 10 runs of the single step", len(got))
+	}
+}
+
+/*
+ * The method of a step is routed as a message of that method
+ */
+func TestStepsMethodDedup(t *testing.T) {
+	push, requests := newPushServer(t)
+	Context := testContext()
+	Context.Config.Methods = map[string]_methodConfig{
+		"ticket": {
+			Dedup: &_dedupConfig{Key: "{{$.host}}", Window: 60000},
+			Ntfy:  []_outPushConfig{{Url: push.URL, Topic: "tickets", Message: "{{$.host}}"}},
+		},
+	}
+	method := &_methodConfig{Steps: []_stepConfig{{Method: "ticket"}}}
+
+	runSteps(testMessage(t, Context, "alert", `{"host":"web1"}`), method)
+	// the tag lists of the output are parsed by the first message
+	waitPushRequests(t, requests, 1)
+	for ActiveWorkers.Get() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for _, host := range []string{"web1", "web2"} {
+		runSteps(testMessage(t, Context, "alert", `{"host":"`+host+`"}`), method)
+	}
+	sent := waitPushRequests(t, requests, 2)
+	if sent[0].body["message"] == sent[1].body["message"] {
+		t.Errorf("messages %v, want one per host", sent)
+	}
+	if entry := Context.Dedup.entries["ticket\x00web1"]; entry == nil || entry.suppressed != 1 {
+		t.Errorf("entry %+v, want the repeat of web1 suppressed by the method", entry)
+	}
+}
+
+func noPushRequests(t *testing.T, requests func() []pushRequest) {
+	t.Helper()
+	waitPushRequests(t, requests, 0)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"strings"
 
@@ -12,6 +13,15 @@ import (
  * Receives input string and replaces {{JSONPath}} with actual value
  */
 func replaceJSONPathTags(msg_ctx *MessageContext, input string, tags_pp **[]string) string {
+	return replaceJSONPathTagsEscaped(msg_ctx, input, tags_pp, nil)
+}
+
+/*
+ * Same as replaceJSONPathTags, but values are escaped before the replace,
+ * so they cannot break the markup of the template
+ */
+func replaceJSONPathTagsEscaped(msg_ctx *MessageContext, input string, tags_pp **[]string,
+	escape func(string) string) string {
 	if *tags_pp == nil {
 		tagList := findTags(input)
 		*tags_pp = &tagList
@@ -25,9 +35,11 @@ func replaceJSONPathTags(msg_ctx *MessageContext, input string, tags_pp **[]stri
 
 	output := input
 	for _, tag := range *tags {
+		msg_ctx.cacheLock.Lock()
 		val, ok := msg_ctx.JSONPath_Cache[tag]
+		msg_ctx.cacheLock.Unlock()
 		if !ok {
-			tag_val, err := jsonpath.Get(tag, json_data)
+			tag_val, err := resolveTag(msg_ctx, tag, json_data)
 			if err != nil {
 				log.Printf("JSONPath: fail to resolve tag \"%s\" in string \"%s\" : %s", tag, input, err)
 				continue
@@ -42,15 +54,54 @@ func replaceJSONPathTags(msg_ctx *MessageContext, input string, tags_pp **[]stri
 				}
 				val = string(val_bytes)
 			}
+			msg_ctx.cacheLock.Lock()
 			msg_ctx.JSONPath_Cache[tag] = val
+			msg_ctx.cacheLock.Unlock()
 		}
 
+		if escape != nil {
+			val = escape(val)
+		}
 		output = strings.Replace(output, "{{"+tag+"}}", val, -1)
 	}
 
 	return output
 }
 
+/*
+ * {{peer.uid}} is resolved from the input peer credentials, {{steps.name.status}} from the results
+ * of the steps, anything else is JSONPath over params
+ */
+func resolveTag(msg_ctx *MessageContext, tag string, json_data interface{}) (interface{}, error) {
+	if strings.HasPrefix(tag, "steps.") {
+		if msg_ctx.Steps == nil {
+			return nil, fmt.Errorf("no steps for this message")
+		}
+		return jsonpath.Get("$."+strings.TrimPrefix(tag, "steps."), msg_ctx.Steps)
+	}
+	if strings.HasPrefix(tag, "peer.") {
+		if msg_ctx.Peer == nil {
+			return nil, fmt.Errorf("no peer credentials for this message")
+		}
+		return jsonpath.Get("$."+strings.TrimPrefix(tag, "peer."), msg_ctx.Peer)
+	}
+	return jsonpath.Get(tag, json_data)
+}
+
+/*
+ * Strings as they are, anything else JSON encoded
+ */
+func jsonValueString(val interface{}) string {
+	if str, ok := val.(string); ok {
+		return str
+	}
+	val_bytes, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Sprint(val)
+	}
+	return string(val_bytes)
+}
+
 // findTags returns a slice of all unique tags found in the input string.
 func findTags(input string) []string {
 	tags := make(map[string]bool) // Use a map to store unique tags
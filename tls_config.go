@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+/*
+ * Client TLS config of the outputs: CA file instead of the system roots,
+ * client certificate with its key, and skipped verification for internal endpoints
+ */
+func loadTlsConfig(ca_file, cert_file, key_file string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if ca_file != "" {
+		ca, err := os.ReadFile(ca_file)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in %s", ca_file)
+		}
+	}
+	if cert_file != "" {
+		cert, err := tls.LoadX509KeyPair(cert_file, key_file)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
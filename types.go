@@ -1,6 +1,9 @@
 package main
 
 import (
+	"net"
+	"net/http"
+	"regexp"
 	"sync"
 	"time"
 )
@@ -12,79 +15,229 @@ type JsonRpcRequest struct {
 	Id      interface{} `json:"id"`
 }
 
+type InputMessage struct {
+	Body string
+	Peer map[string]interface{} // unix socket peer credentials or broker topic, nil for other inputs
+}
+
 type MessageContext struct {
 	JsonRpc        JsonRpcRequest
-	JSONPath_Cache map[string]string // per message cache of resolved JSONPath tags
+	JSONPath_Cache map[string]string      // per message cache of resolved JSONPath tags
+	Peer           map[string]interface{} // resolves {{peer.*}} tags
+	Steps          map[string]interface{} // resolves {{steps.*}} tags, results of the done steps
 
-	Context *_context
+	cacheLock sync.Mutex // the outputs of a message resolve tags concurrently
+
+	Context  *_context
+	diverted bool // by a rate limit, not diverted again
 }
 
 // ========================================================
 // INPUTS
 // ========================================================
 type _inSocketConfig struct {
+	Name    string `mapstructure:"name"` // FileDescriptorName= of systemd socket
 	Type    string `mapstructure:"type"`
 	Address string `mapstructure:"address"`
 	Timeout uint32 `mapstructure:"timeout"`
+
+	// unix sockets only
+	Mode      string `mapstructure:"mode"`
+	Owner     string `mapstructure:"owner"`
+	Group     string `mapstructure:"group"`
+	AllowUids []int  `mapstructure:"allow-uids"`
+	AllowGids []int  `mapstructure:"allow-gids"`
+	DenyUids  []int  `mapstructure:"deny-uids"`
+	DenyGids  []int  `mapstructure:"deny-gids"`
 }
 
 type _inFolderConfig struct {
 	Path       string `mapstructure:"path"`
 	FilePrefix string `mapstructure:"file-prefix"`
 	FileSuffix string `mapstructure:"file-suffix"`
+	TmpSuffix  string `mapstructure:"tmp-suffix"` // files being written, default .tmp
+	Recursive  *bool  `mapstructure:"recursive"`  // default true
+	Watch      string `mapstructure:"watch"`      // inotify (default) or poll
+	Processed  string `mapstructure:"processed"`  // delete (default) or move
+	Failed     string `mapstructure:"failed"`     // move (default) or delete
+	DoneDir    string `mapstructure:"done-dir"`   // default <path>/done
+	FailedDir  string `mapstructure:"failed-dir"` // default <path>/failed
 	ScanTime   uint32 `mapstructure:"scan-time"`
 	Timeout    uint32 `mapstructure:"timeout"`
 }
 
 type _inPipeConfig struct {
-	Path    string `mapstructure:"path"`
-	Timeout uint32 `mapstructure:"timeout"`
+	Path      string  `mapstructure:"path"`
+	Delimiter *string `mapstructure:"delimiter"` // default "\n", "" for multi-line JSON with one message per read
+	Mode      string  `mapstructure:"mode"`      // default 0666
+	Owner     string  `mapstructure:"owner"`
+	Group     string  `mapstructure:"group"`
+	Timeout   uint32  `mapstructure:"timeout"` // a last message without delimiter is sent after it, default input_timeout
 }
 
 type _inHttpConfig struct {
+	Name    string `mapstructure:"name"` // FileDescriptorName= of systemd socket
 	Address string `mapstructure:"address"`
 	Timeout uint32 `mapstructure:"timeout"`
 }
 
+type _inDockerConfig struct {
+	Socket       string   `mapstructure:"socket"`
+	Events       []string `mapstructure:"events"`
+	Labels       []string `mapstructure:"labels"`
+	MethodPrefix string   `mapstructure:"method-prefix"`
+	LogLines     uint32   `mapstructure:"log-lines"`
+	ReconnectMin uint32   `mapstructure:"reconnect-min"`
+	ReconnectMax uint32   `mapstructure:"reconnect-max"`
+	Timeout      uint32   `mapstructure:"timeout"`
+}
+
+type _inTailRuleConfig struct {
+	Match    string `mapstructure:"match"`    // regex with named captures
+	Method   string `mapstructure:"method"`   // JSON-RPC method of the produced message
+	Field    string `mapstructure:"field"`    // journal field to match, default MESSAGE
+	Continue bool   `mapstructure:"continue"` // keep matching the next rules
+
+	regex *regexp.Regexp
+}
+
+type _inTailConfig struct {
+	Path       string              `mapstructure:"path"`
+	Format     string              `mapstructure:"format"` // lines or journal-export
+	OffsetFile string              `mapstructure:"offset-file"`
+	FromStart  bool                `mapstructure:"from-start"`
+	PollTime   uint32              `mapstructure:"poll-time"`
+	Rules      []_inTailRuleConfig `mapstructure:"rules"`
+}
+
 type _inputConfig struct {
 	Sockets []_inSocketConfig `mapstructure:"sockets"`
 	Folders []_inFolderConfig `mapstructure:"folders"`
 	Pipes   []_inPipeConfig   `mapstructure:"pipes"`
 	Http    []_inHttpConfig   `mapstructure:"http"`
+	Docker  []_inDockerConfig `mapstructure:"docker"`
+	Tail    []_inTailConfig   `mapstructure:"tail"`
+	Mqtt    []_inBrokerConfig `mapstructure:"mqtt"`
+	Nats    []_inBrokerConfig `mapstructure:"nats"`
+	Redis   []_inBrokerConfig `mapstructure:"redis"`
+	Amqp    []_inBrokerConfig `mapstructure:"amqp"`
+	Kafka   []_inBrokerConfig `mapstructure:"kafka"`
+}
+
+// MQTT, NATS, Redis, AMQP and Kafka connection of inputs and outputs
+type _brokerConnConfig struct {
+	Url                string `mapstructure:"url"` // kafka: comma separated brokers
+	User               string `mapstructure:"user"`
+	Password           string `mapstructure:"password"`
+	Token              string `mapstructure:"token"`     // nats
+	ClientId           string `mapstructure:"client-id"` // mqtt
+	Tls                bool   `mapstructure:"tls"`
+	CaFile             string `mapstructure:"ca-file"`
+	CertFile           string `mapstructure:"cert-file"`
+	KeyFile            string `mapstructure:"key-file"`
+	InsecureSkipVerify bool   `mapstructure:"insecure-skip-verify"`
+}
+
+type _inBrokerConfig struct {
+	_brokerConnConfig `mapstructure:",squash"`
+
+	Topics       []string `mapstructure:"topics"`   // or subjects, streams, queues
+	Group        string   `mapstructure:"group"`    // NATS queue group, MQTT shared subscription, Redis and Kafka consumer group
+	Consumer     string   `mapstructure:"consumer"` // redis consumer name, default hostname
+	Qos          *byte    `mapstructure:"qos"`      // mqtt, default 1
+	Field        string   `mapstructure:"field"`    // redis stream field, default message
+	Prefetch     uint32   `mapstructure:"prefetch"` // amqp, default 10
+	Method       string   `mapstructure:"method"`   // wrap the payload as params of this JSON-RPC method
+	ReconnectMin uint32   `mapstructure:"reconnect-min"`
+	ReconnectMax uint32   `mapstructure:"reconnect-max"`
+	Timeout      uint32   `mapstructure:"timeout"`
 }
 
 // ========================================================
 // OUTPUTS
 // ========================================================
+type _digestConfig struct {
+	Window  uint32 `mapstructure:"window"`  // milliseconds, enables the digest
+	Max     uint32 `mapstructure:"max"`     // sent before the end of the window, default 1000
+	Key     string `mapstructure:"key"`     // messages are grouped by the key
+	Item    string `mapstructure:"item"`    // line of {{$.list}} per message, default the params as JSON
+	Summary string `mapstructure:"summary"` // {{$.summary}}, resolved with the digest params
+
+	tags struct {
+		Key     *[]string
+		Item    *[]string
+		Summary *[]string
+	}
+
+	batch outputBatch[digestItem]
+}
+
+type _emailAttachmentConfig struct {
+	Name        string `mapstructure:"name"`
+	Content     string `mapstructure:"content"`
+	ContentType string `mapstructure:"content-type"` // default text/plain
+	Base64      bool   `mapstructure:"base64"`       // content is base64 encoded, e.g. in the params
+
+	tags struct {
+		Name    *[]string
+		Content *[]string
+	}
+}
+
 type _outEmailConfig struct {
-	SmtpHost string `mapstructure:"smtp-host"`
-	SmtpPort string `mapstructure:"smtp-port"`
-	SmtpUser string `mapstructure:"smtp-user"`
-	SmtpPass string `mapstructure:"smtp-pass"`
-	From     string `mapstructure:"from"`
-	To       string `mapstructure:"to"`
-	Subject  string `mapstructure:"subject"`
-	Body     string `mapstructure:"body"`
-	Timeout  uint32 `mapstructure:"timeout"`
+	SmtpHost           string                   `mapstructure:"smtp-host"`
+	SmtpPort           string                   `mapstructure:"smtp-port"`
+	SmtpUser           string                   `mapstructure:"smtp-user"`
+	SmtpPass           string                   `mapstructure:"smtp-pass"` // or OAuth 2.0 access token with xoauth2
+	SmtpAuth           string                   `mapstructure:"smtp-auth"` // plain, login, cram-md5, xoauth2, default by the server
+	Helo               string                   `mapstructure:"helo"`      // default hostname
+	Tls                bool                     `mapstructure:"tls"`       // implicit TLS, default for port 465
+	StartTls           string                   `mapstructure:"starttls"`  // required, opportunistic (default) or off
+	CaFile             string                   `mapstructure:"ca-file"`
+	InsecureSkipVerify bool                     `mapstructure:"insecure-skip-verify"`
+	PoolSize           *uint32                  `mapstructure:"pool-size"` // idle sessions kept per server, default 2
+	PoolIdle           uint32                   `mapstructure:"pool-idle"` // milliseconds, default 10000
+	From               string                   `mapstructure:"from"`
+	To                 []string                 `mapstructure:"to"` // address lists or JSON arrays of addresses
+	Cc                 []string                 `mapstructure:"cc"`
+	Bcc                []string                 `mapstructure:"bcc"`
+	ReplyTo            string                   `mapstructure:"reply-to"`
+	Headers            map[string]string        `mapstructure:"headers"`
+	Subject            string                   `mapstructure:"subject"`
+	Body               string                   `mapstructure:"body"` // text/plain
+	Html               string                   `mapstructure:"html"` // text/html, params are HTML escaped
+	Attachments        []_emailAttachmentConfig `mapstructure:"attachments"`
+	Digest             _digestConfig            `mapstructure:"digest"`
+	RateLimit          *_rateLimitConfig        `mapstructure:"rate-limit"`
+	Timeout            uint32                   `mapstructure:"timeout"`
 
 	// Cache parsed TAGs from parsed strings
 	tags struct {
-		SmtpHost *[]string
-		SmtpPort *[]string
-		SmtpUser *[]string
-		SmtpPass *[]string
-		From     *[]string
-		To       *[]string
-		Subject  *[]string
-		Body     *[]string
+		SmtpHost     *[]string
+		SmtpPort     *[]string
+		SmtpUser     *[]string
+		SmtpPass     *[]string
+		From         *[]string
+		To           []*[]string
+		Cc           []*[]string
+		Bcc          []*[]string
+		ReplyTo      *[]string
+		HeadersNames []string
+		HeadersVals  []*[]string
+		Subject      *[]string
+		Body         *[]string
+		Html         *[]string
 	}
+
+	pool smtpPool
 }
 
 type _outSocketConfig struct {
-	Type    string `mapstructure:"type"`
-	Address string `mapstructure:"address"`
-	Message string `mapstructure:"message"`
-	Timeout uint32 `mapstructure:"timeout"`
+	Type      string            `mapstructure:"type"`
+	Address   string            `mapstructure:"address"`
+	Message   string            `mapstructure:"message"`
+	RateLimit *_rateLimitConfig `mapstructure:"rate-limit"`
+	Timeout   uint32            `mapstructure:"timeout"`
 
 	tags struct {
 		Type    *[]string
@@ -93,12 +246,25 @@ type _outSocketConfig struct {
 	}
 }
 
-type _outHttpPostConfig struct {
-	Url     string              `mapstructure:"url"`
-	Method  string              `mapstructure:"method"`
-	Headers []map[string]string `mapstructure:"headers"`
-	Body    string              `mapstructure:"body"`
-	Timeout uint32              `mapstructure:"timeout"`
+type _outHttpConfig struct {
+	Url                string              `mapstructure:"url"`
+	Method             string              `mapstructure:"method"`
+	Headers            []map[string]string `mapstructure:"headers"`
+	Body               string              `mapstructure:"body"`
+	ExpectStatus       []string            `mapstructure:"expect-status"` // codes or ranges like 200-299, the default
+	ExpectBody         string              `mapstructure:"expect-body"`   // regexp the response body must match
+	BodyLimit          uint32              `mapstructure:"body-limit"`    // bytes of the response read, default 1MB
+	Retries            uint32              `mapstructure:"retries"`
+	RetryStatus        []string            `mapstructure:"retry-status"` // default 429 and 500-599
+	RetryDelay         uint32              `mapstructure:"retry-delay"`  // default 1000, doubled each retry
+	Proxy              string              `mapstructure:"proxy"`        // url or none, default from HTTP_PROXY etc.
+	CaFile             string              `mapstructure:"ca-file"`
+	CertFile           string              `mapstructure:"cert-file"` // client certificate
+	KeyFile            string              `mapstructure:"key-file"`
+	InsecureSkipVerify bool                `mapstructure:"insecure-skip-verify"`
+	Digest             _digestConfig       `mapstructure:"digest"`
+	RateLimit          *_rateLimitConfig   `mapstructure:"rate-limit"`
+	Timeout            uint32              `mapstructure:"timeout"`
 
 	tags struct {
 		Url         *[]string
@@ -107,24 +273,369 @@ type _outHttpPostConfig struct {
 		HeadersVals []*[]string
 		Body        *[]string
 	}
+
+	client struct { // keep-alive connections reused across messages
+		sync.Once
+		c            *http.Client
+		expectStatus []statusRange
+		retryStatus  []statusRange
+		expectBody   *regexp.Regexp
+		err          error
+	}
+}
+
+type _execRlimitsConfig struct {
+	Cpu        *uint64 `mapstructure:"cpu"`          // seconds
+	MemoryMb   *uint64 `mapstructure:"memory-mb"`    // address space
+	Files      *uint64 `mapstructure:"files"`        // open files
+	Processes  *uint64 `mapstructure:"processes"`    // of the user, not enforced for root
+	FileSizeMb *uint64 `mapstructure:"file-size-mb"` // largest written file
 }
 
 type _execCommandConfig struct {
-	Cmd     string   `mapstructure:"cmd"`
-	Args    []string `mapstructure:"args"`
-	Timeout uint32   `mapstructure:"timeout"`
+	Cmd           string             `mapstructure:"cmd"`
+	Args          []string           `mapstructure:"args"`
+	Shell         bool               `mapstructure:"shell"` // cmd is a /bin/sh script, params are quoted, args are $1...
+	Stdin         string             `mapstructure:"stdin"` // e.g. '{{$}}' for the params as JSON
+	Env           []string           `mapstructure:"env"`   // NAME=value added to the environment
+	Dir           string             `mapstructure:"dir"`
+	User          string             `mapstructure:"user"`          // name or uid to run as, needs root
+	Group         string             `mapstructure:"group"`         // default the primary group of the user
+	LogOutput     bool               `mapstructure:"log-output"`    // log stdout and stderr on success too
+	SuccessCodes  []int              `mapstructure:"success-codes"` // exit codes besides 0 treated as success
+	Rlimits       _execRlimitsConfig `mapstructure:"rlimits"`
+	Setsid        bool               `mapstructure:"setsid"`         // new session without controlling tty
+	Namespaces    []string           `mapstructure:"namespaces"`     // net, ipc, uts, pid, mount, user
+	NoNewPrivs    bool               `mapstructure:"no-new-privs"`   // setuid binaries do not gain privileges
+	SeccompDeny   []string           `mapstructure:"seccomp-deny"`   // syscalls failing with EPERM
+	MaxConcurrent uint32             `mapstructure:"max-concurrent"` // running at once, others wait up to timeout
+	RateLimit     *_rateLimitConfig  `mapstructure:"rate-limit"`
+	Timeout       uint32             `mapstructure:"timeout"` // default exec_timeout
+
+	tags struct {
+		Cmd   *[]string
+		Args  []*[]string
+		Stdin *[]string
+		Env   []*[]string
+		Dir   *[]string
+	}
+
+	slots     chan bool // max-concurrent
+	slotsOnce sync.Once
+}
+
+type _chatFieldConfig struct {
+	Title string `mapstructure:"title"`
+	Value string `mapstructure:"value"`
+	Short bool   `mapstructure:"short"`
+}
+
+// Slack, Mattermost, Microsoft Teams and Discord
+type _outChatConfig struct {
+	Url       string             `mapstructure:"url"`   // webhook, or API url with token
+	Token     string             `mapstructure:"token"` // Slack and Mattermost API instead of webhook
+	Channel   string             `mapstructure:"channel"`
+	Username  string             `mapstructure:"username"`
+	Icon      string             `mapstructure:"icon"` // url or :emoji:
+	Title     string             `mapstructure:"title"`
+	Text      string             `mapstructure:"text"`
+	Severity  string             `mapstructure:"severity"`
+	Colors    map[string]string  `mapstructure:"colors"` // severity -> #RRGGBB
+	Mentions  []string           `mapstructure:"mentions"`
+	Fields    []_chatFieldConfig `mapstructure:"fields"`
+	ThreadKey string             `mapstructure:"thread-key"`
+	ThreadTtl uint32             `mapstructure:"thread-ttl"` // since the last message of the thread, default 86400000 (a day)
+	Digest    _digestConfig      `mapstructure:"digest"`
+	Retries   *uint32            `mapstructure:"retries"` // on 429, default 3
+	RateLimit *_rateLimitConfig  `mapstructure:"rate-limit"`
+	Timeout   uint32             `mapstructure:"timeout"`
+
+	tags struct {
+		Url          *[]string
+		Token        *[]string
+		Channel      *[]string
+		Username     *[]string
+		Icon         *[]string
+		Title        *[]string
+		Text         *[]string
+		Severity     *[]string
+		ThreadKey    *[]string
+		Mentions     []*[]string
+		FieldsTitles []*[]string
+		FieldsValues []*[]string
+	}
+
+	threads chatThreads
+}
+
+type _outTelegramConfig struct {
+	ApiUrl    string            `mapstructure:"api-url"` // default https://api.telegram.org
+	Token     string            `mapstructure:"token"`
+	ChatIds   []string          `mapstructure:"chat-ids"`
+	Text      string            `mapstructure:"text"`
+	ParseMode string            `mapstructure:"parse-mode"` // MarkdownV2, HTML or empty for plain text
+	Silent    bool              `mapstructure:"silent"`
+	ThreadId  string            `mapstructure:"thread-id"`
+	Digest    _digestConfig     `mapstructure:"digest"`
+	Retries   *uint32           `mapstructure:"retries"` // on 429, default 3
+	RateLimit *_rateLimitConfig `mapstructure:"rate-limit"`
+	Timeout   uint32            `mapstructure:"timeout"`
+
+	tags struct {
+		Token    *[]string
+		ChatIds  []*[]string
+		Text     *[]string
+		ThreadId *[]string
+	}
+}
+
+// ntfy, Gotify and Pushover
+type _outPushConfig struct {
+	Url             string            `mapstructure:"url"`   // server, default https://ntfy.sh and https://api.pushover.net
+	Topic           string            `mapstructure:"topic"` // ntfy
+	Token           string            `mapstructure:"token"` // ntfy access token, Gotify and Pushover application token
+	User            string            `mapstructure:"user"`  // ntfy user, Pushover user or group key
+	Password        string            `mapstructure:"password"`
+	Title           string            `mapstructure:"title"`
+	Message         string            `mapstructure:"message"`
+	Priority        string            `mapstructure:"priority"`   // number or severity name
+	Priorities      map[string]int    `mapstructure:"priorities"` // severity -> priority
+	Tags            []string          `mapstructure:"tags"`       // ntfy tags and emoji short codes
+	Click           string            `mapstructure:"click"`
+	Attach          string            `mapstructure:"attach"`           // url of attachment
+	AttachTemplated bool              `mapstructure:"attach-templated"` // Pushover downloads attach, opt-in for a templated url
+	Digest          _digestConfig     `mapstructure:"digest"`
+	Retries         *uint32           `mapstructure:"retries"`
+	RateLimit       *_rateLimitConfig `mapstructure:"rate-limit"`
+	Timeout         uint32            `mapstructure:"timeout"`
+
+	tags struct {
+		Url      *[]string
+		Topic    *[]string
+		Token    *[]string
+		User     *[]string
+		Password *[]string
+		Title    *[]string
+		Message  *[]string
+		Priority *[]string
+		Tags     []*[]string
+		Click    *[]string
+		Attach   *[]string
+	}
+}
+
+// PagerDuty and Opsgenie
+type _outIncidentConfig struct {
+	Url           string            `mapstructure:"url"`
+	Key           string            `mapstructure:"key"` // PagerDuty routing key, Opsgenie API key
+	Severity      string            `mapstructure:"severity"`
+	Summary       string            `mapstructure:"summary"`
+	Source        string            `mapstructure:"source"`
+	DedupKey      string            `mapstructure:"dedup-key"`
+	Status        string            `mapstructure:"status"`         // e.g. {{$.status}}
+	ResolveOn     []string          `mapstructure:"resolve-on"`     // status values, default resolved and ok
+	AcknowledgeOn []string          `mapstructure:"acknowledge-on"` // status values, default acknowledged
+	Tags          []string          `mapstructure:"tags"`           // Opsgenie
+	Retries       *uint32           `mapstructure:"retries"`
+	RateLimit     *_rateLimitConfig `mapstructure:"rate-limit"`
+	Timeout       uint32            `mapstructure:"timeout"`
+
+	tags struct {
+		Url      *[]string
+		Key      *[]string
+		Severity *[]string
+		Summary  *[]string
+		Source   *[]string
+		DedupKey *[]string
+		Status   *[]string
+		Tags     []*[]string
+	}
+}
+
+type _outSyslogConfig struct {
+	Network            string            `mapstructure:"network"` // udp (default), tcp, tls, unix, unixgram
+	Address            string            `mapstructure:"address"`
+	Format             string            `mapstructure:"format"`  // rfc5424 (default) or rfc3164
+	Framing            string            `mapstructure:"framing"` // octet-counting (default) or non-transparent
+	Facility           string            `mapstructure:"facility"`
+	Severity           string            `mapstructure:"severity"`
+	Hostname           string            `mapstructure:"hostname"`
+	AppName            string            `mapstructure:"app-name"`
+	MsgId              string            `mapstructure:"msgid"`
+	SdId               string            `mapstructure:"sd-id"` // params as structured data, e.g. params@32473
+	Message            string            `mapstructure:"message"`
+	CaFile             string            `mapstructure:"ca-file"`
+	InsecureSkipVerify bool              `mapstructure:"insecure-skip-verify"`
+	RateLimit          *_rateLimitConfig `mapstructure:"rate-limit"`
+	Timeout            uint32            `mapstructure:"timeout"`
 
 	tags struct {
-		Cmd  *[]string
-		Args []*[]string
+		Severity *[]string
+		MsgId    *[]string
+		Message  *[]string
+	}
+
+	conn struct { // reused across messages
+		sync.Mutex
+		c      net.Conn
+		closed bool // by config reload, the messages in flight do not keep it
 	}
 }
 
+type _outZabbixConfig struct {
+	Address       string            `mapstructure:"address"` // server or proxy, host:10051
+	Host          string            `mapstructure:"host"`
+	Key           string            `mapstructure:"key"`
+	Value         string            `mapstructure:"value"`
+	Clock         string            `mapstructure:"clock"`       // unix time, default now
+	BatchTime     uint32            `mapstructure:"batch-time"`  // milliseconds, default 200
+	BatchSize     uint32            `mapstructure:"batch-size"`  // default 250
+	TlsConnect    string            `mapstructure:"tls-connect"` // unencrypted (default) or cert
+	TlsCaFile     string            `mapstructure:"tls-ca-file"`
+	TlsCertFile   string            `mapstructure:"tls-cert-file"`
+	TlsKeyFile    string            `mapstructure:"tls-key-file"`
+	TlsServerName string            `mapstructure:"tls-server-name"`
+	RateLimit     *_rateLimitConfig `mapstructure:"rate-limit"`
+	Timeout       uint32            `mapstructure:"timeout"`
+
+	tags struct {
+		Host  *[]string
+		Key   *[]string
+		Value *[]string
+		Clock *[]string
+	}
+
+	batch outputBatch[zabbixValue]
+}
+
+// StatsD, Graphite and InfluxDB
+type _outMetricConfig struct {
+	Network    string            `mapstructure:"network"` // udp (default), tcp, unix, unixgram
+	Address    string            `mapstructure:"address"`
+	Url        string            `mapstructure:"url"`   // InfluxDB write API instead of socket
+	Token      string            `mapstructure:"token"` // InfluxDB API token
+	Prefix     string            `mapstructure:"prefix"`
+	Name       string            `mapstructure:"name"` // metric name or measurement
+	Type       string            `mapstructure:"type"` // statsd: counter (default), gauge, timer, histogram, set
+	Value      string            `mapstructure:"value"`
+	SampleRate float64           `mapstructure:"sample-rate"`
+	Tags       map[string]string `mapstructure:"tags"`
+	Fields     map[string]string `mapstructure:"fields"` // InfluxDB, default value=<value>
+	Timestamp  string            `mapstructure:"timestamp"`
+	BatchTime  uint32            `mapstructure:"batch-time"` // milliseconds, default 100
+	BatchSize  uint32            `mapstructure:"batch-size"` // default 100
+	RateLimit  *_rateLimitConfig `mapstructure:"rate-limit"`
+	Timeout    uint32            `mapstructure:"timeout"`
+
+	tags struct {
+		Name        *[]string
+		Value       *[]string
+		Timestamp   *[]string
+		TagsNames   []string
+		TagsKeys    []*[]string
+		TagsVals    []*[]string
+		FieldsNames []string
+		FieldsVals  []*[]string
+	}
+
+	batch outputBatch[string]
+}
+
+// MQTT, NATS, Redis, AMQP and Kafka
+type _outBrokerConfig struct {
+	_brokerConnConfig `mapstructure:",squash"`
+
+	Topic     string            `mapstructure:"topic"`    // or subject, stream, channel, routing key
+	Key       string            `mapstructure:"key"`      // kafka partitioning key
+	Exchange  string            `mapstructure:"exchange"` // amqp
+	Qos       byte              `mapstructure:"qos"`      // mqtt
+	Retain    bool              `mapstructure:"retain"`   // mqtt
+	Command   string            `mapstructure:"command"`  // redis: xadd (default) or publish
+	Field     string            `mapstructure:"field"`    // redis stream field, default message
+	MaxLen    int64             `mapstructure:"max-len"`  // redis stream approximate MAXLEN
+	Message   string            `mapstructure:"message"`  // default {{$}}
+	RateLimit *_rateLimitConfig `mapstructure:"rate-limit"`
+	Timeout   uint32            `mapstructure:"timeout"`
+	Retries   *uint32           `mapstructure:"retries"` // default 3
+
+	tags struct {
+		Topic    *[]string
+		Key      *[]string
+		Exchange *[]string
+		Message  *[]string
+	}
+
+	client struct { // reused across messages
+		sync.Mutex
+		c      brokerClient
+		closed bool
+	}
+}
+
+type _rateLimitConfig struct {
+	Rate     float64 `mapstructure:"rate"`      // messages per interval
+	Interval uint32  `mapstructure:"interval"`  // milliseconds, default 1000
+	Burst    uint32  `mapstructure:"burst"`     // default the rate
+	Key      string  `mapstructure:"key"`       // bucket per key, default one bucket (per source for inputs)
+	Action   string  `mapstructure:"action"`    // drop (default), delay or divert
+	Method   string  `mapstructure:"method"`    // divert to this method
+	MaxDelay uint32  `mapstructure:"max-delay"` // milliseconds, longer delays are dropped, default 10000
+
+	tags struct {
+		Key *[]string
+	}
+
+	buckets rateBuckets
+}
+
+type _dedupConfig struct {
+	Key            string `mapstructure:"key"`             // fingerprint, default the params as JSON
+	Window         uint32 `mapstructure:"window"`          // milliseconds, default 60000
+	FollowupMethod string `mapstructure:"followup-method"` // default the method of the message
+	Persistent     bool   `mapstructure:"persistent"`      // kept on reload
+
+	tags struct {
+		Key *[]string
+	}
+}
+
+type _stepConfig struct {
+	Name      string              `mapstructure:"name"`
+	Http      *_outHttpConfig     `mapstructure:"http"`
+	Exec      *_execCommandConfig `mapstructure:"exec"`
+	Method    string              `mapstructure:"method"`     // runs the outputs of the method, with {{steps.*}}
+	OnSuccess string              `mapstructure:"on-success"` // continue (default), stop or name of the next step
+	OnFailure string              `mapstructure:"on-failure"` // stop (default), continue or name of the next step
+}
+
 type _methodConfig struct {
-	Email  []_outEmailConfig    `mapstructure:"email"`
-	Http   []_outHttpPostConfig `mapstructure:"http"`
-	Socket []_outSocketConfig   `mapstructure:"socket"`
-	Exec   []_execCommandConfig `mapstructure:"exec"`
+	RateLimit  *_rateLimitConfig    `mapstructure:"rate-limit"`
+	Dedup      *_dedupConfig        `mapstructure:"dedup"`
+	Steps      []_stepConfig        `mapstructure:"steps"` // run in order, next to the outputs
+	Email      []_outEmailConfig    `mapstructure:"email"`
+	Http       []_outHttpConfig     `mapstructure:"http"`
+	Socket     []_outSocketConfig   `mapstructure:"socket"`
+	Exec       []_execCommandConfig `mapstructure:"exec"`
+	Slack      []_outChatConfig     `mapstructure:"slack"`
+	Mattermost []_outChatConfig     `mapstructure:"mattermost"`
+	Teams      []_outChatConfig     `mapstructure:"teams"`
+	Discord    []_outChatConfig     `mapstructure:"discord"`
+	Telegram   []_outTelegramConfig `mapstructure:"telegram"`
+	Ntfy       []_outPushConfig     `mapstructure:"ntfy"`
+	Gotify     []_outPushConfig     `mapstructure:"gotify"`
+	Pushover   []_outPushConfig     `mapstructure:"pushover"`
+	PagerDuty  []_outIncidentConfig `mapstructure:"pagerduty"`
+	Opsgenie   []_outIncidentConfig `mapstructure:"opsgenie"`
+	Syslog     []_outSyslogConfig   `mapstructure:"syslog"`
+	Zabbix     []_outZabbixConfig   `mapstructure:"zabbix"`
+	Statsd     []_outMetricConfig   `mapstructure:"statsd"`
+	Graphite   []_outMetricConfig   `mapstructure:"graphite"`
+	Influxdb   []_outMetricConfig   `mapstructure:"influxdb"`
+	Mqtt       []_outBrokerConfig   `mapstructure:"mqtt"`
+	Nats       []_outBrokerConfig   `mapstructure:"nats"`
+	Redis      []_outBrokerConfig   `mapstructure:"redis"`
+	Amqp       []_outBrokerConfig   `mapstructure:"amqp"`
+	Kafka      []_outBrokerConfig   `mapstructure:"kafka"`
 }
 
 type _context struct {
@@ -134,6 +645,8 @@ type _context struct {
 
 		QueueSize uint32 `mapstructure:"queue_size"`
 		Workers   uint32 `mapstructure:"workers"`
+
+		RateLimit *_rateLimitConfig `mapstructure:"rate_limit"` // per input source
 	}
 
 	// Default timeouts
@@ -141,7 +654,10 @@ type _context struct {
 	OutputTimeout time.Duration
 	ExecTimeout   time.Duration
 
-	Messages     chan string
+	Messages     chan InputMessage
 	ActiveInputs sync.WaitGroup
+	InputsReady  sync.WaitGroup // done when all inputs are listening
 	StopChan     chan bool
+
+	Dedup dedupState
 }